@@ -1,9 +1,22 @@
+-- The script can be run again on an existing database: everything is
+-- created only if missing, and section 8 brings tables created by an
+-- older version of this file up to date.
+
 -- ==============================
 -- 1) Create ENUM types
 -- ==============================
-CREATE TYPE order_type_enum AS ENUM ('MARKET', 'LIMIT', 'STOP_LOSS', 'STOP_LIMIT');
-CREATE TYPE order_status_enum AS ENUM ('OPEN', 'PARTIALLY_FILLED', 'FILLED', 'CANCELED');
-CREATE TYPE trade_type_enum AS ENUM ('BUY', 'SELL');
+DO $$ BEGIN
+    CREATE TYPE order_type_enum AS ENUM ('MARKET', 'LIMIT', 'STOP_LOSS', 'STOP_LIMIT');
+EXCEPTION WHEN duplicate_object THEN NULL;
+END $$;
+DO $$ BEGIN
+    CREATE TYPE order_status_enum AS ENUM ('OPEN', 'PARTIALLY_FILLED', 'FILLED', 'CANCELED', 'REJECTED');
+EXCEPTION WHEN duplicate_object THEN NULL;
+END $$;
+DO $$ BEGIN
+    CREATE TYPE trade_type_enum AS ENUM ('BUY', 'SELL');
+EXCEPTION WHEN duplicate_object THEN NULL;
+END $$;
 
 -- ==============================
 -- 2) Users Table (Now Includes Username)
@@ -28,14 +41,18 @@ CREATE TABLE IF NOT EXISTS trades (
     symbol          VARCHAR(20)     NOT NULL,
     trade_type      trade_type_enum NOT NULL,
     executed_price  NUMERIC(12,2)   NOT NULL,
-    quantity        INT             NOT NULL,
+    quantity        NUMERIC(18,6)   NOT NULL,
+    -- buy_stream entry id and leg index ("<id>:<leg>"), unique so a
+    -- redelivered trade event is only written once
+    event_id        VARCHAR(64),
     created_at      TIMESTAMP       NOT NULL DEFAULT CURRENT_TIMESTAMP,
     updated_at      TIMESTAMP       NOT NULL DEFAULT CURRENT_TIMESTAMP,
 
     CONSTRAINT fk_user_trades
         FOREIGN KEY (user_id)
         REFERENCES users (id)
-        ON DELETE CASCADE
+        ON DELETE CASCADE,
+    CONSTRAINT unique_trade_event UNIQUE (event_id)
 );
 
 -- ==============================
@@ -45,7 +62,7 @@ CREATE TABLE IF NOT EXISTS positions (
     id              SERIAL          PRIMARY KEY,
     user_id         INT             NOT NULL,
     symbol          VARCHAR(20)     NOT NULL,
-    quantity        INT             NOT NULL DEFAULT 0,
+    quantity        NUMERIC(18,6)   NOT NULL DEFAULT 0,
     average_price   NUMERIC(12,2)   NOT NULL DEFAULT 0.00,
     created_at      TIMESTAMP       DEFAULT CURRENT_TIMESTAMP,
     updated_at      TIMESTAMP       DEFAULT CURRENT_TIMESTAMP,
@@ -64,8 +81,12 @@ CREATE TABLE IF NOT EXISTS orders (
     order_type      order_type_enum     NOT NULL DEFAULT 'MARKET',
     trade_type      trade_type_enum     NOT NULL,
     status          order_status_enum   NOT NULL DEFAULT 'OPEN',
-    quantity        INT                 NOT NULL,
+    quantity        NUMERIC(18,6)       NOT NULL,
     price           NUMERIC(12,2),
+    stop_price      NUMERIC(12,2),
+    triggered_price NUMERIC(12,2),
+    triggered_at    TIMESTAMP,
+    idempotency_key VARCHAR(255),
     created_at      TIMESTAMP           NOT NULL DEFAULT CURRENT_TIMESTAMP,
     updated_at      TIMESTAMP           NOT NULL DEFAULT CURRENT_TIMESTAMP,
 
@@ -102,4 +123,66 @@ CREATE TABLE IF NOT EXISTS watchlist_items (
         FOREIGN KEY (watchlist_id)
         REFERENCES watchlists (id)
         ON DELETE CASCADE
-);
\ No newline at end of file
+);
+-- ==============================
+-- 7) Price History (Ticks and OHLCV Bars)
+-- ==============================
+-- every quote the trading service sees, kept briefly to build 1m bars
+CREATE TABLE IF NOT EXISTS price_ticks (
+    symbol          VARCHAR(20)     NOT NULL,
+    ts              TIMESTAMPTZ     NOT NULL,
+    bid             NUMERIC(12,2)   NOT NULL,
+    ask             NUMERIC(12,2)   NOT NULL,
+    last            NUMERIC(12,2)   NOT NULL,
+
+    PRIMARY KEY (symbol, ts)
+);
+
+CREATE INDEX IF NOT EXISTS idx_price_ticks_ts ON price_ticks (ts);
+
+-- interval is '1m', '5m', '1h' or '1d'; bucket is the start of the bar and
+-- volume the quantity traded through this service
+CREATE TABLE IF NOT EXISTS price_bars (
+    symbol          VARCHAR(20)     NOT NULL,
+    interval        VARCHAR(3)      NOT NULL,
+    bucket          TIMESTAMPTZ     NOT NULL,
+    open            NUMERIC(12,2)   NOT NULL,
+    high            NUMERIC(12,2)   NOT NULL,
+    low             NUMERIC(12,2)   NOT NULL,
+    close           NUMERIC(12,2)   NOT NULL,
+    volume          NUMERIC(18,6)   NOT NULL DEFAULT 0,
+    tick_count      INT             NOT NULL DEFAULT 0,
+
+    PRIMARY KEY (symbol, interval, bucket)
+);
+
+CREATE INDEX IF NOT EXISTS idx_price_bars_retention ON price_bars (interval, bucket);
+
+CREATE INDEX IF NOT EXISTS idx_trades_symbol_created ON trades (symbol, created_at);
+
+-- the writers look up a user's newest trade before writing their balance
+CREATE INDEX IF NOT EXISTS idx_trades_user ON trades (user_id);
+
+-- ==============================
+-- 8) Migrations for databases created from an older db.sql
+-- ==============================
+-- fractional shares: quantities were whole-share INT columns
+ALTER TABLE trades    ALTER COLUMN quantity TYPE NUMERIC(18,6);
+ALTER TABLE positions ALTER COLUMN quantity TYPE NUMERIC(18,6);
+ALTER TABLE orders    ALTER COLUMN quantity TYPE NUMERIC(18,6);
+
+-- trade event ids, so a redelivered trade event is only written once
+ALTER TABLE trades ADD COLUMN IF NOT EXISTS event_id VARCHAR(64);
+DO $$ BEGIN
+    ALTER TABLE trades ADD CONSTRAINT unique_trade_event UNIQUE (event_id);
+EXCEPTION WHEN duplicate_table OR duplicate_object THEN NULL;
+END $$;
+
+-- stop orders and idempotency keys
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS stop_price      NUMERIC(12,2);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS triggered_price NUMERIC(12,2);
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS triggered_at    TIMESTAMP;
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS idempotency_key VARCHAR(255);
+
+-- orders the workers refuse to execute; run outside a transaction block
+ALTER TYPE order_status_enum ADD VALUE IF NOT EXISTS 'REJECTED';
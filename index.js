@@ -2,7 +2,8 @@ import express from "express";
 import redis from "./redis.js";
 import pool from "./db.js"
 import fetchStockPrices  from "./services/stockService.js";
-import {storeBalanceToRedis,storePositionsToRedis} from './services/balancePositions.js'
+import {getAllLastPrices} from "./services/priceStore.js";
+// user_balance and positions:* are hydrated by the Go trading service (services/hydrate)
 
 import {pushLeaderboard} from "./wsServer.js"
 const app = express()
@@ -22,7 +23,7 @@ async function updateLeaderboard() {
       INNER JOIN positions p 
       ON u.id = p.user_id
       `),
-      redis.hGetAll("stockPrices")
+      getAllLastPrices()
       
     ]);
     // const start = Date.now()
@@ -77,10 +78,6 @@ async function updateLeaderboard() {
       throw error;
   }
 }
-await storeBalanceToRedis();
-setInterval(async()=>{await storeBalanceToRedis()}, 60000 * 10)
-await storePositionsToRedis();
-setInterval(async()=>{await storePositionsToRedis()}, 60000 * 10)
 await fetchStockPrices();
 setInterval(async()=>{await fetchStockPrices()}, 360000); 
 await updateLeaderboard();
@@ -1,6 +1,7 @@
 import express from 'express';
 import pool from '../../../db.js';
 import redis from '../../../redis.js';
+import { getLastPrices } from '../../../services/priceStore.js';
 
 import axios from 'axios';
 import authenticateToken from '../../../middleware/authMiddleware.js';
@@ -28,7 +29,7 @@ router.get('/portfolio', authenticateToken, async (req,res)=>{
         const positions = await redis.hGetAll(`positions:${userId}`)
         const stock_symbols = Object.keys(positions)
         const stock_values = Object.values(positions)
-        const prices = await redis.sendCommand(["HMGET", "stockPrices", ...stock_symbols]);
+        const prices = await getLastPrices(stock_symbols);
         stock_symbols.forEach((symbol,index)=>{
             const [quantity, avgPrice] = stock_values[index].split(",").map(Number);
             total_investment += quantity * avgPrice
@@ -1,6 +1,7 @@
 import express from 'express';
 import pool from '../../../db.js';
 import redis from '../../../redis.js';
+import { getLastPrices } from '../../../services/priceStore.js';
 
 import axios from 'axios';
 import authenticateToken from '../../../middleware/authMiddleware.js';
@@ -26,8 +27,7 @@ router.post('/new_trade', async (req, res) => {
                            VALUES ${trades.map((_, i) => `($${i * 5 + 1}, $${i * 5 + 2}, $${i * 5 + 3}, $${i * 5 + 4}, $${i * 5 + 5})`).join(", ")}`;
 
         // Fetch latest stock prices from Redis
-        const pricePromises = trades.map(trade => redis.get(trade.symbol));
-        const stockPrices = await Promise.all(pricePromises);
+        const stockPrices = await getLastPrices(trades.map(trade => trade.symbol));
 
         const queryValues = trades.flatMap(({ userId, symbol, quantity, action }, index) => [
             userId,
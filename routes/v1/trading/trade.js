@@ -1,6 +1,7 @@
 import express from 'express';
 import pool from '../../../db.js';
 import redis from '../../../redis.js';
+import { getLastPrices } from '../../../services/priceStore.js';
 import authenticateToken from '../../../middleware/authMiddleware.js';
 import 'dotenv/config';
 
@@ -82,7 +83,7 @@ router.post('/trade', async (req,res)=>{
                 return res.status(404).json({error:"User not found"})
             }
             const balance = parseFloat(userResult.rows[0].balance)
-            const prices = await redis.sendCommand(["HMGET", "stockPrices", ...stock_symbols]);
+            const prices = await getLastPrices(stock_symbols);
             // const total = stock.reduce((sum,s,index) => sum + (s.quantity) * (prices[index]))
             const total = stock.reduce((sum, s) => {
                 const stockPrice = prices[s.symbol] || 0;  // Ensure price lookup works
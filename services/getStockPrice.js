@@ -1,10 +1,10 @@
-import redis from "../redis.js"
+import { getLastPrices } from "./priceStore.js"
 export default async function getStockPrice(symbol){
-    const price = await redis.get(symbol)
+    const [price] = await getLastPrices([symbol])
     if (price){
         return parseFloat(price)
 
     }else{
         return null
     }
-}
\ No newline at end of file
+}
@@ -0,0 +1,43 @@
+import redis from "../redis.js";
+
+// Prices live in one hash per symbol, quote:<SYMBOL>, with the fields bid,
+// ask, last and updated_at (unix ms). The Go trading service reads the same
+// schema (trading-service/redis/priceStore.go) and listens on QUOTE_CHANNEL.
+export const QUOTE_CHANNEL = "quotes:updates";
+const quoteKey = (symbol) => `quote:${symbol}`;
+
+// putQuotes stores quotes ({symbol, bid, ask, last, updated_at}) and
+// publishes them so the Go price cache updates right away.
+export async function putQuotes(quotes) {
+    if (quotes.length === 0) return;
+    const multi = redis.multi();
+    for (const quote of quotes) {
+        multi.hSet(quoteKey(quote.symbol), {
+            bid: quote.bid.toString(),
+            ask: quote.ask.toString(),
+            last: quote.last.toString(),
+            updated_at: quote.updated_at.toString(),
+        });
+    }
+    multi.publish(QUOTE_CHANNEL, JSON.stringify(quotes));
+    await multi.exec();
+}
+
+// getLastPrices returns the last price of each symbol, in order, or null
+// for a symbol without a quote (like HMGET on the old stockPrices hash).
+export async function getLastPrices(symbols) {
+    if (symbols.length === 0) return [];
+    const multi = redis.multi();
+    symbols.forEach(symbol => multi.hGet(quoteKey(symbol), "last"));
+    return multi.exec();
+}
+
+// getAllLastPrices returns { symbol: last } for every quote.
+export async function getAllLastPrices() {
+    const symbols = [];
+    for await (const key of redis.scanIterator({ MATCH: "quote:*", COUNT: 500 })) {
+        symbols.push(key.slice("quote:".length));
+    }
+    const prices = await getLastPrices(symbols);
+    return Object.fromEntries(symbols.map((symbol, i) => [symbol, prices[i]]).filter(([, price]) => price !== null));
+}
@@ -2,6 +2,7 @@ import axios from "axios";
 import redis from "../redis.js"
 import "dotenv/config";
 import {pushStockPrices} from "../wsServer.js";
+import {putQuotes} from "./priceStore.js";
 const localStockCache = new Map(); // Local in-memory storage
 const STOCK_API_KEY = process.env.STOCK_API_KEY
 const STOCKS = [
@@ -23,16 +24,20 @@ export default async function fetchStockPrices(){
         const prices = await axios.get(url)
 
         if (!prices.data || prices.data.length === 0) throw new error("No stock data received.")
-        const multi = redis.multi(); 
         let length = 0
+        // the Go trading service rejects trades on quotes older than its max
+        // staleness, so every price carries the time it was fetched
+        const updatedAt = Date.now()
+        const quotes = []
         for (const stock of prices.data) {
             
             if (stock.symbol && stock.price !== undefined){
-                multi.hSet("stockPrices", stock.symbol, stock.price);
+                // the quote endpoint has no bid/ask, so they fall back to the last price
+                quotes.push({ symbol: stock.symbol, bid: stock.bid ?? stock.price, ask: stock.ask ?? stock.price, last: stock.price, updated_at: updatedAt })
                 length += 1
             }
         }
-        await multi.exec();
+        await putQuotes(quotes);
         pushStockPrices();
         console.log(` Updated ${length} stocks at ${new Date().toLocaleTimeString()}`);
 
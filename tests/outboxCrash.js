@@ -0,0 +1,120 @@
+import axios from 'axios';
+import { spawn, execSync } from 'child_process';
+import fs from 'fs';
+import os from 'os';
+import path from 'path';
+import redis from '../redis.js';
+
+// Crash test for the trade outbox: user_balance and buy_stream must never
+// diverge. Each round starts the Go trading service, fires trades at it and
+// kills it with SIGKILL mid-load. With REDIS_CONTAINER set, the Redis
+// container is killed and restarted too (run it with appendonly yes so the
+// restart reloads the AOF). After every round, every balance that changed
+// must equal the balance carried by that user's newest buy_stream entry,
+// and every balance without a new entry must be unchanged.
+//
+//   node tests/outboxCrash.js
+//
+// The service is built with `go build` into a temp dir; set
+// TRADING_SERVICE_BIN to run an existing binary instead.
+const REDIS_CONTAINER = process.env.REDIS_CONTAINER;
+const TRADE_API_URL = 'http://localhost:8081/api/trade';
+const ROUNDS = Number(process.env.ROUNDS || 5);
+const STOCKS = ['AAPL', 'MSFT', 'AMZN', 'GOOGL'];
+
+const sleep = (ms) => new Promise((resolve) => setTimeout(resolve, ms));
+
+const buildService = () => {
+    if (process.env.TRADING_SERVICE_BIN) {
+        return process.env.TRADING_SERVICE_BIN;
+    }
+    const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'trading-service-'));
+    const bin = path.join(dir, 'trading-service');
+    console.log(`🔨 Building the trading service into ${dir}`);
+    execSync(`go build -o ${bin} .`, { cwd: './trading-service', stdio: 'inherit' });
+    return bin;
+};
+
+const startService = async (bin) => {
+    const service = spawn(bin, [], { stdio: 'ignore' });
+    for (let i = 0; i < 60; i++) {
+        try {
+            // unlike /api/admin/*, health needs no ADMIN_TOKEN
+            await axios.get('http://localhost:8081/api/health');
+            return service;
+        } catch (err) {
+            await sleep(500);
+        }
+    }
+    service.kill('SIGKILL');
+    throw new Error('trading service did not come up');
+};
+
+const fireTrades = (users, until) => {
+    const send = async () => {
+        while (Date.now() < until) {
+            await axios.post(TRADE_API_URL, {
+                user_id: Number(users[Math.floor(Math.random() * users.length)]),
+                action: Math.random() < 0.7 ? 'BUY' : 'SELL',
+                stock: [{ symbol: STOCKS[Math.floor(Math.random() * STOCKS.length)], quantity: 1 }],
+            }).catch(() => {}); // refused once the service is killed
+        }
+    };
+    return Promise.all(Array.from({ length: 20 }, send));
+};
+
+// newestBalances returns the balance of each user's newest buy_stream entry
+// since startID. Retention only trims entries every group has processed and
+// keeps 200000 of them, which is far more than a run adds.
+const newestBalances = async (startID) => {
+    const balances = {};
+    for (const entry of await redis.xRange('buy_stream', startID, '+')) {
+        balances[entry.message.user_id] = entry.message.balance;
+    }
+    return balances;
+};
+
+const checkOutbox = async (before, startID) => {
+    const after = await redis.hGetAll('user_balance');
+    const streamed = await newestBalances(startID);
+    let diverged = 0;
+    for (const [user, balance] of Object.entries(after)) {
+        const expected = streamed[user] ?? before[user];
+        if (Number(balance) !== Number(expected)) {
+            console.error(`❌ user ${user}: balance ${balance}, outbox says ${expected}`);
+            diverged++;
+        }
+    }
+    return { diverged, trades: Object.keys(streamed).length };
+};
+
+const runCrashTest = async () => {
+    const before = await redis.hGetAll('user_balance');
+    const users = Object.keys(before);
+    const bin = buildService();
+    const startID = `${Date.now()}-0`;
+    let failed = false;
+
+    for (let round = 1; round <= ROUNDS; round++) {
+        const service = await startService(bin);
+        const killAt = Date.now() + 500 + Math.random() * 2500;
+        const load = fireTrades(users, killAt + 500);
+        await sleep(killAt - Date.now());
+        service.kill('SIGKILL');
+        if (REDIS_CONTAINER) {
+            execSync(`docker kill ${REDIS_CONTAINER} && docker start ${REDIS_CONTAINER}`);
+            await sleep(2000);
+            await redis.ping(); // node-redis reconnects on its own
+        }
+        await load;
+
+        const { diverged, trades } = await checkOutbox(before, startID);
+        console.log(`📌 Round ${round}: ${trades} users traded, ${diverged} balances diverged`);
+        failed = failed || diverged > 0;
+    }
+
+    console.log(failed ? '\n❌ Outbox crash test failed' : '\n✅ Outbox crash test passed');
+    process.exit(failed ? 1 : 0);
+};
+
+runCrashTest();
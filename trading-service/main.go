@@ -4,19 +4,26 @@ package main
 
 import (
     "bytes"
+    "context"
     "encoding/json"
     "log"
     "math/rand"
     "net/http"
+    "os"
     "runtime"
     "sync/atomic"
     "time"
 
-    "github.com/go-chi/chi/v5"
-
     "trading-service/db"
     "trading-service/pkg/redisClient"
+    "trading-service/pkg/shares"
     redisStorage "trading-service/redis"
+    "trading-service/server"
+    "trading-service/services/bars"
+    "trading-service/services/hydrate"
+    "trading-service/services/marketdata"
+    "trading-service/services/orders"
+    "trading-service/services/reconcile"
     trade_service "trading-service/services/trade"
     "trading-service/services/workers"
 )
@@ -57,41 +64,14 @@ func randomTrade(userID int) trade_service.TradeRequest {
     return trade_service.TradeRequest{
         UserID: userID,
         Action: "BUY",
-        Stock: []struct {
-            Symbol   string  `json:"symbol"`
-            Quantity float64 `json:"quantity"`
-            Price    float64 `json:"price"`
-        }{{
+        Stock: []trade_service.TradeStock{{
             Symbol:   stockList[rand.Intn(len(stockList))],
-            Quantity: float64(rand.Intn(5) + 1),
+            Quantity: shares.FromInt(int64(rand.Intn(5) + 1)),
             Price:    0,
         }},
     }
 }
 
-// ─── API handler: enqueue trade ────────────────────────────────────────────────
-func tradeHandler(w http.ResponseWriter, r *http.Request) {
-    var req trade_service.TradeRequest
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, "bad json", http.StatusBadRequest)
-        return
-    }
-    select {
-    case workers.TradeJobQueue <- workers.TradeJob{Trade: req}:
-        w.WriteHeader(http.StatusAccepted)
-    default:
-        http.Error(w, "queue full", http.StatusServiceUnavailable)
-    }
-}
-
-// ─── router setup ─────────────────────────────────────────────────────────────
-func apiRouter() http.Handler {
-    r := chi.NewRouter()
-    r.Get("/api/health", func(w http.ResponseWriter, _ *http.Request) { w.Write([]byte("ok")) })
-    r.Post("/api/trade", tradeHandler)
-    return r
-}
-
 // ─── load tester (sends HTTP requests) ─────────────────────────────────────────
 func startLoadTest() {
     ids := fetchAllUserIDs()
@@ -109,7 +89,7 @@ func startLoadTest() {
                     body, _ := json.Marshal(tr)
                     client.Post("http://localhost:8081/api/trade", "application/json", bytes.NewReader(body))
                     atomic.AddInt64(&totalTrades, 1)
-                    for _, s := range tr.Stock { atomic.AddInt64(&totalStocksTraded, int64(s.Quantity)) }
+                    for _, s := range tr.Stock { atomic.AddInt64(&totalStocksTraded, int64(s.Quantity.Float64())) }
                 }
             }
         }
@@ -164,7 +144,12 @@ func getExecutedTradeCountFromDB() int {
 }
 // ─── main ─────────────────────────────────────────────────────────────────────
 func main() {
-    rand.Seed(time.Now().UnixNano())
+    // SIM_SEED makes the simulated trades repeatable along with the prices
+    seed, err := marketdata.Seed()
+    if err != nil {
+        log.Fatalf("❌ %v", err)
+    }
+    rand.Seed(seed)
     runtime.GOMAXPROCS(runtime.NumCPU())
     log.SetFlags(log.LstdFlags | log.Lshortfile)
 
@@ -172,19 +157,70 @@ func main() {
     redisClient.InitRedis()
     redisStorage.InitRedis(redisClient.Client)
 	oldTrades := getExecutedTradeCountFromDB()
-    workers.EnsureRedisStream()
-    workers.StartKafkaProducer(2)
-    workers.StartKafkaConsumer(15, db.DB)
+    // price history: every quote into price_ticks, rolled up into OHLCV bars
+    bars.Start(bars.Config{})
+    // trade_events runs on Kafka unless EVENT_BUS selects redis or memory
+    bus, err := workers.NewEventBus(os.Getenv("EVENT_BUS"))
+    if err != nil {
+        log.Fatalf("❌ %v", err)
+    }
+    workers.SetEventBus(bus)
+    // PERSISTENCE_MODE is direct, kafka (default) or both
+    err = workers.StartPersistence(workers.PipelineConfig{
+        Mode:         os.Getenv("PERSISTENCE_MODE"),
+        KafkaWriters: 15,
+        SQLWorkers:   10,
+    }, db.DB)
+    if err != nil {
+        log.Fatalf("❌ %v", err)
+    }
+    // load user_balance and positions:* unless a complete snapshot is there;
+    // after the pipeline starts, so the drained check knows what writes to Postgres
+    if err := hydrate.EnsureLoaded(context.Background(), db.DB); err != nil {
+        log.Fatalf("❌ Failed to hydrate Redis: %v", err)
+    }
+    // hand entries stranded by other consumers back to each group's reader
+    workers.StartReclaimer(30*time.Second, time.Minute)
+    // trim what every consumer group has processed; workers only ack
+    workers.StartRetention(workers.RetentionConfig{Stream: "buy_stream", MaxLen: 200000, MaxAge: time.Hour, Interval: 10 * time.Second})
+    if _, ok := bus.(*workers.RedisBus); ok {
+        workers.StartRetention(workers.RetentionConfig{Stream: "trade_events", MaxLen: 200000, MaxAge: time.Hour, Interval: 10 * time.Second})
+    }
+    // report users whose Redis and Postgres accounts drift apart
+    reconcile.Start(5*time.Minute, 30*time.Second)
+
+    // trades on quotes older than PRICE_MAX_STALENESS are rejected
+    maxStaleness := 15 * time.Minute
+    if v := os.Getenv("PRICE_MAX_STALENESS"); v != "" {
+        if maxStaleness, err = time.ParseDuration(v); err != nil {
+            log.Fatalf("❌ Invalid PRICE_MAX_STALENESS: %v", err)
+        }
+    }
+    redisStorage.SetMaxStaleness(maxStaleness)
+    go redisStorage.SubscribePrices()
+    go redisStorage.WatchPrices(time.Second)
+    // MARKET_DATA_PROVIDERS lets the service feed its own prices
+    if started, err := marketdata.StartFromEnv(); err != nil {
+        log.Fatalf("❌ %v", err)
+    } else if !started {
+        log.Println("ℹ️ No market data providers configured; prices come from the Node feed")
+    }
 
     // go workers.StartWorkerPool(workerCount, workers.TradeJobQueue)
 
     // start background processing
     go workers.StartWorkerPool(30, workers.TradeJobQueue)
 
-    // start HTTP API
+    // resting limit orders and triggered stops fill through the same job queue as market trades
+    orders.StartBook(func(t trade_service.TradeRequest) {
+        workers.TradeJobQueue <- workers.TradeJob{Trade: t}
+    })
+    orders.StartTriggers()
+
+    // start HTTP API; /api/admin/* is refused unless ADMIN_TOKEN is set
     go func() {
         log.Println("🌐 API listening on :8081")
-        if err := http.ListenAndServe(":8081", apiRouter()); err != nil {
+        if err := http.ListenAndServe(":8081", server.SetupRouter()); err != nil {
             log.Fatalf("server: %v", err)
         }
     }()
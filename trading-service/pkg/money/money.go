@@ -0,0 +1,236 @@
+// Package money holds the fixed-point amount type used for every price, cost
+// and balance in the trading service, so Redis, Kafka and Postgres all see
+// the same digits.
+package money
+
+import (
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"trading-service/pkg/shares"
+)
+
+// Rounding decides what happens to digits beyond a currency's scale.
+type Rounding int
+
+const (
+	// HalfUp rounds halves away from zero: 0.125 -> 0.13, -0.125 -> -0.13.
+	HalfUp Rounding = iota
+	// HalfEven rounds halves to the even neighbour: 0.125 -> 0.12.
+	HalfEven
+)
+
+// Currency describes how amounts in one currency are stored and rounded.
+type Currency struct {
+	Code     string
+	Scale    int // digits kept after the decimal point
+	Rounding Rounding
+}
+
+// USD amounts keep cents and round half away from zero, which is what
+// Postgres does when a value is cast to NUMERIC(12,2). Rounding in Go with
+// the same rule means Postgres never has to round anything we send it.
+var USD = Currency{Code: "USD", Scale: 2, Rounding: HalfUp}
+
+// Base is the currency all balances and prices in the service are held in.
+var Base = USD
+
+// Money is an amount of Base in its minor unit (cents for USD).
+type Money int64
+
+// ErrOverflow is returned for amounts that do not fit in a Money.
+var ErrOverflow = errors.New("amount out of range")
+
+func scaleFactor() *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(Base.Scale)), nil)
+}
+
+// divRound divides num by den and rounds the quotient with Base's rule. It
+// fails with ErrOverflow if the result does not fit in a Money.
+func divRound(num, den *big.Int) (Money, error) {
+	if den.Sign() < 0 {
+		num, den = new(big.Int).Neg(num), new(big.Int).Neg(den)
+	}
+	quo, rem := new(big.Int).QuoRem(num, den, new(big.Int))
+	twice := new(big.Int).Abs(rem)
+	twice.Lsh(twice, 1)
+	cmp := twice.Cmp(den)
+	if cmp > 0 || (cmp == 0 && (Base.Rounding == HalfUp || quo.Bit(0) == 1)) {
+		if num.Sign() < 0 {
+			quo.Sub(quo, big.NewInt(1))
+		} else {
+			quo.Add(quo, big.NewInt(1))
+		}
+	}
+	if !quo.IsInt64() {
+		return 0, ErrOverflow
+	}
+	return Money(quo.Int64()), nil
+}
+
+// decimal splits a plain decimal string into an integer and a power of ten,
+// e.g. "-12.345" -> -12345, 1000.
+func decimal(s string) (*big.Int, *big.Int, error) {
+	s = strings.TrimSpace(s)
+	intPart, fracPart, _ := strings.Cut(s, ".")
+	if intPart == "" || intPart == "-" || intPart == "+" {
+		intPart += "0"
+	}
+	digits, ok := new(big.Int).SetString(intPart+fracPart, 10)
+	if !ok || strings.ContainsAny(fracPart, "+-") {
+		return nil, nil, fmt.Errorf("invalid decimal %q", s)
+	}
+	den := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(len(fracPart))), nil)
+	return digits, den, nil
+}
+
+// Parse reads a decimal amount such as "1234.5" or "-0.125", rounding any
+// digits beyond Base's scale.
+func Parse(s string) (Money, error) {
+	num, den, err := decimal(s)
+	if err != nil {
+		return 0, err
+	}
+	m, err := divRound(num.Mul(num, scaleFactor()), den)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", err, strings.TrimSpace(s))
+	}
+	return m, nil
+}
+
+// parseFloat converts a float using its shortest decimal representation, so
+// 0.1 becomes exactly 0.10.
+func parseFloat(f float64) (Money, error) {
+	return Parse(strconv.FormatFloat(f, 'f', -1, 64))
+}
+
+// FromFloat converts a float (e.g. a quote from an external feed) using its
+// shortest decimal representation. Floats out of range give 0.
+func FromFloat(f float64) Money {
+	m, _ := parseFloat(f)
+	return m
+}
+
+// sharesPerUnit converts shares.Quantity units back to whole shares.
+var sharesPerUnit = new(big.Int).Exp(big.NewInt(10), big.NewInt(shares.Scale), nil)
+
+// Times returns the value of quantity shares at price m, rounded, or
+// ErrOverflow if it does not fit in a Money.
+func (m Money) Times(quantity shares.Quantity) (Money, error) {
+	num := new(big.Int).Mul(big.NewInt(int64(m)), big.NewInt(quantity.Units()))
+	return divRound(num, sharesPerUnit)
+}
+
+// WeightedAverage returns the average price of heldQty at held plus qty at
+// price, as used for a position's average_price after a buy. Only the final
+// average is rounded.
+func WeightedAverage(heldQty shares.Quantity, held Money, qty shares.Quantity, price Money) Money {
+	total := heldQty + qty
+	if total == 0 {
+		return 0
+	}
+	num := new(big.Int).Mul(big.NewInt(int64(held)), big.NewInt(heldQty.Units()))
+	num.Add(num, new(big.Int).Mul(big.NewInt(int64(price)), big.NewInt(qty.Units())))
+	// the average lies between the two prices, so it cannot overflow
+	average, _ := divRound(num, big.NewInt(total.Units()))
+	return average
+}
+
+// Cents returns the amount in Base's minor unit.
+func (m Money) Cents() int64 {
+	return int64(m)
+}
+
+func (m Money) Float64() float64 {
+	f, _ := strconv.ParseFloat(m.String(), 64)
+	return f
+}
+
+// String formats m with exactly Base.Scale decimals, e.g. "-12.30".
+func (m Money) String() string {
+	n := int64(m)
+	sign := ""
+	if n < 0 {
+		sign, n = "-", -n
+	}
+	s := strconv.FormatInt(n, 10)
+	if Base.Scale == 0 {
+		return sign + s
+	}
+	if len(s) <= Base.Scale {
+		s = strings.Repeat("0", Base.Scale-len(s)+1) + s
+	}
+	return sign + s[:len(s)-Base.Scale] + "." + s[len(s)-Base.Scale:]
+}
+
+// MarshalJSON writes m as a JSON number with exactly Base.Scale decimals.
+func (m Money) MarshalJSON() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalJSON accepts a JSON number or a quoted decimal string.
+func (m *Money) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "null" || s == "" {
+		*m = 0
+		return nil
+	}
+	if strings.ContainsAny(s, "eE") {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		parsed, err := parseFloat(f)
+		if err != nil {
+			return err
+		}
+		*m = parsed
+		return nil
+	}
+	parsed, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*m = parsed
+	return nil
+}
+
+// MarshalBinary lets go-redis store m as its decimal string.
+func (m Money) MarshalBinary() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// Value sends m to Postgres as an exact NUMERIC literal.
+func (m Money) Value() (driver.Value, error) {
+	return m.String(), nil
+}
+
+// Scan reads a NUMERIC column.
+func (m *Money) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*m = 0
+		return nil
+	case []byte:
+		parsed, err := Parse(string(v))
+		*m = parsed
+		return err
+	case string:
+		parsed, err := Parse(v)
+		*m = parsed
+		return err
+	case int64:
+		parsed, err := Parse(strconv.FormatInt(v, 10))
+		*m = parsed
+		return err
+	case float64:
+		parsed, err := parseFloat(v)
+		*m = parsed
+		return err
+	}
+	return fmt.Errorf("cannot scan %T into money.Money", src)
+}
@@ -0,0 +1,192 @@
+package money
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"trading-service/pkg/shares"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		in   string
+		want Money
+	}{
+		{"", 0},
+		{"0", 0},
+		{"12", 1200},
+		{"12.3", 1230},
+		{"-12.30", -1230},
+		{" 1234.56 ", 123456},
+		{".5", 50},
+		{"-.5", -50},
+		{"+7.01", 701},
+		{"0.001", 0},
+		{"92233720368547758.07", 9223372036854775807},
+		{"-92233720368547758.08", -9223372036854775808},
+	}
+	for _, c := range cases {
+		got, err := Parse(c.in)
+		if err != nil || got != c.want {
+			t.Errorf("Parse(%q) = %d, %v; want %d", c.in, got, err, c.want)
+		}
+	}
+	for _, in := range []string{"abc", "1.2.3", "1.-5", "1e3", "$5"} {
+		if _, err := Parse(in); err == nil || errors.Is(err, ErrOverflow) {
+			t.Errorf("Parse(%q) = %v, want an invalid decimal error", in, err)
+		}
+	}
+}
+
+func TestRounding(t *testing.T) {
+	cases := []struct {
+		in               string
+		halfUp, halfEven Money
+	}{
+		{"0.125", 13, 12},
+		{"0.135", 14, 14},
+		{"-0.125", -13, -12},
+		{"-0.135", -14, -14},
+		{"0.1249", 12, 12},
+		{"0.1251", 13, 13},
+		{"2.005", 201, 200},
+		{"-2.015", -202, -202},
+	}
+	for _, rounding := range []Rounding{HalfUp, HalfEven} {
+		withBase(t, Currency{Code: "TST", Scale: 2, Rounding: rounding})
+		for _, c := range cases {
+			want := c.halfUp
+			if rounding == HalfEven {
+				want = c.halfEven
+			}
+			if got, err := Parse(c.in); err != nil || got != want {
+				t.Errorf("rounding %d: Parse(%q) = %d, %v; want %d", rounding, c.in, got, err, want)
+			}
+		}
+	}
+}
+
+// withBase makes c the base currency for the rest of the test.
+func withBase(t *testing.T, c Currency) {
+	t.Helper()
+	previous := Base
+	Base = c
+	t.Cleanup(func() { Base = previous })
+}
+
+func TestOverflow(t *testing.T) {
+	for _, in := range []string{"1000000000000000000000000000000", "92233720368547758.08", "-92233720368547758.09"} {
+		if _, err := Parse(in); !errors.Is(err, ErrOverflow) {
+			t.Errorf("Parse(%q) = %v, want ErrOverflow", in, err)
+		}
+	}
+	var m Money
+	if err := json.Unmarshal([]byte("1e30"), &m); !errors.Is(err, ErrOverflow) {
+		t.Errorf("unmarshalling 1e30 = %v, want ErrOverflow", err)
+	}
+	if err := m.Scan(1e30); !errors.Is(err, ErrOverflow) {
+		t.Errorf("scanning 1e30 = %v, want ErrOverflow", err)
+	}
+	if _, err := Money(9223372036854775807).Times(shares.FromInt(2)); !errors.Is(err, ErrOverflow) {
+		t.Errorf("Times past the largest Money = %v, want ErrOverflow", err)
+	}
+	if FromFloat(1e30) != 0 {
+		t.Errorf("FromFloat(1e30) = %s, want 0", FromFloat(1e30))
+	}
+}
+
+func TestTimesAndWeightedAverage(t *testing.T) {
+	quantity := func(s string) shares.Quantity {
+		q, err := shares.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return q
+	}
+	times := []struct {
+		price    Money
+		quantity string
+		want     Money
+	}{
+		{10000, "3", 30000},
+		{333, "0.5", 167}, // 1.665 rounds up
+		{-333, "0.5", -167},
+		{1, "0.000001", 0},
+	}
+	for _, c := range times {
+		if got, err := c.price.Times(quantity(c.quantity)); err != nil || got != c.want {
+			t.Errorf("%s.Times(%s) = %s, %v; want %s", c.price, c.quantity, got, err, c.want)
+		}
+	}
+	if got := WeightedAverage(quantity("2"), 10000, quantity("1"), 13000); got != 11000 {
+		t.Errorf("WeightedAverage = %s, want 110.00", got)
+	}
+	if got := WeightedAverage(0, 0, 0, 500); got != 0 {
+		t.Errorf("WeightedAverage of nothing = %s, want 0", got)
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	cases := []struct {
+		in, out string
+	}{
+		{`12.3`, `12.30`},
+		{`"12.345"`, `12.35`},
+		{`-0.5`, `-0.50`},
+		{`0`, `0.00`},
+		{`1.5e2`, `150.00`},
+		{`null`, `0.00`},
+	}
+	for _, c := range cases {
+		var m Money
+		if err := json.Unmarshal([]byte(c.in), &m); err != nil {
+			t.Errorf("unmarshalling %s: %v", c.in, err)
+			continue
+		}
+		out, err := json.Marshal(m)
+		if err != nil || string(out) != c.out {
+			t.Errorf("%s round-tripped to %s, %v; want %s", c.in, out, err, c.out)
+		}
+		var back Money
+		if err := json.Unmarshal(out, &back); err != nil || back != m {
+			t.Errorf("%s read back as %s, %v; want %s", out, back, err, m)
+		}
+	}
+	var m Money
+	if err := json.Unmarshal([]byte(`"twelve"`), &m); err == nil {
+		t.Error("unmarshalling \"twelve\" succeeded")
+	}
+}
+
+func TestScanAndValue(t *testing.T) {
+	cases := []struct {
+		src  interface{}
+		want Money
+	}{
+		{nil, 0},
+		{[]byte("1234.56"), 123456},
+		{"-0.10", -10},
+		{int64(42), 4200},
+		{float64(0.1), 10},
+		{[]byte("9.999"), 1000},
+	}
+	for _, c := range cases {
+		var m Money
+		if err := m.Scan(c.src); err != nil || m != c.want {
+			t.Errorf("Scan(%#v) = %d, %v; want %d", c.src, m, err, c.want)
+		}
+		value, err := m.Value()
+		if err != nil || value != m.String() {
+			t.Errorf("Value() of %d = %v, %v; want %q", m, value, err, m.String())
+		}
+		var back Money
+		if err := back.Scan(value); err != nil || back != m {
+			t.Errorf("Scan(Value()) of %d = %d, %v", m, back, err)
+		}
+	}
+	var m Money
+	if err := m.Scan(true); err == nil {
+		t.Error("scanning a bool succeeded")
+	}
+}
@@ -0,0 +1,192 @@
+// Package shares holds the fixed-point share quantity type and the
+// per-symbol trading precision used to validate order sizes.
+package shares
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Scale is the number of decimals a Quantity keeps, matching the
+// NUMERIC(18,6) quantity columns in Postgres.
+const Scale = 6
+
+// unit is one whole share in Quantity units.
+const unit = 1000000
+
+// Quantity is a number of shares in millionths of a share.
+type Quantity int64
+
+// FromInt returns n whole shares.
+func FromInt(n int64) Quantity {
+	return Quantity(n * unit)
+}
+
+// Parse reads a decimal quantity such as "12" or "0.25". Quantities with
+// more than Scale decimals are rejected rather than rounded.
+func Parse(s string) (Quantity, error) {
+	s = strings.TrimSpace(s)
+	whole, frac, _ := strings.Cut(s, ".")
+	frac = strings.TrimRight(frac, "0")
+	if len(frac) > Scale {
+		return 0, fmt.Errorf("quantity %q has more than %d decimals", s, Scale)
+	}
+	if whole == "" || whole == "-" || whole == "+" {
+		whole += "0"
+	}
+	n, ok := new(big.Int).SetString(whole+frac+strings.Repeat("0", Scale-len(frac)), 10)
+	if !ok || strings.ContainsAny(frac, "+-") || !n.IsInt64() {
+		return 0, fmt.Errorf("invalid quantity %q", s)
+	}
+	return Quantity(n.Int64()), nil
+}
+
+// Units returns the quantity in millionths of a share.
+func (q Quantity) Units() int64 {
+	return int64(q)
+}
+
+func (q Quantity) Float64() float64 {
+	return float64(q) / unit
+}
+
+// String formats q without trailing zeros, e.g. "5" or "0.125", which is
+// also the quantity encoding used in positions:<id>.
+func (q Quantity) String() string {
+	n := int64(q)
+	sign := ""
+	if n < 0 {
+		sign, n = "-", -n
+	}
+	whole := strconv.FormatInt(n/unit, 10)
+	frac := strings.TrimRight(fmt.Sprintf("%06d", n%unit), "0")
+	if frac == "" {
+		return sign + whole
+	}
+	return sign + whole + "." + frac
+}
+
+// MarshalJSON writes q as a JSON number.
+func (q Quantity) MarshalJSON() ([]byte, error) {
+	return []byte(q.String()), nil
+}
+
+// UnmarshalJSON accepts a JSON number or a quoted decimal string.
+func (q *Quantity) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "null" || s == "" {
+		*q = 0
+		return nil
+	}
+	if strings.ContainsAny(s, "eE") {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		s = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	parsed, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*q = parsed
+	return nil
+}
+
+// MarshalBinary lets go-redis store q as its decimal string.
+func (q Quantity) MarshalBinary() ([]byte, error) {
+	return []byte(q.String()), nil
+}
+
+// Value sends q to Postgres as an exact NUMERIC literal.
+func (q Quantity) Value() (driver.Value, error) {
+	return q.String(), nil
+}
+
+// Scan reads a NUMERIC or INT quantity column.
+func (q *Quantity) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*q = 0
+		return nil
+	case []byte:
+		parsed, err := Parse(string(v))
+		*q = parsed
+		return err
+	case string:
+		parsed, err := Parse(v)
+		*q = parsed
+		return err
+	case int64:
+		*q = FromInt(v)
+		return nil
+	}
+	return fmt.Errorf("cannot scan %T into shares.Quantity", src)
+}
+
+// Per-symbol precision is read once from the environment:
+//
+//	DEFAULT_SHARE_PRECISION=0        decimals allowed for unlisted symbols
+//	SHARE_PRECISION=AAPL=2,MSFT=4    overrides per symbol
+//
+// A precision of p means orders must be a multiple of 10^-p shares, so the
+// default of 0 keeps whole-share trading unless a symbol opts in.
+var (
+	precisionOnce    sync.Once
+	defaultPrecision int
+	precisions       map[string]int
+)
+
+func loadPrecisions() {
+	precisions = make(map[string]int)
+	if v, err := strconv.Atoi(os.Getenv("DEFAULT_SHARE_PRECISION")); err == nil && v >= 0 && v <= Scale {
+		defaultPrecision = v
+	}
+	for _, entry := range strings.Split(os.Getenv("SHARE_PRECISION"), ",") {
+		symbol, value, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		p, err := strconv.Atoi(value)
+		if err != nil || p < 0 || p > Scale {
+			continue
+		}
+		precisions[strings.ToUpper(symbol)] = p
+	}
+}
+
+// Precision returns how many decimals symbol may be traded in.
+func Precision(symbol string) int {
+	precisionOnce.Do(loadPrecisions)
+	if p, ok := precisions[strings.ToUpper(symbol)]; ok {
+		return p
+	}
+	return defaultPrecision
+}
+
+// MinIncrement returns the smallest tradable quantity of symbol.
+func MinIncrement(symbol string) Quantity {
+	increment := Quantity(unit)
+	for i := 0; i < Precision(symbol); i++ {
+		increment /= 10
+	}
+	return increment
+}
+
+// Validate rejects non-positive quantities and quantities that are not a
+// multiple of symbol's minimum increment.
+func Validate(symbol string, q Quantity) error {
+	if q <= 0 {
+		return fmt.Errorf("quantity must be positive")
+	}
+	increment := MinIncrement(symbol)
+	if q%increment != 0 {
+		return fmt.Errorf("%s trades in increments of %s shares, got %s", symbol, increment, q)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package shares
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		in   string
+		want Quantity
+	}{
+		{"", 0},
+		{"12", 12000000},
+		{"0.25", 250000},
+		{".5", 500000},
+		{"-1.5", -1500000},
+		{" 3 ", 3000000},
+		{"0.000001", 1},
+		{"1.1000000", 1100000}, // trailing zeros past the scale are fine
+		{"9223372036854.775807", 9223372036854775807},
+	}
+	for _, c := range cases {
+		got, err := Parse(c.in)
+		if err != nil || got != c.want {
+			t.Errorf("Parse(%q) = %d, %v; want %d", c.in, got, err, c.want)
+		}
+	}
+	for _, in := range []string{
+		"0.0000001",            // more than Scale decimals
+		"1.0000005",            // not rounded either
+		"9223372036854.775808", // past int64
+		"10000000000000000000", // past int64
+		"abc", "1.2.3", "1.-5", "1e3",
+	} {
+		if got, err := Parse(in); err == nil {
+			t.Errorf("Parse(%q) = %d, want an error", in, got)
+		}
+	}
+}
+
+func TestStringAndJSON(t *testing.T) {
+	cases := []struct {
+		in, out string
+	}{
+		{`5`, `5`},
+		{`"0.125"`, `0.125`},
+		{`1.500000`, `1.5`},
+		{`-0.000001`, `-0.000001`},
+		{`2.5e-1`, `0.25`},
+		{`null`, `0`},
+	}
+	for _, c := range cases {
+		var q Quantity
+		if err := q.UnmarshalJSON([]byte(c.in)); err != nil {
+			t.Errorf("unmarshalling %s: %v", c.in, err)
+			continue
+		}
+		out, err := q.MarshalJSON()
+		if err != nil || string(out) != c.out {
+			t.Errorf("%s round-tripped to %s, %v; want %s", c.in, out, err, c.out)
+		}
+	}
+	var q Quantity
+	if err := q.UnmarshalJSON([]byte(`1e-7`)); err == nil {
+		t.Errorf("unmarshalling 1e-7 = %s, want an error", q)
+	}
+}
+
+// withPrecisions sets the default and per-symbol precisions for the rest of
+// the test instead of reading them from the environment.
+func withPrecisions(t *testing.T, def int, symbols map[string]int) {
+	t.Helper()
+	precisionOnce.Do(func() {})
+	previousDefault, previous := defaultPrecision, precisions
+	defaultPrecision, precisions = def, symbols
+	t.Cleanup(func() { defaultPrecision, precisions = previousDefault, previous })
+}
+
+func TestValidate(t *testing.T) {
+	withPrecisions(t, 0, map[string]int{"AAPL": 2, "BRK": 6})
+	increments := []struct {
+		symbol string
+		want   Quantity
+	}{
+		{"MSFT", 1000000},
+		{"AAPL", 10000},
+		{"aapl", 10000},
+		{"BRK", 1},
+	}
+	for _, c := range increments {
+		if got := MinIncrement(c.symbol); got != c.want {
+			t.Errorf("MinIncrement(%s) = %d, want %d", c.symbol, got, c.want)
+		}
+	}
+
+	cases := []struct {
+		symbol, quantity string
+		ok               bool
+	}{
+		{"MSFT", "3", true},
+		{"MSFT", "0.5", false},
+		{"AAPL", "0.25", true},
+		{"AAPL", "0.125", false},
+		{"BRK", "0.000001", true},
+		{"MSFT", "0", false},
+		{"AAPL", "-0.25", false},
+	}
+	for _, c := range cases {
+		q, err := Parse(c.quantity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := Validate(c.symbol, q); (err == nil) != c.ok {
+			t.Errorf("Validate(%s, %s) = %v, want ok %v", c.symbol, c.quantity, err, c.ok)
+		}
+	}
+}
+
+func TestPrecisionsFromEnvironment(t *testing.T) {
+	t.Setenv("DEFAULT_SHARE_PRECISION", "1")
+	t.Setenv("SHARE_PRECISION", "aapl=3, MSFT=9,TSLA=x,BRK")
+	previousDefault, previous := defaultPrecision, precisions
+	t.Cleanup(func() { defaultPrecision, precisions = previousDefault, previous })
+
+	defaultPrecision = 0
+	loadPrecisions()
+	for symbol, want := range map[string]int{"AAPL": 3, "MSFT": 1, "TSLA": 1, "BRK": 1} {
+		if got := Precision(symbol); got != want {
+			t.Errorf("Precision(%s) = %d, want %d", symbol, got, want)
+		}
+	}
+}
+
+// NUMERIC(18,6) columns arrive as decimal text with all six decimals.
+func TestScanAndValue(t *testing.T) {
+	cases := []struct {
+		src  interface{}
+		want Quantity
+	}{
+		{nil, 0},
+		{[]byte("12.000000"), 12000000},
+		{[]byte("0.000001"), 1},
+		{[]byte("-3.250000"), -3250000},
+		{[]byte("999999999999.999999"), 999999999999999999},
+		{"7.5", 7500000},
+		{int64(4), 4000000},
+	}
+	for _, c := range cases {
+		var q Quantity
+		if err := q.Scan(c.src); err != nil || q != c.want {
+			t.Errorf("Scan(%#v) = %d, %v; want %d", c.src, q, err, c.want)
+		}
+		value, err := q.Value()
+		if err != nil || value != q.String() {
+			t.Errorf("Value() of %d = %v, %v; want %q", q, value, err, q.String())
+		}
+		var back Quantity
+		if err := back.Scan(value); err != nil || back != q {
+			t.Errorf("Scan(Value()) of %d = %d, %v", q, back, err)
+		}
+	}
+	for _, src := range []interface{}{[]byte("1.0000001"), []byte("abc"), 1.5} {
+		var q Quantity
+		if err := q.Scan(src); err == nil {
+			t.Errorf("Scan(%#v) = %d, want an error", src, q)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package redisStorage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"trading-service/pkg/money"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Prices live in one hash per symbol, quote:<SYMBOL>, with the fields bid,
+// ask, last and updated_at (unix milliseconds). Writers store quotes with
+// PriceStore.Put, which also publishes them on PriceChannel. The Node feed
+// writes the same schema (services/priceStore.js).
+//
+// Before this, prices were kept in stock:<SYMBOL> strings and then in the
+// stockPrices hash, with times in stockPrices:updated_at. MigrateLegacy
+// moves whatever is left of those into quote:* hashes.
+const (
+	quoteKeyPrefix = "quote:"
+	PriceChannel   = "quotes:updates"
+
+	legacyPriceHash  = "stockPrices"
+	legacyTimesHash  = "stockPrices:updated_at"
+	legacyKeyPattern = "stock:*"
+
+	// keys per SCAN round
+	scanCount = 500
+)
+
+var ErrNoQuote = errors.New("no quote for symbol")
+
+// Quote is the latest bid, ask and last trade price of a symbol.
+type Quote struct {
+	Symbol    string
+	Bid       money.Money
+	Ask       money.Money
+	Last      money.Money
+	UpdatedAt time.Time
+}
+
+// quoteMessage is a Quote as stored in Redis and published on PriceChannel.
+type quoteMessage struct {
+	Symbol    string      `json:"symbol"`
+	Bid       money.Money `json:"bid"`
+	Ask       money.Money `json:"ask"`
+	Last      money.Money `json:"last"`
+	UpdatedAt int64       `json:"updated_at"`
+}
+
+func (q Quote) message() quoteMessage {
+	var millis int64
+	if !q.UpdatedAt.IsZero() {
+		millis = q.UpdatedAt.UnixMilli()
+	}
+	return quoteMessage{Symbol: q.Symbol, Bid: q.Bid, Ask: q.Ask, Last: q.Last, UpdatedAt: millis}
+}
+
+func (m quoteMessage) quote() Quote {
+	q := Quote{Symbol: m.Symbol, Bid: m.Bid, Ask: m.Ask, Last: m.Last}
+	if m.UpdatedAt > 0 {
+		q.UpdatedAt = time.UnixMilli(m.UpdatedAt)
+	}
+	return q
+}
+
+func QuoteKey(symbol string) string {
+	return quoteKeyPrefix + symbol
+}
+
+// PriceStore reads and writes quotes in Redis.
+type PriceStore struct {
+	client *redis.Client
+}
+
+func NewPriceStore(c *redis.Client) *PriceStore {
+	return &PriceStore{client: c}
+}
+
+// parseQuote reads a quote:<SYMBOL> hash. A quote without updated_at has an
+// unknown age and is returned with a zero UpdatedAt.
+func parseQuote(symbol string, fields map[string]string) (Quote, error) {
+	if len(fields) == 0 {
+		return Quote{}, fmt.Errorf("%w: %s", ErrNoQuote, symbol)
+	}
+	q := Quote{Symbol: symbol}
+	for name, dest := range map[string]*money.Money{"bid": &q.Bid, "ask": &q.Ask, "last": &q.Last} {
+		value, err := money.Parse(fields[name])
+		if err != nil {
+			return Quote{}, fmt.Errorf("invalid %s for %s: %v", name, symbol, err)
+		}
+		*dest = value
+	}
+	if millis, err := strconv.ParseInt(fields["updated_at"], 10, 64); err == nil && millis > 0 {
+		q.UpdatedAt = time.UnixMilli(millis)
+	}
+	return q, nil
+}
+
+func (s *PriceStore) Get(ctx context.Context, symbol string) (Quote, error) {
+	fields, err := s.client.HGetAll(ctx, QuoteKey(symbol)).Result()
+	if err != nil {
+		return Quote{}, err
+	}
+	return parseQuote(symbol, fields)
+}
+
+// All loads every quote: quote:* keys are found with SCAN and read with
+// pipelined HGETALLs. Unreadable quotes are skipped.
+func (s *PriceStore) All(ctx context.Context) ([]Quote, error) {
+	var quotes []Quote
+	var cursor uint64
+	for {
+		keys, next, err := s.client.Scan(ctx, cursor, quoteKeyPrefix+"*", scanCount).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) > 0 {
+			pipe := s.client.Pipeline()
+			cmds := make([]*redis.MapStringStringCmd, len(keys))
+			for i, key := range keys {
+				cmds[i] = pipe.HGetAll(ctx, key)
+			}
+			if _, err := pipe.Exec(ctx); err != nil {
+				return nil, err
+			}
+			for i, key := range keys {
+				q, err := parseQuote(strings.TrimPrefix(key, quoteKeyPrefix), cmds[i].Val())
+				if err != nil {
+					fmt.Printf("⚠️ %v\n", err)
+					continue
+				}
+				quotes = append(quotes, q)
+			}
+		}
+		if cursor = next; cursor == 0 {
+			return quotes, nil
+		}
+	}
+}
+
+// Put stores quotes and publishes them on PriceChannel.
+func (s *PriceStore) Put(ctx context.Context, quotes ...Quote) error {
+	if len(quotes) == 0 {
+		return nil
+	}
+	messages := make([]quoteMessage, len(quotes))
+	pipe := s.client.TxPipeline()
+	for i, q := range quotes {
+		messages[i] = q.message()
+		pipe.HSet(ctx, QuoteKey(q.Symbol),
+			"bid", q.Bid.String(),
+			"ask", q.Ask.String(),
+			"last", q.Last.String(),
+			"updated_at", messages[i].UpdatedAt,
+		)
+	}
+	payload, err := json.Marshal(messages)
+	if err != nil {
+		return err
+	}
+	pipe.Publish(ctx, PriceChannel, payload)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// MigrateLegacy copies prices from the stockPrices hash and stock:* keys into
+// quote:* hashes and deletes the legacy keys. A legacy price only carries the
+// last price, so it also becomes the bid and ask. Fields of an existing
+// quote are never overwritten, so a quote the feed already wrote wins, and
+// the stockPrices hash wins over the older stock:* keys.
+func (s *PriceStore) MigrateLegacy(ctx context.Context) (int, error) {
+	prices, err := s.client.HGetAll(ctx, legacyPriceHash).Result()
+	if err != nil {
+		return 0, err
+	}
+	times, err := s.client.HGetAll(ctx, legacyTimesHash).Result()
+	if err != nil {
+		return 0, err
+	}
+	legacy := make([]string, 0, 2)
+	if len(prices) > 0 {
+		legacy = append(legacy, legacyPriceHash)
+	}
+	if len(times) > 0 {
+		legacy = append(legacy, legacyTimesHash)
+	}
+
+	type legacyPrice struct{ price, updatedAt string }
+	var symbols []string
+	found := make(map[string]legacyPrice)
+	for symbol, price := range prices {
+		symbols = append(symbols, symbol)
+		found[symbol] = legacyPrice{price, times[symbol]}
+	}
+	iter := s.client.Scan(ctx, 0, legacyKeyPattern, scanCount).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		legacy = append(legacy, key)
+		symbol := strings.TrimPrefix(key, "stock:")
+		if _, ok := found[symbol]; ok {
+			continue
+		}
+		price, err := s.client.Get(ctx, key).Result()
+		if err != nil {
+			continue // not a string key
+		}
+		symbols = append(symbols, symbol)
+		found[symbol] = legacyPrice{price: price}
+	}
+	if err := iter.Err(); err != nil {
+		return 0, err
+	}
+	if len(legacy) == 0 {
+		return 0, nil
+	}
+
+	pipe := s.client.Pipeline()
+	migrated := 0
+	for _, symbol := range symbols {
+		p := found[symbol]
+		price, err := money.Parse(p.price)
+		if err != nil {
+			fmt.Printf("⚠️ Skipping invalid legacy price for %s: %v\n", symbol, err)
+			continue
+		}
+		key := QuoteKey(symbol)
+		for _, field := range []string{"bid", "ask", "last"} {
+			pipe.HSetNX(ctx, key, field, price.String())
+		}
+		// no time means the age is unknown, which counts as stale
+		if p.updatedAt != "" {
+			pipe.HSetNX(ctx, key, "updated_at", p.updatedAt)
+		}
+		migrated++
+	}
+	pipe.Unlink(ctx, legacy...)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return migrated, nil
+}
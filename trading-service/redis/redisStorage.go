@@ -2,120 +2,217 @@ package redisStorage
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"strconv"
+	"sort"
 	"sync"
+	"time"
+
+	"trading-service/pkg/money"
 
 	"github.com/redis/go-redis/v9"
 )
 
+// The cache holds the latest quote of every symbol. SubscribePrices applies
+// quotes published on PriceChannel within moments of an update; WatchPrices
+// re-reads the price store as a fallback for messages missed while the
+// subscription was reconnecting.
+
+// ErrStalePrice is returned for a quote older than the max staleness.
+var ErrStalePrice = errors.New("stock price is stale")
+
 var (
 	client     *redis.Client
-	cache      = make(map[string]float64)
+	cache      = make(map[string]Quote)
 	cacheMutex sync.RWMutex
+
+	// Prices is the price store on the client passed to InitRedis.
+	Prices *PriceStore
+
+	// maxStaleness is how old a quote may be before GetQuote refuses it; 0
+	// accepts any age
+	maxStaleness time.Duration
+
+	listeners      []func(symbol string, price money.Money)
+	quoteListeners []func(q Quote)
+	listenersMutex sync.RWMutex
 )
 
-// ✅ Initialize Redis + load all stock prices into memory cache
-func InitRedis(c *redis.Client) {
-	client = c
+// SetMaxStaleness sets how old a quote may be before trades on it are
+// rejected; 0 disables the check.
+func SetMaxStaleness(d time.Duration) {
+	cacheMutex.Lock()
+	maxStaleness = d
+	cacheMutex.Unlock()
+}
 
-	ctx := context.Background()
-	keys, err := client.Keys(ctx, "stock:*").Result()
-	if err != nil {
-		fmt.Printf("❌ Failed to list stock keys: %v\n", err)
+// OnPriceUpdate registers fn to be called whenever a new last price lands in
+// the in-memory cache, e.g. so resting orders can check for a crossing price.
+func OnPriceUpdate(fn func(symbol string, price money.Money)) {
+	listenersMutex.Lock()
+	listeners = append(listeners, fn)
+	listenersMutex.Unlock()
+}
+
+// OnQuote registers fn to be called with every quote newer than the cached
+// one, whether or not the last price changed, e.g. to record price history.
+func OnQuote(fn func(q Quote)) {
+	listenersMutex.Lock()
+	quoteListeners = append(quoteListeners, fn)
+	listenersMutex.Unlock()
+}
+
+// SetStockPrice caches price, quoted now, as the bid, ask and last price of
+// symbol and notifies price listeners. It does not write to Redis.
+func SetStockPrice(symbol string, price money.Money) {
+	setQuote(Quote{Symbol: symbol, Bid: price, Ask: price, Last: price, UpdatedAt: time.Now()})
+}
+
+// setQuote caches q unless the cache already has a newer quote, notifies
+// quote listeners if q is newer and price listeners if the last price changed.
+func setQuote(q Quote) {
+	cacheMutex.Lock()
+	current, ok := cache[q.Symbol]
+	if ok && q.UpdatedAt.Before(current.UpdatedAt) {
+		cacheMutex.Unlock()
 		return
 	}
+	cache[q.Symbol] = q
+	cacheMutex.Unlock()
 
-	for _, key := range keys {
-		val, err := client.Get(ctx, key).Result()
-		if err != nil {
-			fmt.Printf("⚠️ Failed to get %s: %v\n", key, err)
-			continue
+	listenersMutex.RLock()
+	defer listenersMutex.RUnlock()
+	if !ok || q.UpdatedAt.After(current.UpdatedAt) {
+		for _, fn := range quoteListeners {
+			fn(q)
 		}
-		price, err := strconv.ParseFloat(val, 64)
-		if err != nil {
-			fmt.Printf("⚠️ Invalid price for %s: %v\n", key, err)
-			continue
-		}
-		symbol := key[len("stock:"):] // remove "stock:" prefix
-		cacheMutex.Lock()
-		cache[symbol] = price
-		cacheMutex.Unlock()
 	}
+	if ok && current.Last == q.Last {
+		return
+	}
+	for _, fn := range listeners {
+		fn(q.Symbol, q.Last)
+	}
+}
 
-	fmt.Printf("✅ Loaded %d stock prices from Redis into memory\n", len(cache))
+// StoreQuotes writes quotes to the price store, which publishes them, and
+// puts them in the in-memory cache right away.
+func StoreQuotes(ctx context.Context, quotes ...Quote) error {
+	if err := Prices.Put(ctx, quotes...); err != nil {
+		return err
+	}
+	for _, q := range quotes {
+		setQuote(q)
+	}
+	return nil
 }
 
-// ✅ Read-only fast lookup from in-memory cache
-func GetStockPrice(symbol string) (float64, error) {
+// Symbols lists the symbols in the in-memory cache.
+func Symbols() []string {
 	cacheMutex.RLock()
-	price, ok := cache[symbol]
-	cacheMutex.RUnlock()
-	if ok {
-		return price, nil
+	defer cacheMutex.RUnlock()
+	symbols := make([]string, 0, len(cache))
+	for symbol := range cache {
+		symbols = append(symbols, symbol)
 	}
+	sort.Strings(symbols)
+	return symbols
+}
 
-	// 🔄 Pull from Redis hash
+// SubscribePrices applies the quotes published on PriceChannel to the cache
+// until the process exits. go-redis resubscribes on its own after a
+// dropped connection.
+func SubscribePrices() {
 	ctx := context.Background()
-	val, err := client.HGet(ctx, "stockPrices", symbol).Result()
-	if err == redis.Nil {
-		return 0, fmt.Errorf("❌ symbol not found in Redis hash: %s", symbol)
-	}
-	if err != nil {
-		return 0, fmt.Errorf("redis HGET error for %s: %v", symbol, err)
+	sub := client.Subscribe(ctx, PriceChannel)
+	defer sub.Close()
+	for msg := range sub.Channel() {
+		var messages []quoteMessage
+		if err := json.Unmarshal([]byte(msg.Payload), &messages); err != nil {
+			fmt.Printf("⚠️ Invalid price update: %v\n", err)
+			continue
+		}
+		for _, m := range messages {
+			setQuote(m.quote())
+		}
 	}
+}
 
-	parsed, err := strconv.ParseFloat(val, 64)
-	if err != nil {
-		return 0, fmt.Errorf("invalid price for %s: %v", symbol, err)
+// WatchPrices re-reads every quote each interval so the cache (and any
+// price listeners) follow the feed even when a published update was missed.
+func WatchPrices(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		quotes, err := Prices.All(context.Background())
+		if err != nil {
+			fmt.Printf("⚠️ Failed to refresh stock prices: %v\n", err)
+			continue
+		}
+		for _, q := range quotes {
+			setQuote(q)
+		}
 	}
-
-	// ✅ Save to local cache
-	cacheMutex.Lock()
-	cache[symbol] = parsed
-	cacheMutex.Unlock()
-
-	return parsed, nil
 }
 
+// ✅ Initialize Redis, migrate legacy price keys and load all quotes into
+// the memory cache
+func InitRedis(c *redis.Client) {
+	client = c
+	Prices = NewPriceStore(c)
 
+	ctx := context.Background()
+	migrated, err := Prices.MigrateLegacy(ctx)
+	if err != nil {
+		fmt.Printf("❌ Failed to migrate legacy price keys: %v\n", err)
+	} else if migrated > 0 {
+		fmt.Printf("✅ Migrated %d legacy prices to quote:* hashes\n", migrated)
+	}
 
+	quotes, err := Prices.All(ctx)
+	if err != nil {
+		fmt.Printf("❌ Failed to load quotes: %v\n", err)
+		return
+	}
+	for _, q := range quotes {
+		setQuote(q)
+	}
+	fmt.Printf("✅ Loaded %d stock prices from Redis into memory\n", len(quotes))
+}
 
-// func GetStockPrice(symbol string) (float64, error) {
-// 	// 🔍 1. Check local cache
-// 	cacheMutex.RLock()
-// 	price, ok := cache[symbol]
-// 	cacheMutex.RUnlock()
-// 	if ok {
-// 		return price, nil
-// 	}
-
-// 	// 🌐 2. Fetch from Redis if not in cache
-// 	ctx := context.Background()
-// 	val, err := client.Get(ctx, fmt.Sprintf("stock:%s", symbol)).Result()
-// 	if err != nil {
-// 		return 0, err
-// 	}
-
-// 	parsed, err := strconv.ParseFloat(val, 64)
-// 	if err != nil {
-// 		return 0, err
-// 	}
-
-// 	// 💾 3. Save to cache
-// 	cacheMutex.Lock()
-// 	cache[symbol] = parsed
-// 	cacheMutex.Unlock()
-
-// 	return parsed, nil
-// }
+// GetQuote returns the latest quote of symbol from the in-memory cache,
+// falling back to the price store. A quote older than the max staleness, or
+// of unknown age, fails with ErrStalePrice.
+func GetQuote(symbol string) (Quote, error) {
+	cacheMutex.RLock()
+	q, ok := cache[symbol]
+	limit := maxStaleness
+	cacheMutex.RUnlock()
+	if !ok {
+		// 🔄 Pull from the price store
+		var err error
+		if q, err = Prices.Get(context.Background(), symbol); err != nil {
+			return Quote{}, err
+		}
+		// ✅ Save to local cache
+		setQuote(q)
+	}
 
+	if age := time.Since(q.UpdatedAt); limit > 0 && age > limit {
+		if q.UpdatedAt.IsZero() {
+			return Quote{}, fmt.Errorf("%w: %s has no quote time", ErrStalePrice, symbol)
+		}
+		return Quote{}, fmt.Errorf("%w: %s quoted %s ago", ErrStalePrice, symbol, age.Round(time.Second))
+	}
+	return q, nil
+}
 
-// func main() {
-// 	redisClient := RedisClient()
-// 	val, err := redisClient.HGet(ctx, "stockPrices", "META").Result()
-// 	if err != nil {
-// 		log.Fatalf("Failed to retrieve stock price from redis")
-// 	}
-// 	fmt.Println("META PRICE:", val)
-// }
+// ✅ Read-only fast lookup of the last price, see GetQuote
+func GetStockPrice(symbol string) (money.Money, error) {
+	q, err := GetQuote(symbol)
+	if err != nil {
+		return 0, err
+	}
+	return q.Last, nil
+}
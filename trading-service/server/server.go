@@ -4,11 +4,24 @@ package server
 
 import (
 	"encoding/json" // for JSON parsing
+	"crypto/subtle"
+	"errors"
+	"log"
 	"net/http" // for HTTP server
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-chi/chi/v5" // lightweight router
 	"github.com/go-chi/chi/v5/middleware" // common middleware functions
 
+	"trading-service/db"
+	"trading-service/services/bars"
+	"trading-service/services/hydrate"
+	"trading-service/services/marketdata"
+	"trading-service/services/orders"
+	"trading-service/services/reconcile"
 	trade "trading-service/services/trade"
 	"trading-service/services/workers"
 )
@@ -33,15 +46,407 @@ func SetupRouter() http.Handler {
 			return
 		}
 
-		// enqueue the trade for async processing
-		select {
-		case workers.TradeJobQueue <- workers.TradeJob{Trade: tradeReq}:
-			w.WriteHeader(http.StatusAccepted) // 202 - Accepted
-			w.Write([]byte("🟢 Trade enqueued successfully"))
-		default:
+		// every trade is persisted as orders first so the caller gets ids to manage them by
+		if err := orders.Validate(tradeReq); err != nil {
+			http.Error(w, "❌ "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// a retried submission replays the first response instead of trading again
+		if key := r.Header.Get("Idempotency-Key"); key != "" {
+			tradeReq.IdempotencyKey = key
+		}
+		// an orders row holds one symbol, so a market trade of several stocks
+		// is placed as one order per stock; each executes, or is rejected, on
+		// its own and is fetched, canceled or amended by its own id
+		legs := orders.Legs(tradeReq)
+		for _, leg := range legs {
+			if len(leg.IdempotencyKey) > 255 {
+				http.Error(w, "❌ Idempotency key is too long", http.StatusBadRequest)
+				return
+			}
+		}
+		if tradeReq.IdempotencyKey != "" {
+			original, reserved, err := orders.Reserve(r.Context(), tradeReq.UserID, tradeReq.IdempotencyKey)
+			if errors.Is(err, orders.ErrIdempotencyPending) {
+				http.Error(w, "⏳ "+err.Error(), http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, "❌ Failed to check idempotency key", http.StatusInternalServerError)
+				return
+			}
+			if !reserved {
+				w.Header().Set("Idempotent-Replayed", "true")
+				writeJSON(w, http.StatusAccepted, original)
+				return
+			}
+		}
+
+		placed, err := createOrders(r, legs)
+		if err != nil {
+			releaseKey(r, tradeReq)
+			http.Error(w, "❌ Failed to save order", http.StatusInternalServerError)
+			return
+		}
+		live := 0
+		for i := range placed {
+			order := &placed[i]
+			orders.Record(r.Context(), order.ID, orders.StageAccepted, "")
+			switch order.OrderType {
+			case "LIMIT":
+				// limit and stop orders wait for the price to reach them
+				orders.Rest(*order)
+			case "STOP_LOSS", "STOP_LIMIT":
+				orders.Arm(*order)
+			default:
+				// enqueue the trade for async processing
+				orders.Track(*order)
+				select {
+				case workers.TradeJobQueue <- workers.TradeJob{Trade: order.ToTrade()}:
+				default:
+					orders.Cancel(r.Context(), order.ID)
+					order.Status = "CANCELED"
+					continue
+				}
+			}
+			live++
+		}
+		if live == 0 {
+			releaseKey(r, tradeReq)
 			http.Error(w, "🚫 Trade queue is full", http.StatusServiceUnavailable)
+			return
+		}
+
+		// a single order is returned as is, the orders of several stocks as a list
+		var result interface{} = placed
+		if len(placed) == 1 {
+			result = placed[0]
+		}
+		if tradeReq.IdempotencyKey != "" {
+			orders.Remember(r.Context(), tradeReq.UserID, tradeReq.IdempotencyKey, result)
+		}
+		writeJSON(w, http.StatusAccepted, result) // 202 - Accepted
+	})
+
+	// order status plus where it is in the execution and persistence pipeline
+	r.Get("/api/orders/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			http.Error(w, "❌ Invalid order id", http.StatusBadRequest)
+			return
+		}
+		order, err := orders.Get(r.Context(), id)
+		if err != nil {
+			writeOrderError(w, err)
+			return
+		}
+		lifecycle, err := orders.GetLifecycle(r.Context(), id)
+		if err != nil {
+			http.Error(w, "❌ Failed to read order lifecycle", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"order":     order,
+			"lifecycle": lifecycle,
+		})
+	})
+
+	// cancel an order that has not executed yet
+	r.Delete("/api/orders/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			http.Error(w, "❌ Invalid order id", http.StatusBadRequest)
+			return
+		}
+		order, err := orders.Cancel(r.Context(), id)
+		if err != nil {
+			writeOrderError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, order)
+	})
+
+	// amend the quantity or prices of an order that has not executed yet
+	r.Patch("/api/orders/{id}", func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			http.Error(w, "❌ Invalid order id", http.StatusBadRequest)
+			return
+		}
+		var amendment orders.Amendment
+		if err := json.NewDecoder(r.Body).Decode(&amendment); err != nil {
+			http.Error(w, "❌ Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		order, err := orders.Amend(r.Context(), id, amendment)
+		if err != nil {
+			writeOrderError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, order)
+	})
+
+	// OHLCV bars, ?interval=1m|5m|1h|1d&from=&to= with RFC 3339 or unix
+	// times; defaults are 1m and the last 100 bars
+	r.Get("/api/symbols/{sym}/bars", func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		interval := query.Get("interval")
+		if interval == "" {
+			interval = "1m"
+		}
+		iv, err := bars.LookupInterval(interval)
+		if err != nil {
+			http.Error(w, "❌ "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		to, err := parseTime(query.Get("to"), time.Now())
+		if err != nil {
+			http.Error(w, "❌ Invalid to", http.StatusBadRequest)
+			return
+		}
+		from, err := parseTime(query.Get("from"), to.Add(-100*iv.Length))
+		if err != nil {
+			http.Error(w, "❌ Invalid from", http.StatusBadRequest)
+			return
+		}
+		result, err := bars.Query(r.Context(), chi.URLParam(r, "sym"), iv.Name, from, to)
+		switch {
+		case errors.Is(err, bars.ErrTooManyBars), errors.Is(err, bars.ErrEmptyRange):
+			http.Error(w, "❌ "+err.Error(), http.StatusBadRequest)
+		case err != nil:
+			http.Error(w, "❌ "+err.Error(), http.StatusInternalServerError)
+		default:
+			writeJSON(w, http.StatusOK, result)
 		}
 	})
 
+	// admin endpoints need ADMIN_TOKEN as a bearer token
+	r.Group(func(r chi.Router) {
+		r.Use(adminOnly(os.Getenv("ADMIN_TOKEN")))
+
+		// dead letters: messages a pipeline stage gave up on
+		r.Get("/api/admin/dlq", func(w http.ResponseWriter, r *http.Request) {
+			count := int64(100)
+			if v := r.URL.Query().Get("count"); v != "" {
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err != nil || n <= 0 {
+					http.Error(w, "❌ Invalid count", http.StatusBadRequest)
+					return
+				}
+				count = n
+			}
+			letters, err := workers.ListDeadLetters(r.Context(), count)
+			if err != nil {
+				http.Error(w, "❌ Failed to read dead letters", http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, letters)
+		})
+
+		r.Get("/api/admin/dlq/{id}", func(w http.ResponseWriter, r *http.Request) {
+			letter, err := workers.GetDeadLetter(r.Context(), chi.URLParam(r, "id"))
+			if err != nil {
+				writeDeadLetterError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, letter)
+		})
+
+		// send a dead letter back to the stage it failed in
+		r.Post("/api/admin/dlq/{id}/replay", func(w http.ResponseWriter, r *http.Request) {
+			if err := workers.ReplayDeadLetter(r.Context(), chi.URLParam(r, "id")); err != nil {
+				writeDeadLetterError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+		r.Delete("/api/admin/dlq/{id}", func(w http.ResponseWriter, r *http.Request) {
+			if err := workers.DiscardDeadLetter(r.Context(), chi.URLParam(r, "id")); err != nil {
+				writeDeadLetterError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+		// pending-entry and reclaim counts per buy_stream consumer group
+		r.Get("/api/admin/streams/metrics", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, workers.ReclaimMetrics())
+		})
+
+		r.Get("/api/admin/streams/retention", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, workers.RetentionMetrics())
+		})
+
+		r.Get("/api/admin/pipeline/metrics", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, workers.PersistenceStats())
+		})
+
+		r.Get("/api/admin/marketdata", func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, http.StatusOK, marketdata.ProviderHealth())
+		})
+
+		r.Get("/api/admin/hydrate", func(w http.ResponseWriter, r *http.Request) {
+			snapshot, ok, err := hydrate.Current(r.Context())
+			if err != nil {
+				http.Error(w, "❌ "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				http.Error(w, "❌ Redis has not been hydrated", http.StatusNotFound)
+				return
+			}
+			writeJSON(w, http.StatusOK, snapshot)
+		})
+
+		// reload user_balance and positions:* from Postgres
+		r.Post("/api/admin/hydrate", func(w http.ResponseWriter, r *http.Request) {
+			snapshot, err := hydrate.Rebuild(r.Context(), db.DB)
+			switch {
+			case errors.Is(err, hydrate.ErrPipelineBusy):
+				http.Error(w, "⛔ "+err.Error(), http.StatusConflict)
+			case err != nil:
+				http.Error(w, "❌ "+err.Error(), http.StatusInternalServerError)
+			default:
+				writeJSON(w, http.StatusOK, snapshot)
+			}
+		})
+
+		// compare Redis and Postgres accounts; settle is how long a trade may
+		// be in flight before it counts as dropped
+		r.Get("/api/admin/reconcile", func(w http.ResponseWriter, r *http.Request) {
+			settle := 30 * time.Second
+			if v := r.URL.Query().Get("settle"); v != "" {
+				parsed, err := time.ParseDuration(v)
+				if err != nil {
+					http.Error(w, "❌ Invalid settle duration", http.StatusBadRequest)
+					return
+				}
+				settle = parsed
+			}
+			report, err := reconcile.Run(r.Context(), settle)
+			if err != nil {
+				http.Error(w, "❌ "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeJSON(w, http.StatusOK, report)
+		})
+
+		// overwrite one side of a user's account with the other, ?source=redis|postgres
+		r.Post("/api/admin/reconcile/{userID}/repair", func(w http.ResponseWriter, r *http.Request) {
+			userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+			if err != nil {
+				http.Error(w, "❌ Invalid user id", http.StatusBadRequest)
+				return
+			}
+			err = reconcile.Repair(r.Context(), userID, r.URL.Query().Get("source"))
+			switch {
+			case errors.Is(err, reconcile.ErrUnknownSource):
+				http.Error(w, "❌ "+err.Error(), http.StatusBadRequest)
+			case errors.Is(err, reconcile.ErrUnknownUser):
+				http.Error(w, "❌ User not found", http.StatusNotFound)
+			case errors.Is(err, reconcile.ErrTradesInFlight):
+				http.Error(w, "⛔ "+err.Error(), http.StatusConflict)
+			case err != nil:
+				http.Error(w, "❌ "+err.Error(), http.StatusInternalServerError)
+			default:
+				w.WriteHeader(http.StatusNoContent)
+			}
+		})
+	})
+
 	return r // return configured router
 }
+
+// adminOnly lets through requests carrying "Authorization: Bearer <token>".
+// Without a token configured every admin request is refused.
+func adminOnly(token string) func(http.Handler) http.Handler {
+	if token == "" {
+		log.Println("⚠️ ADMIN_TOKEN is not set; admin endpoints are disabled")
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if token == "" {
+				http.Error(w, "⛔ Admin endpoints are disabled", http.StatusForbidden)
+				return
+			}
+			given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				http.Error(w, "⛔ Invalid admin token", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// parseTime reads an RFC 3339 time or unix seconds; empty gives def.
+func parseTime(v string, def time.Time) (time.Time, error) {
+	if v == "" {
+		return def, nil
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, strings.TrimSpace(v))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// releaseKey frees a request's idempotency key when it failed before an
+// order was accepted, so the client's retry is treated as new.
+func releaseKey(r *http.Request, trade trade.TradeRequest) {
+	if trade.IdempotencyKey != "" {
+		orders.Release(r.Context(), trade.UserID, trade.IdempotencyKey)
+	}
+}
+
+// createOrders persists one OPEN order per leg. If an insert fails, the
+// orders already created are canceled so none is left open that was never
+// handed on.
+func createOrders(r *http.Request, legs []trade.TradeRequest) ([]orders.Order, error) {
+	placed := make([]orders.Order, 0, len(legs))
+	for _, leg := range legs {
+		id, err := orders.Create(r.Context(), leg)
+		if err != nil {
+			for _, o := range placed {
+				orders.SetStatus(r.Context(), o.ID, "CANCELED")
+			}
+			return nil, err
+		}
+		leg.OrderID = id
+		placed = append(placed, orders.FromTrade(leg))
+	}
+	return placed, nil
+}
+
+// writeOrderError maps order management errors onto HTTP statuses.
+func writeOrderError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, orders.ErrNotFound):
+		http.Error(w, "❌ Order not found", http.StatusNotFound)
+	case errors.Is(err, orders.ErrFilled), errors.Is(err, orders.ErrNotOpen), errors.Is(err, orders.ErrExecuting):
+		http.Error(w, "⛔ "+err.Error(), http.StatusConflict)
+	case errors.Is(err, orders.ErrInvalid):
+		http.Error(w, "❌ "+err.Error(), http.StatusBadRequest)
+	default:
+		http.Error(w, "❌ Failed to update order", http.StatusInternalServerError)
+	}
+}
+
+// writeDeadLetterError maps dead-letter errors onto HTTP statuses.
+func writeDeadLetterError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, workers.ErrDeadLetterNotFound):
+		http.Error(w, "❌ Dead letter not found", http.StatusNotFound)
+	case errors.Is(err, workers.ErrUnreplayable):
+		http.Error(w, "⛔ "+err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, "❌ "+err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestAdminOnly(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	cases := []struct {
+		token, header string
+		want          int
+	}{
+		{"secret", "Bearer secret", http.StatusNoContent},
+		{"secret", "Bearer wrong", http.StatusUnauthorized},
+		{"secret", "secret", http.StatusUnauthorized},
+		{"secret", "", http.StatusUnauthorized},
+		{"", "Bearer ", http.StatusForbidden},
+		{"", "", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/api/admin/hydrate", nil)
+		if c.header != "" {
+			req.Header.Set("Authorization", c.header)
+		}
+		rec := httptest.NewRecorder()
+		adminOnly(c.token)(ok).ServeHTTP(rec, req)
+		if rec.Code != c.want {
+			t.Errorf("token %q, Authorization %q: status %d, want %d", c.token, c.header, rec.Code, c.want)
+		}
+	}
+}
+
+// Every /api/admin route sits behind adminOnly.
+func TestAdminRoutesNeedTheToken(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "secret")
+	router := SetupRouter().(chi.Routes)
+	err := chi.Walk(router, func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		if !strings.HasPrefix(route, "/api/admin/") {
+			return nil
+		}
+		path := strings.NewReplacer("{id}", "1-0", "{userID}", "1").Replace(route)
+		rec := httptest.NewRecorder()
+		router.(http.Handler).ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s without a token: status %d, want %d", method, route, rec.Code, http.StatusUnauthorized)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tests/outboxCrash.js waits for the service on /api/health, without a token.
+func TestHealthNeedsNoToken(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "secret")
+	rec := httptest.NewRecorder()
+	SetupRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/health", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /api/health: status %d, want %d", rec.Code, http.StatusOK)
+	}
+}
@@ -0,0 +1,101 @@
+package bars
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"trading-service/db"
+	"trading-service/pkg/money"
+	"trading-service/pkg/shares"
+)
+
+// Price history lives in Postgres: every quote the service sees is written
+// to price_ticks, and the rollup turns ticks into 1m bars, 1m bars into 5m,
+// 5m into 1h and 1h into 1d. Bars start on multiples of their length since
+// the unix epoch, so 1d bars run from midnight UTC. Bars are built from the
+// last price; volume is the quantity traded through this service.
+
+// Interval is a bar length and how long its bars are kept.
+type Interval struct {
+	Name   string
+	Length time.Duration
+	// Retention is how long bars are kept; 0 keeps them forever.
+	Retention time.Duration
+}
+
+// Intervals are the bar lengths, shortest first; each is rolled up from the
+// one before it.
+var Intervals = []Interval{
+	{Name: "1m", Length: time.Minute, Retention: 30 * 24 * time.Hour},
+	{Name: "5m", Length: 5 * time.Minute, Retention: 180 * 24 * time.Hour},
+	{Name: "1h", Length: time.Hour, Retention: 2 * 365 * 24 * time.Hour},
+	{Name: "1d", Length: 24 * time.Hour},
+}
+
+// MaxBars is the most bars one query returns.
+const MaxBars = 5000
+
+var (
+	ErrUnknownInterval = errors.New("interval must be one of 1m, 5m, 1h, 1d")
+	ErrTooManyBars     = fmt.Errorf("range covers more than %d bars", MaxBars)
+	ErrEmptyRange      = errors.New("from must be before to")
+)
+
+type Bar struct {
+	Time   time.Time       `json:"time"` // start of the bar
+	Open   money.Money     `json:"open"`
+	High   money.Money     `json:"high"`
+	Low    money.Money     `json:"low"`
+	Close  money.Money     `json:"close"`
+	Volume shares.Quantity `json:"volume"`
+	Ticks  int             `json:"ticks"`
+}
+
+// LookupInterval finds an interval by name.
+func LookupInterval(name string) (Interval, error) {
+	for _, iv := range Intervals {
+		if iv.Name == name {
+			return iv, nil
+		}
+	}
+	return Interval{}, ErrUnknownInterval
+}
+
+// Query returns symbol's bars of the named interval that start in [from, to),
+// oldest first. The latest bar may still be forming.
+func Query(ctx context.Context, symbol, interval string, from, to time.Time) ([]Bar, error) {
+	iv, err := LookupInterval(interval)
+	if err != nil {
+		return nil, err
+	}
+	if !from.Before(to) {
+		return nil, ErrEmptyRange
+	}
+	if to.Sub(from)/iv.Length > MaxBars {
+		return nil, ErrTooManyBars
+	}
+
+	rows, err := db.DB.QueryContext(ctx, `
+		SELECT bucket, open, high, low, close, volume, tick_count
+		FROM price_bars
+		WHERE symbol = $1 AND interval = $2 AND bucket >= $3 AND bucket < $4
+		ORDER BY bucket
+	`, strings.ToUpper(symbol), iv.Name, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	bars := []Bar{}
+	for rows.Next() {
+		var b Bar
+		if err := rows.Scan(&b.Time, &b.Open, &b.High, &b.Low, &b.Close, &b.Volume, &b.Ticks); err != nil {
+			return nil, err
+		}
+		b.Time = b.Time.UTC()
+		bars = append(bars, b)
+	}
+	return bars, rows.Err()
+}
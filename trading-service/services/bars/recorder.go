@@ -0,0 +1,88 @@
+package bars
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"trading-service/db"
+	redisStorage "trading-service/redis"
+
+	"github.com/lib/pq"
+)
+
+// tickBuffer is how many quotes may wait to be written; when the database
+// falls that far behind, new quotes are dropped rather than blocking the
+// price cache.
+const tickBuffer = 10000
+
+// tickBatch is the most ticks written by one INSERT.
+const tickBatch = 1000
+
+var (
+	pendingTicks = make(chan redisStorage.Quote, tickBuffer)
+	droppedTicks int64
+)
+
+// record queues q to be written to price_ticks.
+func record(q redisStorage.Quote) {
+	if q.UpdatedAt.IsZero() {
+		return
+	}
+	select {
+	case pendingTicks <- q:
+	default:
+		if atomic.AddInt64(&droppedTicks, 1)%1000 == 1 {
+			log.Printf("⚠️ Price tick buffer is full; %d ticks dropped so far", atomic.LoadInt64(&droppedTicks))
+		}
+	}
+}
+
+// writeTicks writes queued ticks every flush interval, or sooner once a
+// batch is full.
+func writeTicks(flush time.Duration) {
+	ticker := time.NewTicker(flush)
+	defer ticker.Stop()
+	batch := make([]redisStorage.Quote, 0, tickBatch)
+	for {
+		select {
+		case q := <-pendingTicks:
+			batch = append(batch, q)
+			if len(batch) < tickBatch {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := insertTicks(context.Background(), batch); err != nil {
+			log.Printf("❌ Failed to write %d price ticks: %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+}
+
+// insertTicks writes batch in one statement. A tick already stored, e.g.
+// by another instance that saw the same quote, is skipped.
+func insertTicks(ctx context.Context, batch []redisStorage.Quote) error {
+	symbols := make([]string, len(batch))
+	times := make([]string, len(batch))
+	bids := make([]string, len(batch))
+	asks := make([]string, len(batch))
+	lasts := make([]string, len(batch))
+	for i, q := range batch {
+		symbols[i] = q.Symbol
+		times[i] = q.UpdatedAt.UTC().Format(time.RFC3339Nano)
+		bids[i] = q.Bid.String()
+		asks[i] = q.Ask.String()
+		lasts[i] = q.Last.String()
+	}
+	_, err := db.DB.ExecContext(ctx, `
+		INSERT INTO price_ticks (symbol, ts, bid, ask, last)
+		SELECT * FROM unnest($1::text[], $2::timestamptz[], $3::numeric[], $4::numeric[], $5::numeric[])
+		ON CONFLICT (symbol, ts) DO NOTHING
+	`, pq.Array(symbols), pq.Array(times), pq.Array(bids), pq.Array(asks), pq.Array(lasts))
+	return err
+}
@@ -0,0 +1,183 @@
+package bars
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"trading-service/db"
+	redisStorage "trading-service/redis"
+)
+
+// Config tunes the recorder and rollup.
+type Config struct {
+	Flush  time.Duration // how often queued ticks are written
+	Rollup time.Duration // how often bars are rebuilt from new data
+	// TickRetention is how long raw ticks are kept; it must cover a few
+	// rollups so late ticks still reach their 1m bar.
+	TickRetention time.Duration
+	Cleanup       time.Duration // how often old ticks and bars are deleted
+}
+
+// Start records every new quote from the price cache and keeps the bars
+// rolled up. Call it after redisStorage.InitRedis.
+func Start(cfg Config) {
+	if cfg.Flush <= 0 {
+		cfg.Flush = time.Second
+	}
+	if cfg.Rollup <= 0 {
+		cfg.Rollup = 10 * time.Second
+	}
+	if cfg.TickRetention <= 0 {
+		cfg.TickRetention = 48 * time.Hour
+	}
+	if cfg.Cleanup <= 0 {
+		cfg.Cleanup = time.Hour
+	}
+
+	redisStorage.OnQuote(record)
+	go writeTicks(cfg.Flush)
+	go func() {
+		ticker := time.NewTicker(cfg.Rollup)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := RollupAll(context.Background()); err != nil {
+				log.Printf("❌ Bar rollup failed: %v", err)
+			}
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(cfg.Cleanup)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := cleanup(context.Background(), cfg.TickRetention); err != nil {
+				log.Printf("❌ Price history cleanup failed: %v", err)
+			}
+		}
+	}()
+	log.Printf("✅ Recording price ticks; rolling up bars every %s", cfg.Rollup)
+}
+
+// RollupAll rebuilds the recent bars of every interval, shortest first, so
+// each interval is built from the bars just updated below it.
+func RollupAll(ctx context.Context) error {
+	for i, iv := range Intervals {
+		var err error
+		if i == 0 {
+			err = rollupTicks(ctx, iv)
+		} else {
+			err = rollupBars(ctx, Intervals[i-1], iv)
+		}
+		if err != nil {
+			return fmt.Errorf("%s bars: %v", iv.Name, err)
+		}
+	}
+	return nil
+}
+
+// rebuildFrom is where iv's rollup starts: one bar before its newest, so the
+// newest bar is finished and the one before it picks up late ticks and
+// trades. With no bars yet it starts from the beginning.
+func rebuildFrom(ctx context.Context, iv Interval) (time.Time, error) {
+	var newest sql.NullTime
+	err := db.DB.QueryRowContext(ctx,
+		`SELECT MAX(bucket) FROM price_bars WHERE interval = $1`, iv.Name,
+	).Scan(&newest)
+	if err != nil || !newest.Valid {
+		return time.Unix(0, 0), err
+	}
+	return newest.Time.Add(-iv.Length), nil
+}
+
+// rollupTicks builds iv's bars from price_ticks; volume comes from trades.
+func rollupTicks(ctx context.Context, iv Interval) error {
+	from, err := rebuildFrom(ctx, iv)
+	if err != nil {
+		return err
+	}
+	// trades.created_at is local time without a zone, so $1 is converted
+	// to it for the index and the buckets are cut after converting back
+	_, err = db.DB.ExecContext(ctx, `
+		WITH ticks AS (
+			SELECT symbol,
+			       to_timestamp(floor(extract(epoch FROM ts) / $3) * $3) AS bucket,
+			       (array_agg(last ORDER BY ts))[1]      AS open,
+			       MAX(last)                             AS high,
+			       MIN(last)                             AS low,
+			       (array_agg(last ORDER BY ts DESC))[1] AS close,
+			       COUNT(*)                              AS tick_count
+			FROM price_ticks
+			WHERE ts >= $1
+			GROUP BY 1, 2
+		), volumes AS (
+			SELECT symbol,
+			       to_timestamp(floor(extract(epoch FROM created_at::timestamptz) / $3) * $3) AS bucket,
+			       SUM(quantity) AS volume
+			FROM trades
+			WHERE created_at >= $1::timestamptz::timestamp
+			GROUP BY 1, 2
+		)
+		INSERT INTO price_bars (symbol, interval, bucket, open, high, low, close, volume, tick_count)
+		SELECT t.symbol, $2, t.bucket, t.open, t.high, t.low, t.close, COALESCE(v.volume, 0), t.tick_count
+		FROM ticks t
+		LEFT JOIN volumes v ON v.symbol = t.symbol AND v.bucket = t.bucket
+		ON CONFLICT (symbol, interval, bucket) DO UPDATE SET
+			open = EXCLUDED.open, high = EXCLUDED.high, low = EXCLUDED.low, close = EXCLUDED.close,
+			volume = EXCLUDED.volume, tick_count = EXCLUDED.tick_count
+	`, from, iv.Name, iv.Length.Seconds())
+	return err
+}
+
+// rollupBars builds iv's bars from the shorter source interval's bars.
+func rollupBars(ctx context.Context, source, iv Interval) error {
+	from, err := rebuildFrom(ctx, iv)
+	if err != nil {
+		return err
+	}
+	_, err = db.DB.ExecContext(ctx, `
+		INSERT INTO price_bars (symbol, interval, bucket, open, high, low, close, volume, tick_count)
+		SELECT symbol, $2,
+		       to_timestamp(floor(extract(epoch FROM bucket) / $4) * $4),
+		       (array_agg(open ORDER BY bucket))[1],
+		       MAX(high),
+		       MIN(low),
+		       (array_agg(close ORDER BY bucket DESC))[1],
+		       SUM(volume),
+		       SUM(tick_count)
+		FROM price_bars
+		WHERE interval = $3 AND bucket >= $1
+		GROUP BY symbol, 3
+		ON CONFLICT (symbol, interval, bucket) DO UPDATE SET
+			open = EXCLUDED.open, high = EXCLUDED.high, low = EXCLUDED.low, close = EXCLUDED.close,
+			volume = EXCLUDED.volume, tick_count = EXCLUDED.tick_count
+	`, from, iv.Name, source.Name, iv.Length.Seconds())
+	return err
+}
+
+// cleanup deletes ticks and bars past their retention.
+func cleanup(ctx context.Context, tickRetention time.Duration) error {
+	now := time.Now()
+	res, err := db.DB.ExecContext(ctx, `DELETE FROM price_ticks WHERE ts < $1`, now.Add(-tickRetention))
+	if err != nil {
+		return err
+	}
+	deleted, _ := res.RowsAffected()
+	for _, iv := range Intervals {
+		if iv.Retention <= 0 {
+			continue
+		}
+		res, err := db.DB.ExecContext(ctx,
+			`DELETE FROM price_bars WHERE interval = $1 AND bucket < $2`, iv.Name, now.Add(-iv.Retention))
+		if err != nil {
+			return fmt.Errorf("%s bars: %v", iv.Name, err)
+		}
+		n, _ := res.RowsAffected()
+		deleted += n
+	}
+	if deleted > 0 {
+		log.Printf("🧹 Deleted %d expired price ticks and bars", deleted)
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+package hydrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"trading-service/pkg/money"
+	"trading-service/pkg/redisClient"
+	"trading-service/pkg/shares"
+	trade_service "trading-service/services/trade"
+	"trading-service/services/workers"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Hydration loads user_balance and positions:<id> into Redis from Postgres.
+// Every load is a numbered snapshot recorded in the redis_snapshot hash: it is
+// marked loading before the first key is touched and complete after the last
+// one is written. A marker still saying loading means a load was cut short,
+// so the cache is only partly there and is rebuilt.
+const (
+	snapshotKey        = "redis_snapshot"
+	snapshotVersionKey = "redis_snapshot:version"
+
+	StatusLoading  = "loading"
+	StatusComplete = "complete"
+
+	// rows fetched from each Postgres cursor per round trip
+	fetchSize = 5000
+	// keys handled per SCAN round when swapping the snapshot in
+	scanCount = 1000
+
+	// a snapshot is written under stagingPrefix and renamed into place
+	stagingPrefix = "redis_snapshot:staging:"
+	// the lock expires this long after the last batch was loaded, so a
+	// load cut short by a crash does not hold trades off for good
+	lockTTL = time.Minute
+)
+
+// ErrPipelineBusy is returned while executed trades are still on their way
+// to Postgres, see workers.Drained. Loading from Postgres would undo them in
+// Redis.
+var ErrPipelineBusy = errors.New("the pipeline has trades not yet in Postgres")
+
+// Snapshot is the redis_snapshot marker.
+type Snapshot struct {
+	Version     int64  `json:"version"`
+	Status      string `json:"status"`
+	StartedAt   string `json:"started_at"`
+	CompletedAt string `json:"completed_at,omitempty"`
+	Users       int64  `json:"users"`
+	Positions   int64  `json:"positions"`
+}
+
+// Current reads the marker; ok is false if Redis has never been hydrated.
+func Current(ctx context.Context) (Snapshot, bool, error) {
+	fields, err := redisClient.Client.HGetAll(ctx, snapshotKey).Result()
+	if err != nil || len(fields) == 0 {
+		return Snapshot{}, false, err
+	}
+	s := Snapshot{
+		Status:      fields["status"],
+		StartedAt:   fields["started_at"],
+		CompletedAt: fields["completed_at"],
+	}
+	s.Version, _ = strconv.ParseInt(fields["version"], 10, 64)
+	s.Users, _ = strconv.ParseInt(fields["users"], 10, 64)
+	s.Positions, _ = strconv.ParseInt(fields["positions"], 10, 64)
+	return s, true, nil
+}
+
+// EnsureLoaded hydrates Redis at startup unless a complete snapshot is
+// already there. A snapshot that was cut short, or a cache loaded before
+// markers existed, is rebuilt once the pipeline is drained. A load writes
+// to staging keys, so until then the live keys are the last complete
+// snapshot plus the trades since, and they are kept.
+func EnsureLoaded(ctx context.Context, db *sql.DB) error {
+	current, ok, err := Current(ctx)
+	if err != nil {
+		return err
+	}
+	if ok && current.Status == StatusComplete {
+		log.Printf("✅ Redis snapshot v%d is complete (%d users, %d positions)", current.Version, current.Users, current.Positions)
+		return nil
+	}
+	if ok {
+		log.Printf("⚠️ Redis snapshot v%d is %s, rebuilding it", current.Version, current.Status)
+	}
+	_, err = Rebuild(ctx, db)
+	if errors.Is(err, ErrPipelineBusy) {
+		log.Printf("⚠️ Not rebuilding Redis, keeping the existing cache: %v", err)
+		return nil
+	}
+	return err
+}
+
+// Rebuild hydrates Redis on demand. It refuses with ErrPipelineBusy while
+// trades are still on their way to Postgres.
+func Rebuild(ctx context.Context, db *sql.DB) (Snapshot, error) {
+	return load(ctx, db, true)
+}
+
+func checkDrained(ctx context.Context) error {
+	err := workers.Drained(ctx)
+	if errors.Is(err, workers.ErrUndrained) {
+		return fmt.Errorf("%w: %v", ErrPipelineBusy, err)
+	}
+	return err
+}
+
+// Load replaces user_balance and positions:* with a new snapshot of Postgres.
+// Both tables are read through cursors in one repeatable-read transaction, so
+// balances and positions come from the same point in time.
+func Load(ctx context.Context, db *sql.DB) (Snapshot, error) {
+	return load(ctx, db, false)
+}
+
+// load holds trade_service.HydrationLockKey for the whole load, so no trade
+// script runs while it does: buy_stream cannot grow once drained has been
+// checked, and no trade is applied to keys about to be replaced. The
+// snapshot is written to staging keys and renamed into place at the end.
+func load(ctx context.Context, db *sql.DB, drained bool) (Snapshot, error) {
+	start := time.Now()
+	version, err := redisClient.Client.Incr(ctx, snapshotVersionKey).Result()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	locked, err := redisClient.Client.SetNX(ctx, trade_service.HydrationLockKey, version, lockTTL).Result()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if !locked {
+		return Snapshot{}, fmt.Errorf("%w: another snapshot is being loaded", ErrPipelineBusy)
+	}
+	defer unlockScript.Run(context.Background(), redisClient.Client, []string{trade_service.HydrationLockKey}, version)
+	if drained {
+		if err := checkDrained(ctx); err != nil {
+			return Snapshot{}, err
+		}
+	}
+
+	snapshot := Snapshot{Version: version, Status: StatusLoading, StartedAt: start.UTC().Format(time.RFC3339)}
+	if err := writeMarker(ctx, snapshot); err != nil {
+		return Snapshot{}, err
+	}
+	log.Printf("🚚 Loading Redis snapshot v%d from Postgres", version)
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return Snapshot{}, err
+	}
+	defer tx.Rollback()
+
+	// whatever an earlier load left behind
+	if err := unlinkMatching(ctx, stagingPrefix+"*", nil); err != nil {
+		return Snapshot{}, err
+	}
+	if snapshot.Users, err = loadBalances(ctx, tx); err != nil {
+		return Snapshot{}, fmt.Errorf("failed to load balances: %v", err)
+	}
+	if snapshot.Positions, err = loadPositions(ctx, tx); err != nil {
+		return Snapshot{}, fmt.Errorf("failed to load positions: %v", err)
+	}
+	if err := redisClient.Client.Expire(ctx, trade_service.HydrationLockKey, lockTTL).Err(); err != nil {
+		return Snapshot{}, err
+	}
+	if err := swapIn(ctx); err != nil {
+		return Snapshot{}, fmt.Errorf("failed to swap the snapshot in: %v", err)
+	}
+
+	snapshot.Status = StatusComplete
+	snapshot.CompletedAt = time.Now().UTC().Format(time.RFC3339)
+	if err := writeMarker(ctx, snapshot); err != nil {
+		return Snapshot{}, err
+	}
+	log.Printf("✅ Loaded Redis snapshot v%d: %d users, %d positions in %s", version, snapshot.Users, snapshot.Positions, time.Since(start))
+	return snapshot, nil
+}
+
+// unlockScript releases the lock only if it is still the one this load took.
+var unlockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+func writeMarker(ctx context.Context, s Snapshot) error {
+	return redisClient.Client.HSet(ctx, snapshotKey,
+		"version", s.Version,
+		"status", s.Status,
+		"started_at", s.StartedAt,
+		"completed_at", s.CompletedAt,
+		"users", s.Users,
+		"positions", s.Positions,
+	).Err()
+}
+
+// swapIn renames the staged user_balance and positions:<id> keys over the
+// live ones and removes live keys the snapshot does not have, so users and
+// symbols no longer in Postgres do not linger.
+func swapIn(ctx context.Context) error {
+	loaded := make(map[string]bool)
+	iter := redisClient.Client.Scan(ctx, 0, stagingPrefix+"*", scanCount).Iterator()
+	pipe := redisClient.Client.TxPipeline()
+	for iter.Next(ctx) {
+		staged := iter.Val()
+		live := strings.TrimPrefix(staged, stagingPrefix)
+		loaded[live] = true
+		pipe.Rename(ctx, staged, live)
+		if pipe.Len() == scanCount {
+			if _, err := pipe.Exec(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	if !loaded["user_balance"] {
+		if err := redisClient.Client.Unlink(ctx, "user_balance").Err(); err != nil {
+			return err
+		}
+	}
+	return unlinkMatching(ctx, "positions:*", loaded)
+}
+
+// unlinkMatching removes every key matching pattern that is not in keep.
+func unlinkMatching(ctx context.Context, pattern string, keep map[string]bool) error {
+	iter := redisClient.Client.Scan(ctx, 0, pattern, scanCount).Iterator()
+	batch := make([]string, 0, scanCount)
+	for iter.Next(ctx) {
+		if keep[iter.Val()] {
+			continue
+		}
+		batch = append(batch, iter.Val())
+		if len(batch) == scanCount {
+			if err := redisClient.Client.Unlink(ctx, batch...).Err(); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(batch) > 0 {
+		return redisClient.Client.Unlink(ctx, batch...).Err()
+	}
+	return nil
+}
+
+// fetchAll declares a cursor for query and calls write with each batch of rows
+// until the cursor is exhausted.
+func fetchAll(ctx context.Context, tx *sql.Tx, name, query string, write func(*sql.Rows, redis.Pipeliner) (int64, error)) (int64, error) {
+	if _, err := tx.ExecContext(ctx, "DECLARE "+name+" NO SCROLL CURSOR FOR "+query); err != nil {
+		return 0, err
+	}
+	defer tx.ExecContext(ctx, "CLOSE "+name)
+	var total int64
+	for {
+		rows, err := tx.QueryContext(ctx, fmt.Sprintf("FETCH %d FROM %s", fetchSize, name))
+		if err != nil {
+			return total, err
+		}
+		pipe := redisClient.Client.Pipeline()
+		pipe.Expire(ctx, trade_service.HydrationLockKey, lockTTL)
+		n, err := write(rows, pipe)
+		rows.Close()
+		if err != nil {
+			return total, err
+		}
+		if n == 0 {
+			return total, nil
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return total, err
+		}
+		total += n
+	}
+}
+
+func loadBalances(ctx context.Context, tx *sql.Tx) (int64, error) {
+	return fetchAll(ctx, tx, "hydrate_users", `SELECT id, balance FROM users ORDER BY id`,
+		func(rows *sql.Rows, pipe redis.Pipeliner) (int64, error) {
+			var n int64
+			fields := make([]interface{}, 0, 2*fetchSize)
+			for rows.Next() {
+				var id int
+				var balance money.Money
+				if err := rows.Scan(&id, &balance); err != nil {
+					return n, err
+				}
+				fields = append(fields, strconv.Itoa(id), balance.String())
+				n++
+			}
+			if len(fields) > 0 {
+				pipe.HSet(ctx, stagingPrefix+"user_balance", fields...)
+			}
+			return n, rows.Err()
+		})
+}
+
+// loadPositions writes positions in the "quantity,average_price" encoding the
+// trade scripts read.
+func loadPositions(ctx context.Context, tx *sql.Tx) (int64, error) {
+	return fetchAll(ctx, tx, "hydrate_positions", `SELECT user_id, symbol, quantity, average_price FROM positions ORDER BY user_id`,
+		func(rows *sql.Rows, pipe redis.Pipeliner) (int64, error) {
+			var n int64
+			for rows.Next() {
+				var userID int
+				var symbol string
+				var quantity shares.Quantity
+				var average money.Money
+				if err := rows.Scan(&userID, &symbol, &quantity, &average); err != nil {
+					return n, err
+				}
+				pipe.HSet(ctx, fmt.Sprintf("%spositions:%d", stagingPrefix, userID), symbol, quantity.String()+","+average.String())
+				n++
+			}
+			return n, rows.Err()
+		})
+}
@@ -0,0 +1,64 @@
+package hydrate
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"trading-service/pkg/redisClient"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// useTestRedis points redisClient at an empty database 15 on REDIS_ADDR
+// (default localhost:6379), or skips the test when Redis is not running.
+func useTestRedis(t *testing.T) {
+	t.Helper()
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr, DB: 15})
+	ctx := context.Background()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		t.Skipf("Redis is not available at %s: %v", addr, err)
+	}
+	if err := client.FlushDB(ctx).Err(); err != nil {
+		t.Fatalf("failed to flush the test database: %v", err)
+	}
+	previous := redisClient.Client
+	redisClient.Client = client
+	t.Cleanup(func() {
+		client.FlushDB(ctx)
+		client.Close()
+		redisClient.Client = previous
+	})
+}
+
+// The staged snapshot replaces the live keys, and positions of users the
+// snapshot does not have are dropped.
+func TestSwapInReplacesLiveKeys(t *testing.T) {
+	useTestRedis(t)
+	ctx := context.Background()
+	client := redisClient.Client
+	client.HSet(ctx, "user_balance", "1", "5.00", "2", "6.00")
+	client.HSet(ctx, "positions:1", "AAPL", "1,5.00")
+	client.HSet(ctx, "positions:2", "MSFT", "2,6.00")
+	client.HSet(ctx, stagingPrefix+"user_balance", "1", "50.00")
+	client.HSet(ctx, stagingPrefix+"positions:1", "TSLA", "3,7.00")
+
+	if err := swapIn(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(client.HGetAll(ctx, "user_balance").Val()); got != "map[1:50.00]" {
+		t.Fatalf("user_balance is %s", got)
+	}
+	if got := fmt.Sprint(client.HGetAll(ctx, "positions:1").Val()); got != "map[TSLA:3,7.00]" {
+		t.Fatalf("positions:1 is %s", got)
+	}
+	if n := client.Exists(ctx, "positions:2", stagingPrefix+"user_balance", stagingPrefix+"positions:1").Val(); n != 0 {
+		t.Fatalf("%d stale or staged keys left", n)
+	}
+}
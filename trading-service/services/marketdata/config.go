@@ -0,0 +1,179 @@
+package marketdata
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"trading-service/pkg/money"
+)
+
+// active is the feed started by StartFromEnv, if any.
+var active *Feed
+
+// StartFromEnv builds a feed from the environment and starts it:
+//
+//	MARKET_DATA_PROVIDERS  providers in fallback order, e.g. "http,csv"; unset leaves prices to the Node feed
+//	MARKET_DATA_URL        quote API URL for http, see HTTPProvider
+//	MARKET_DATA_CSV        recorded quotes for csv, see CSVProvider
+//	MARKET_DATA_SYMBOLS    comma-separated symbols; default is every cached symbol
+//	MARKET_DATA_INTERVAL   poll interval, default 1m; the simulator's tick rate
+//
+// The simulator provider is configured with:
+//
+//	SIM_SEED               random seed, default 1; main's simulated trades use it too
+//	SIM_SYMBOLS            symbols with optional start prices, e.g. "AAPL=190,MSFT"; default the load test's symbols, unpriced ones start at 100
+//	SIM_DRIFT              annual drift, default 0.05
+//	SIM_VOLATILITY         annual volatility, default 0.3
+//	SIM_CORRELATION        correlation between symbols, 0 to 1, default 0.5
+//	SIM_JUMP_RATE          jumps per symbol per year, default 4
+//	SIM_JUMP_MEAN          mean log jump size, default 0
+//	SIM_JUMP_STDDEV        log jump size standard deviation, default 0.05
+//	SIM_SPREAD_BPS         bid/ask spread in basis points, default 5
+//	SIM_STEP               market time per tick, default the poll interval
+//	SIM_START              RFC 3339 market time quotes are stamped from, default the start of the service
+//
+// It returns false when no providers are configured.
+func StartFromEnv() (bool, error) {
+	names := splitList(os.Getenv("MARKET_DATA_PROVIDERS"))
+	if len(names) == 0 {
+		return false, nil
+	}
+	cfg := FeedConfig{Symbols: splitList(os.Getenv("MARKET_DATA_SYMBOLS"))}
+	if v := os.Getenv("MARKET_DATA_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			return false, fmt.Errorf("invalid MARKET_DATA_INTERVAL: %v", err)
+		}
+		cfg.Interval = interval
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Minute
+	}
+	for _, name := range names {
+		provider, err := providerFromEnv(name, cfg.Interval)
+		if err != nil {
+			return false, err
+		}
+		cfg.Providers = append(cfg.Providers, provider)
+	}
+	feed, err := NewFeed(cfg)
+	if err != nil {
+		return false, err
+	}
+	active = feed
+	feed.Start()
+	return true, nil
+}
+
+func providerFromEnv(name string, interval time.Duration) (Provider, error) {
+	switch name {
+	case "http":
+		url := os.Getenv("MARKET_DATA_URL")
+		if url == "" {
+			return nil, fmt.Errorf("the http market data provider needs MARKET_DATA_URL")
+		}
+		return NewHTTPProvider(name, url), nil
+	case "csv":
+		path := os.Getenv("MARKET_DATA_CSV")
+		if path == "" {
+			return nil, fmt.Errorf("the csv market data provider needs MARKET_DATA_CSV")
+		}
+		return NewCSVProvider(name, path)
+	case "simulator":
+		return simulatorFromEnv(interval)
+	}
+	return nil, fmt.Errorf("unknown market data provider %q", name)
+}
+
+// defaultSimSymbols are the symbols main's load test trades.
+const defaultSimSymbols = "AAPL,MSFT,AMZN,GOOGL,META"
+
+// Seed is SIM_SEED, or 1 if it is not set. The simulator and the simulated
+// trades both use it, so one seed repeats a whole run.
+func Seed() (int64, error) {
+	seed, err := strconv.ParseInt(envOr("SIM_SEED", "1"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid SIM_SEED: %v", err)
+	}
+	return seed, nil
+}
+
+func simulatorFromEnv(interval time.Duration) (*Simulator, error) {
+	cfg := SimulatorConfig{StartPrices: make(map[string]money.Money), Step: interval}
+	var err error
+	if cfg.Seed, err = Seed(); err != nil {
+		return nil, err
+	}
+	if v := os.Getenv("SIM_START"); v != "" {
+		if cfg.Start, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, fmt.Errorf("invalid SIM_START: %v", err)
+		}
+	}
+	for _, entry := range splitList(envOr("SIM_SYMBOLS", defaultSimSymbols)) {
+		symbol, price, priced := strings.Cut(entry, "=")
+		start := money.FromFloat(100)
+		if priced {
+			if start, err = money.Parse(price); err != nil || start <= 0 {
+				return nil, fmt.Errorf("invalid SIM_SYMBOLS price for %s: %q", symbol, price)
+			}
+		}
+		cfg.StartPrices[strings.TrimSpace(symbol)] = start
+	}
+	floats := []struct {
+		env, def string
+		dest     *float64
+	}{
+		{"SIM_DRIFT", "0.05", &cfg.Drift},
+		{"SIM_VOLATILITY", "0.3", &cfg.Volatility},
+		{"SIM_CORRELATION", "0.5", &cfg.Correlation},
+		{"SIM_JUMP_RATE", "4", &cfg.JumpRate},
+		{"SIM_JUMP_MEAN", "0", &cfg.JumpMean},
+		{"SIM_JUMP_STDDEV", "0.05", &cfg.JumpStdDev},
+		{"SIM_SPREAD_BPS", "5", &cfg.SpreadBps},
+	}
+	for _, f := range floats {
+		if *f.dest, err = strconv.ParseFloat(envOr(f.env, f.def), 64); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", f.env, err)
+		}
+	}
+	if cfg.Correlation < 0 || cfg.Correlation > 1 {
+		return nil, fmt.Errorf("SIM_CORRELATION must be between 0 and 1")
+	}
+	if v := os.Getenv("SIM_STEP"); v != "" {
+		if cfg.Step, err = time.ParseDuration(v); err != nil {
+			return nil, fmt.Errorf("invalid SIM_STEP: %v", err)
+		}
+	}
+	log.Printf("🎲 Simulating %d symbols from seed %d", len(cfg.StartPrices), cfg.Seed)
+	return NewSimulator(cfg), nil
+}
+
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// ProviderHealth reports the running feed's providers; nil if there is no
+// feed.
+func ProviderHealth() []Health {
+	if active == nil {
+		return nil
+	}
+	return active.Health()
+}
@@ -0,0 +1,96 @@
+package marketdata
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"trading-service/pkg/money"
+	redisStorage "trading-service/redis"
+)
+
+// CSVProvider replays recorded quotes from a file with the columns
+// time,symbol,bid,ask,last, where time is anything that orders the ticks
+// (e.g. RFC 3339 or unix seconds). A header row is skipped. Consecutive rows
+// with the same time form one tick, and each Fetch returns the next tick,
+// stamped with the time of the fetch, so the replay runs at the feed's
+// interval. At the end of the file the replay starts over.
+type CSVProvider struct {
+	name string
+
+	mutex sync.Mutex
+	ticks [][]redisStorage.Quote
+	next  int
+}
+
+func NewCSVProvider(name, path string) (*CSVProvider, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	ticks, err := readTicks(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(ticks) == 0 {
+		return nil, fmt.Errorf("%s has no quotes", path)
+	}
+	return &CSVProvider{name: name, ticks: ticks}, nil
+}
+
+func readTicks(r io.Reader) ([][]redisStorage.Quote, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 5
+	reader.TrimLeadingSpace = true
+	var ticks [][]redisStorage.Quote
+	lastTime := ""
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return ticks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if line == 1 && strings.EqualFold(record[1], "symbol") {
+			continue
+		}
+		q := redisStorage.Quote{Symbol: record[1]}
+		for i, dest := range []*money.Money{&q.Bid, &q.Ask, &q.Last} {
+			if *dest, err = money.Parse(record[2+i]); err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+		}
+		if record[0] != lastTime || len(ticks) == 0 {
+			ticks = append(ticks, nil)
+			lastTime = record[0]
+		}
+		ticks[len(ticks)-1] = append(ticks[len(ticks)-1], q)
+	}
+}
+
+func (p *CSVProvider) Name() string {
+	return p.name
+}
+
+// Fetch returns the next tick; symbols is ignored.
+func (p *CSVProvider) Fetch(ctx context.Context, symbols []string) ([]redisStorage.Quote, error) {
+	p.mutex.Lock()
+	tick := p.ticks[p.next]
+	p.next = (p.next + 1) % len(p.ticks)
+	p.mutex.Unlock()
+
+	now := time.Now()
+	quotes := make([]redisStorage.Quote, len(tick))
+	for i, q := range tick {
+		q.UpdatedAt = now
+		quotes[i] = q
+	}
+	return quotes, nil
+}
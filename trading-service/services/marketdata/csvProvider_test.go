@@ -0,0 +1,65 @@
+package marketdata
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeCSV(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "quotes.csv")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Rows sharing a time are one tick; the replay loops at the end.
+func TestCSVProviderReplaysTicks(t *testing.T) {
+	provider, err := NewCSVProvider("replay", writeCSV(t, `time,symbol,bid,ask,last
+1,AAPL,100.00,100.20,100.10
+1,MSFT,300.00,300.50,300.25
+2,AAPL,101.00,101.20,101.10
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for i := 0; i < 3; i++ {
+		quotes, err := provider.Fetch(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tick []string
+		for _, q := range quotes {
+			if q.UpdatedAt.IsZero() {
+				t.Fatalf("quote %s is not stamped", q.Symbol)
+			}
+			tick = append(tick, q.Symbol+"@"+q.Last.String())
+		}
+		got = append(got, fmt.Sprint(tick))
+	}
+	want := "[[AAPL@100.10 MSFT@300.25] [AAPL@101.10] [AAPL@100.10 MSFT@300.25]]"
+	if fmt.Sprint(got) != want {
+		t.Fatalf("replayed %v, want %s", got, want)
+	}
+}
+
+func TestCSVProviderRejectsBadFiles(t *testing.T) {
+	for name, content := range map[string]string{
+		"bad price":   "1,AAPL,abc,100.20,100.10\n",
+		"short row":   "1,AAPL,100.00\n",
+		"header only": "time,symbol,bid,ask,last\n",
+		"empty":       "",
+	} {
+		if _, err := NewCSVProvider("replay", writeCSV(t, content)); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+	if _, err := NewCSVProvider("replay", filepath.Join(t.TempDir(), "missing.csv")); err == nil {
+		t.Error("accepted a missing file")
+	}
+}
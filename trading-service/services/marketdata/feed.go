@@ -0,0 +1,198 @@
+package marketdata
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	redisStorage "trading-service/redis"
+)
+
+// Provider is a source of quotes.
+type Provider interface {
+	Name() string
+	// Fetch returns the current quotes of symbols. A provider that does
+	// not take a symbol list, like a replay, may return other symbols.
+	Fetch(ctx context.Context, symbols []string) ([]redisStorage.Quote, error)
+}
+
+// Health is how a provider has been doing.
+type Health struct {
+	Provider    string `json:"provider"`
+	Healthy     bool   `json:"healthy"`
+	Failures    int    `json:"consecutive_failures"`
+	LastError   string `json:"last_error,omitempty"`
+	LastSuccess string `json:"last_success,omitempty"`
+	// RetryAt is when an unhealthy provider is tried again.
+	RetryAt string `json:"retry_at,omitempty"`
+}
+
+// FeedConfig tunes a Feed. Providers are tried in order on every poll and
+// the first to return quotes wins, so later providers are fallbacks.
+type FeedConfig struct {
+	Providers []Provider
+	// Symbols to quote; empty means every symbol in the price cache.
+	Symbols  []string
+	Interval time.Duration
+	// Timeout bounds one provider's Fetch.
+	Timeout time.Duration
+	// MaxFailures in a row mark a provider unhealthy; it is skipped until
+	// Cooldown has passed and then tried again.
+	MaxFailures int
+	Cooldown    time.Duration
+}
+
+// Feed polls its providers and stores their quotes with
+// redisStorage.StoreQuotes, which updates the price store and the cache.
+type Feed struct {
+	cfg FeedConfig
+
+	healthMutex sync.Mutex
+	health      map[string]*providerHealth
+}
+
+type providerHealth struct {
+	failures    int
+	lastError   string
+	lastSuccess time.Time
+	retryAt     time.Time
+}
+
+func NewFeed(cfg FeedConfig) (*Feed, error) {
+	if len(cfg.Providers) == 0 {
+		return nil, fmt.Errorf("market data feed needs at least one provider")
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Minute
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.MaxFailures <= 0 {
+		cfg.MaxFailures = 3
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = time.Minute
+	}
+	f := &Feed{cfg: cfg, health: make(map[string]*providerHealth)}
+	for _, p := range cfg.Providers {
+		f.health[p.Name()] = &providerHealth{}
+	}
+	return f, nil
+}
+
+// Start polls right away and then every interval.
+func (f *Feed) Start() {
+	go func() {
+		ticker := time.NewTicker(f.cfg.Interval)
+		defer ticker.Stop()
+		for {
+			if err := f.Poll(context.Background()); err != nil {
+				log.Printf("❌ Market data poll failed: %v", err)
+			}
+			<-ticker.C
+		}
+	}()
+	log.Printf("✅ Market data feed polling every %s", f.cfg.Interval)
+}
+
+// Poll fetches quotes from the first healthy provider that has them and
+// stores them. It fails only if every provider failed or was skipped.
+func (f *Feed) Poll(ctx context.Context) error {
+	symbols := f.cfg.Symbols
+	if len(symbols) == 0 {
+		symbols = redisStorage.Symbols()
+	}
+	name, quotes, err := f.fetch(ctx, symbols)
+	if err != nil {
+		return err
+	}
+	if err := redisStorage.StoreQuotes(ctx, quotes...); err != nil {
+		return fmt.Errorf("failed to store quotes from %s: %v", name, err)
+	}
+	return nil
+}
+
+// fetch tries the providers in order, skipping unhealthy ones, and returns
+// the quotes of the first that has any, with its name.
+func (f *Feed) fetch(ctx context.Context, symbols []string) (string, []redisStorage.Quote, error) {
+	var errs []string
+	for _, p := range f.cfg.Providers {
+		if !f.available(p.Name()) {
+			errs = append(errs, p.Name()+": unhealthy")
+			continue
+		}
+		fetchCtx, cancel := context.WithTimeout(ctx, f.cfg.Timeout)
+		quotes, err := p.Fetch(fetchCtx, symbols)
+		cancel()
+		if err == nil && len(quotes) == 0 {
+			err = fmt.Errorf("no quotes")
+		}
+		if err != nil {
+			f.recordFailure(p.Name(), err)
+			errs = append(errs, fmt.Sprintf("%s: %v", p.Name(), err))
+			continue
+		}
+		f.recordSuccess(p.Name())
+		return p.Name(), quotes, nil
+	}
+	return "", nil, fmt.Errorf("no provider returned quotes (%v)", errs)
+}
+
+func (f *Feed) available(name string) bool {
+	f.healthMutex.Lock()
+	defer f.healthMutex.Unlock()
+	h := f.health[name]
+	return h.failures < f.cfg.MaxFailures || !time.Now().Before(h.retryAt)
+}
+
+func (f *Feed) recordFailure(name string, err error) {
+	f.healthMutex.Lock()
+	defer f.healthMutex.Unlock()
+	h := f.health[name]
+	h.failures++
+	h.lastError = err.Error()
+	if h.failures >= f.cfg.MaxFailures {
+		h.retryAt = time.Now().Add(f.cfg.Cooldown)
+		log.Printf("⚠️ Market data provider %s is unhealthy after %d failures: %v", name, h.failures, err)
+	}
+}
+
+func (f *Feed) recordSuccess(name string) {
+	f.healthMutex.Lock()
+	defer f.healthMutex.Unlock()
+	h := f.health[name]
+	if h.failures >= f.cfg.MaxFailures {
+		log.Printf("✅ Market data provider %s recovered", name)
+	}
+	h.failures = 0
+	h.lastError = ""
+	h.lastSuccess = time.Now()
+	h.retryAt = time.Time{}
+}
+
+// Health reports every provider, in fallback order.
+func (f *Feed) Health() []Health {
+	f.healthMutex.Lock()
+	defer f.healthMutex.Unlock()
+	report := make([]Health, 0, len(f.cfg.Providers))
+	for _, p := range f.cfg.Providers {
+		h := f.health[p.Name()]
+		entry := Health{
+			Provider:  p.Name(),
+			Healthy:   h.failures < f.cfg.MaxFailures,
+			Failures:  h.failures,
+			LastError: h.lastError,
+		}
+		if !h.lastSuccess.IsZero() {
+			entry.LastSuccess = h.lastSuccess.UTC().Format(time.RFC3339)
+		}
+		if !entry.Healthy {
+			entry.RetryAt = h.retryAt.UTC().Format(time.RFC3339)
+		}
+		report = append(report, entry)
+	}
+	return report
+}
@@ -0,0 +1,112 @@
+package marketdata
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	redisStorage "trading-service/redis"
+)
+
+// stubProvider fails while failing is set and counts its fetches.
+type stubProvider struct {
+	name    string
+	failing bool
+	fetches int
+}
+
+func (p *stubProvider) Name() string {
+	return p.name
+}
+
+func (p *stubProvider) Fetch(ctx context.Context, symbols []string) ([]redisStorage.Quote, error) {
+	p.fetches++
+	if p.failing {
+		return nil, fmt.Errorf("%s is down", p.name)
+	}
+	return []redisStorage.Quote{{Symbol: "AAPL"}}, nil
+}
+
+func fetchFrom(t *testing.T, feed *Feed) string {
+	t.Helper()
+	name, _, err := feed.fetch(context.Background(), []string{"AAPL"})
+	if err != nil {
+		return "none"
+	}
+	return name
+}
+
+// The first healthy provider wins; a provider that keeps failing is skipped
+// until its cooldown has passed and is healthy again once it answers.
+func TestFeedFallsBackInOrder(t *testing.T) {
+	primary := &stubProvider{name: "primary"}
+	backup := &stubProvider{name: "backup"}
+	feed, err := NewFeed(FeedConfig{Providers: []Provider{primary, backup}, MaxFailures: 2, Cooldown: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fetchFrom(t, feed); got != "primary" {
+		t.Fatalf("quotes from %s, want primary", got)
+	}
+	if backup.fetches != 0 {
+		t.Fatal("the backup was asked while the primary answered")
+	}
+
+	primary.failing = true
+	for i := 0; i < 2; i++ {
+		if got := fetchFrom(t, feed); got != "backup" {
+			t.Fatalf("quotes from %s, want backup", got)
+		}
+	}
+	health := feed.Health()
+	if health[0].Provider != "primary" || health[0].Healthy || health[0].Failures != 2 || health[0].RetryAt == "" {
+		t.Fatalf("primary health %+v, want unhealthy after 2 failures", health[0])
+	}
+	if !health[1].Healthy || health[1].LastSuccess == "" {
+		t.Fatalf("backup health %+v", health[1])
+	}
+
+	// skipped during the cooldown
+	fetchFrom(t, feed)
+	if primary.fetches != 3 {
+		t.Fatalf("primary fetched %d times, want it skipped while cooling down", primary.fetches)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	primary.failing = false
+	if got := fetchFrom(t, feed); got != "primary" {
+		t.Fatalf("quotes from %s after the cooldown, want primary", got)
+	}
+	if h := feed.Health()[0]; !h.Healthy || h.Failures != 0 || h.LastError != "" {
+		t.Fatalf("primary health %+v, want recovered", h)
+	}
+
+	primary.failing, backup.failing = true, true
+	if got := fetchFrom(t, feed); got != "none" {
+		t.Fatalf("quotes from %s with every provider down", got)
+	}
+}
+
+// A provider with nothing to quote counts as failing.
+func TestFeedTreatsEmptyQuotesAsFailure(t *testing.T) {
+	empty := &emptyProvider{}
+	feed, _ := NewFeed(FeedConfig{Providers: []Provider{empty}})
+	if got := fetchFrom(t, feed); got != "none" {
+		t.Fatalf("quotes from %s", got)
+	}
+	if h := feed.Health()[0]; h.Failures != 1 || h.LastError != "no quotes" {
+		t.Fatalf("health %+v, want one failure", h)
+	}
+}
+
+type emptyProvider struct{}
+
+func (emptyProvider) Name() string {
+	return "empty"
+}
+
+func (emptyProvider) Fetch(ctx context.Context, symbols []string) ([]redisStorage.Quote, error) {
+	return nil, nil
+}
@@ -0,0 +1,91 @@
+package marketdata
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"trading-service/pkg/money"
+	redisStorage "trading-service/redis"
+)
+
+// HTTPProvider fetches quotes from a JSON quote API. The URL may contain
+// {symbols}, which is replaced by the comma-separated symbol list, e.g.
+// https://financialmodelingprep.com/api/v3/quote/{symbols}?apikey=KEY.
+// The response is an array of objects with symbol and price or last, and
+// optionally bid, ask and timestamp (unix seconds). Missing bid or ask fall
+// back to the last price and a missing timestamp to the time of the fetch.
+type HTTPProvider struct {
+	name   string
+	url    string
+	client *http.Client
+}
+
+func NewHTTPProvider(name, url string) *HTTPProvider {
+	return &HTTPProvider{name: name, url: url, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (p *HTTPProvider) Name() string {
+	return p.name
+}
+
+type httpQuote struct {
+	Symbol    string      `json:"symbol"`
+	Price     money.Money `json:"price"`
+	Last      money.Money `json:"last"`
+	Bid       money.Money `json:"bid"`
+	Ask       money.Money `json:"ask"`
+	Timestamp int64       `json:"timestamp"`
+}
+
+func (p *HTTPProvider) Fetch(ctx context.Context, symbols []string) ([]redisStorage.Quote, error) {
+	if len(symbols) == 0 && strings.Contains(p.url, "{symbols}") {
+		return nil, fmt.Errorf("no symbols to quote")
+	}
+	url := strings.ReplaceAll(p.url, "{symbols}", strings.Join(symbols, ","))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("quote API returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var rows []httpQuote
+	if err := json.NewDecoder(resp.Body).Decode(&rows); err != nil {
+		return nil, fmt.Errorf("invalid quote response: %v", err)
+	}
+
+	now := time.Now()
+	quotes := make([]redisStorage.Quote, 0, len(rows))
+	for _, row := range rows {
+		last := row.Last
+		if last == 0 {
+			last = row.Price
+		}
+		if row.Symbol == "" || last <= 0 {
+			continue
+		}
+		q := redisStorage.Quote{Symbol: row.Symbol, Bid: row.Bid, Ask: row.Ask, Last: last, UpdatedAt: now}
+		if q.Bid <= 0 {
+			q.Bid = last
+		}
+		if q.Ask <= 0 {
+			q.Ask = last
+		}
+		if row.Timestamp > 0 {
+			q.UpdatedAt = time.Unix(row.Timestamp, 0)
+		}
+		quotes = append(quotes, q)
+	}
+	return quotes, nil
+}
@@ -0,0 +1,73 @@
+package marketdata
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPProviderFetch(t *testing.T) {
+	var path string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		w.Write([]byte(`[
+			{"symbol": "AAPL", "price": 101.5, "bid": 101.4, "ask": 101.6, "timestamp": 1700000000},
+			{"symbol": "MSFT", "last": "300.25"},
+			{"symbol": "BAD", "price": 0},
+			{"price": 5}
+		]`))
+	}))
+	defer server.Close()
+
+	before := time.Now()
+	quotes, err := NewHTTPProvider("api", server.URL+"/quote/{symbols}").Fetch(context.Background(), []string{"AAPL", "MSFT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != "/quote/AAPL,MSFT" {
+		t.Fatalf("requested %s, want the symbols in the path", path)
+	}
+	if len(quotes) != 2 {
+		t.Fatalf("got %d quotes, want rows without a symbol or price skipped: %+v", len(quotes), quotes)
+	}
+	aapl, msft := quotes[0], quotes[1]
+	if aapl.Last.String() != "101.50" || aapl.Bid.String() != "101.40" || aapl.Ask.String() != "101.60" {
+		t.Fatalf("AAPL quoted %s/%s/%s", aapl.Bid, aapl.Ask, aapl.Last)
+	}
+	if !aapl.UpdatedAt.Equal(time.Unix(1700000000, 0)) {
+		t.Fatalf("AAPL stamped %s, want the timestamp from the response", aapl.UpdatedAt)
+	}
+	// bid, ask and time fall back to the last price and the fetch time
+	if msft.Last.String() != "300.25" || msft.Bid != msft.Last || msft.Ask != msft.Last {
+		t.Fatalf("MSFT quoted %s/%s/%s", msft.Bid, msft.Ask, msft.Last)
+	}
+	if msft.UpdatedAt.Before(before) {
+		t.Fatalf("MSFT stamped %s, want the fetch time", msft.UpdatedAt)
+	}
+}
+
+func TestHTTPProviderErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("broken") != "" {
+			w.Write([]byte(`{"not": "an array"}`))
+			return
+		}
+		http.Error(w, "rate limited", http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+	ctx := context.Background()
+
+	_, err := NewHTTPProvider("api", server.URL).Fetch(ctx, []string{"AAPL"})
+	if err == nil || !strings.Contains(err.Error(), "429") || !strings.Contains(err.Error(), "rate limited") {
+		t.Fatalf("got %v, want the status and body", err)
+	}
+	if _, err := NewHTTPProvider("api", server.URL+"?broken=1").Fetch(ctx, []string{"AAPL"}); err == nil {
+		t.Fatal("accepted a response that is not an array")
+	}
+	if _, err := NewHTTPProvider("api", server.URL+"/{symbols}").Fetch(ctx, nil); err == nil {
+		t.Fatal("fetched a per-symbol URL without symbols")
+	}
+}
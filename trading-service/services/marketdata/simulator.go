@@ -0,0 +1,126 @@
+package marketdata
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"trading-service/pkg/money"
+	redisStorage "trading-service/redis"
+)
+
+// year is the unit drift, volatility and jump rate are quoted in.
+const year = 365 * 24 * time.Hour
+
+// SimulatorConfig describes a synthetic market. Drift, Volatility and
+// JumpRate are annual figures; Step is how much market time one tick
+// covers, so a Step longer than the feed interval runs the market fast.
+type SimulatorConfig struct {
+	Seed int64
+	// StartPrices are the symbols and their first prices.
+	StartPrices map[string]money.Money
+	Drift       float64
+	Volatility  float64
+	// Correlation of every pair of symbols' moves, from 0 to 1: each
+	// move is this share of a common market move and the rest its own.
+	Correlation float64
+	// JumpRate is the expected number of jumps per symbol per year; a
+	// jump moves the log price by a normal with JumpMean and JumpStdDev.
+	JumpRate   float64
+	JumpMean   float64
+	JumpStdDev float64
+	// SpreadBps is the bid/ask spread around the last price.
+	SpreadBps float64
+	Step      time.Duration
+	// Start is the market time before the first tick; zero means when the
+	// simulator is created.
+	Start time.Time
+}
+
+// Simulator is a Provider of geometric Brownian motion prices with jumps.
+// Every Fetch advances the market one tick, and quotes are stamped with the
+// market clock, Start plus Step per tick. The same config and seed give the
+// same sequence of prices and times.
+type Simulator struct {
+	cfg     SimulatorConfig
+	symbols []string // sorted, so random draws are made in a fixed order
+
+	mutex  sync.Mutex
+	rng    *rand.Rand
+	prices map[string]float64
+	ticks  int64
+}
+
+func NewSimulator(cfg SimulatorConfig) *Simulator {
+	if cfg.Start.IsZero() {
+		cfg.Start = time.Now()
+	}
+	s := &Simulator{
+		cfg:    cfg,
+		rng:    rand.New(rand.NewSource(cfg.Seed)),
+		prices: make(map[string]float64, len(cfg.StartPrices)),
+	}
+	for symbol, price := range cfg.StartPrices {
+		s.symbols = append(s.symbols, symbol)
+		s.prices[symbol] = price.Float64()
+	}
+	sort.Strings(s.symbols)
+	return s
+}
+
+func (s *Simulator) Name() string {
+	return "simulator"
+}
+
+// Fetch advances every symbol one tick; symbols is ignored.
+func (s *Simulator) Fetch(ctx context.Context, symbols []string) ([]redisStorage.Quote, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.tick()
+	s.ticks++
+
+	now := s.cfg.Start.Add(time.Duration(s.ticks) * s.cfg.Step)
+	halfSpread := s.cfg.SpreadBps / 20000
+	quotes := make([]redisStorage.Quote, 0, len(s.symbols))
+	for _, symbol := range s.symbols {
+		price := s.prices[symbol]
+		quotes = append(quotes, redisStorage.Quote{
+			Symbol:    symbol,
+			Bid:       money.FromFloat(price * (1 - halfSpread)),
+			Ask:       money.FromFloat(price * (1 + halfSpread)),
+			Last:      money.FromFloat(price),
+			UpdatedAt: now,
+		})
+	}
+	return quotes, nil
+}
+
+// tick moves every price by
+//
+//	exp((drift - volatility²/2)·dt + volatility·√dt·z + jump)
+//
+// where z mixes a market-wide and a per-symbol standard normal.
+func (s *Simulator) tick() {
+	dt := s.cfg.Step.Hours() / year.Hours()
+	sigma := s.cfg.Volatility
+	drift := (s.cfg.Drift - sigma*sigma/2) * dt
+	market := s.rng.NormFloat64()
+	common, own := math.Sqrt(s.cfg.Correlation), math.Sqrt(1-s.cfg.Correlation)
+	jumpChance := s.cfg.JumpRate * dt
+
+	for _, symbol := range s.symbols {
+		z := common*market + own*s.rng.NormFloat64()
+		move := drift + sigma*math.Sqrt(dt)*z
+		// draw both every tick, so whether one symbol jumps does not change
+		// the draws of the symbols after it
+		jumped, size := s.rng.Float64() < jumpChance, s.cfg.JumpMean+s.cfg.JumpStdDev*s.rng.NormFloat64()
+		if jumped {
+			move += size
+		}
+		// a price never rounds down to nothing
+		s.prices[symbol] = math.Max(s.prices[symbol]*math.Exp(move), 0.01)
+	}
+}
@@ -0,0 +1,54 @@
+package marketdata
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"trading-service/pkg/money"
+)
+
+func simulate(t *testing.T, cfg SimulatorConfig, ticks int) []string {
+	t.Helper()
+	sim := NewSimulator(cfg)
+	var out []string
+	for i := 0; i < ticks; i++ {
+		quotes, err := sim.Fetch(context.Background(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, q := range quotes {
+			out = append(out, fmt.Sprintf("%s %s %s", q.UpdatedAt.Format(time.RFC3339), q.Symbol, q.Last))
+		}
+	}
+	return out
+}
+
+// A seed and start time repeat a run exactly, and quotes are stamped with
+// the market clock rather than the wall clock.
+func TestSimulatorIsRepeatable(t *testing.T) {
+	cfg := SimulatorConfig{
+		Seed:        7,
+		StartPrices: map[string]money.Money{"AAPL": money.FromFloat(190), "MSFT": money.FromFloat(400)},
+		Volatility:  0.3,
+		Correlation: 0.5,
+		JumpRate:    4,
+		JumpStdDev:  0.05,
+		Step:        time.Hour,
+		Start:       time.Date(2024, 1, 2, 9, 30, 0, 0, time.UTC),
+	}
+	first, second := simulate(t, cfg, 3), simulate(t, cfg, 3)
+	if fmt.Sprint(first) != fmt.Sprint(second) {
+		t.Fatalf("runs differ:\n%v\n%v", first, second)
+	}
+	for i, want := range []string{"2024-01-02T10:30:00Z", "2024-01-02T11:30:00Z", "2024-01-02T12:30:00Z"} {
+		if got := first[2*i][:len(want)]; got != want {
+			t.Fatalf("tick %d stamped %s, want %s", i+1, got, want)
+		}
+	}
+	cfg.Seed = 8
+	if other := simulate(t, cfg, 3); fmt.Sprint(other) == fmt.Sprint(first) {
+		t.Fatal("a different seed gave the same prices")
+	}
+}
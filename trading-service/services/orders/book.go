@@ -0,0 +1,174 @@
+package orders
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"trading-service/pkg/money"
+	redisStorage "trading-service/redis"
+	trade_service "trading-service/services/trade"
+)
+
+// symbolBook keeps the resting limit orders for one symbol in price-time
+// priority: best limit first, oldest first within a price level.
+type symbolBook struct {
+	buys  []Order // highest limit first
+	sells []Order // lowest limit first
+}
+
+var (
+	books     = make(map[string]*symbolBook)
+	bookMutex sync.Mutex
+	dispatch  func(trade_service.TradeRequest)
+
+	// crossed and triggered orders waiting to be passed to dispatch, and
+	// other work price listeners leave to runHandoff
+	handoffMutex sync.Mutex
+	handoff      []func()
+	handoffReady = make(chan struct{}, 1)
+)
+
+// StartBook reloads OPEN limit orders from Postgres and starts matching them
+// against price updates. fill receives each crossed order as a trade request
+// ready for the regular trade job queue; it may block.
+func StartBook(fill func(trade_service.TradeRequest)) {
+	dispatch = fill
+	go runHandoff()
+
+	open, err := LoadOpen(context.Background(), "LIMIT")
+	if err != nil {
+		log.Printf("❌ Failed to load open limit orders: %v", err)
+	}
+	for _, o := range open {
+		Rest(o)
+	}
+	redisStorage.OnPriceUpdate(onPrice)
+	log.Printf("✅ Limit order book ready with %d resting orders", len(open))
+}
+
+// Rest adds a limit order to its symbol's book and fills it straight away if
+// the cached price already crosses the limit.
+func Rest(o Order) {
+	bookMutex.Lock()
+	book, ok := books[o.Symbol]
+	if !ok {
+		book = &symbolBook{}
+		books[o.Symbol] = book
+	}
+	if o.TradeType == "SELL" {
+		i := 0
+		for i < len(book.sells) && book.sells[i].Price <= o.Price {
+			i++
+		}
+		book.sells = append(book.sells[:i], append([]Order{o}, book.sells[i:]...)...)
+	} else {
+		i := 0
+		for i < len(book.buys) && book.buys[i].Price >= o.Price {
+			i++
+		}
+		book.buys = append(book.buys[:i], append([]Order{o}, book.buys[i:]...)...)
+	}
+	bookMutex.Unlock()
+
+	if price, err := redisStorage.GetStockPrice(o.Symbol); err == nil {
+		onPrice(o.Symbol, price)
+	}
+}
+
+// Crosses reports whether a limit order may execute at price.
+func Crosses(tradeType string, limit money.Money, price money.Money) bool {
+	if tradeType == "SELL" {
+		return price >= limit
+	}
+	return price <= limit
+}
+
+func onPrice(symbol string, price money.Money) {
+	bookMutex.Lock()
+	book, ok := books[symbol]
+	var filled []Order
+	if ok {
+		n := 0
+		for n < len(book.buys) && Crosses("BUY", book.buys[n].Price, price) {
+			n++
+		}
+		filled = append(filled, book.buys[:n]...)
+		book.buys = book.buys[n:]
+
+		n = 0
+		for n < len(book.sells) && Crosses("SELL", book.sells[n].Price, price) {
+			n++
+		}
+		filled = append(filled, book.sells[:n]...)
+		book.sells = book.sells[n:]
+	}
+	// track before releasing the book lock so a cancel never finds the
+	// order in neither place
+	for _, o := range filled {
+		Track(o)
+	}
+	bookMutex.Unlock()
+
+	for _, o := range filled {
+		if dispatch == nil {
+			log.Printf("❌ Limit order %d crossed before the book was started", o.ID)
+			continue
+		}
+		send(o.ToTrade())
+	}
+}
+
+// send queues trade for dispatch without waiting. Price listeners run on
+// whichever goroutine cached the price, trade workers included, and hold
+// the price cache's listener lock, so blocking here on a full trade job
+// queue could leave no worker to drain it.
+func send(trade trade_service.TradeRequest) {
+	later(func() { dispatch(trade) })
+}
+
+// later queues fn to run on the handoff goroutine, after everything queued
+// before it. Price listeners use it for anything that may block.
+func later(fn func()) {
+	handoffMutex.Lock()
+	handoff = append(handoff, fn)
+	handoffMutex.Unlock()
+	select {
+	case handoffReady <- struct{}{}:
+	default:
+	}
+}
+
+// runHandoff runs the queued work one item at a time, in order.
+func runHandoff() {
+	for range handoffReady {
+		for {
+			handoffMutex.Lock()
+			if len(handoff) == 0 {
+				handoffMutex.Unlock()
+				break
+			}
+			fn := handoff[0]
+			handoff = handoff[1:]
+			handoffMutex.Unlock()
+			fn()
+		}
+	}
+}
+
+// unrest removes a resting order from the book.
+func unrest(id int) (Order, bool) {
+	bookMutex.Lock()
+	defer bookMutex.Unlock()
+	for _, book := range books {
+		for _, side := range []*[]Order{&book.buys, &book.sells} {
+			for i, o := range *side {
+				if o.ID == id {
+					*side = append((*side)[:i], (*side)[i+1:]...)
+					return o, true
+				}
+			}
+		}
+	}
+	return Order{}, false
+}
@@ -0,0 +1,108 @@
+package orders
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"trading-service/pkg/redisClient"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Clients retry POST /api/trade on timeouts, so a request may carry an
+// Idempotency-Key. Keys are scoped to the user and remembered for a day:
+//
+//	idempotency:<user_id>:<key>           the original response, or pending
+//	idempotency_consumed:<user_id>:<key>  set once the trade reached Postgres
+const idempotencyTTL = 24 * time.Hour
+
+// pendingResult marks a key whose first request is still being handled.
+const pendingResult = "pending"
+
+// ErrIdempotencyPending is returned for a retry that arrives before the
+// first request with the same key has finished.
+var ErrIdempotencyPending = errors.New("a request with this idempotency key is still in progress")
+
+func idempotencyKey(userID int, key string) string {
+	return fmt.Sprintf("idempotency:%d:%s", userID, key)
+}
+
+func consumedKey(userID int, key string) string {
+	return fmt.Sprintf("idempotency_consumed:%d:%s", userID, key)
+}
+
+// Reserve claims key for a new request. If the key was already used it
+// returns the stored response of the first request instead, or
+// ErrIdempotencyPending if that request has not finished yet.
+func Reserve(ctx context.Context, userID int, key string) (json.RawMessage, bool, error) {
+	ok, err := redisClient.Client.SetNX(ctx, idempotencyKey(userID, key), pendingResult, idempotencyTTL).Result()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to reserve idempotency key: %v", err)
+	}
+	if ok {
+		return nil, true, nil
+	}
+	stored, err := redisClient.Client.Get(ctx, idempotencyKey(userID, key)).Result()
+	if err == redis.Nil {
+		// expired between the two calls, so treat it as unused
+		return Reserve(ctx, userID, key)
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read idempotency key: %v", err)
+	}
+	if stored == pendingResult {
+		return nil, false, ErrIdempotencyPending
+	}
+	return json.RawMessage(stored), false, nil
+}
+
+// Remember stores the response a reserved key should replay.
+func Remember(ctx context.Context, userID int, key string, result interface{}) {
+	payload, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("❌ Failed to serialize idempotent result: %v", err)
+		return
+	}
+	if err := redisClient.Client.Set(ctx, idempotencyKey(userID, key), payload, redis.KeepTTL).Err(); err != nil {
+		log.Printf("❌ Failed to store idempotent result: %v", err)
+	}
+}
+
+// Release frees a reserved key after a request failed before creating
+// anything, so the client can retry with it.
+func Release(ctx context.Context, userID int, key string) {
+	if err := redisClient.Client.Del(ctx, idempotencyKey(userID, key)).Err(); err != nil {
+		log.Printf("❌ Failed to release idempotency key: %v", err)
+	}
+}
+
+// Consumed reports whether a trade with this key was already persisted.
+func Consumed(ctx context.Context, userID int, key string) bool {
+	n, err := redisClient.Client.Exists(ctx, consumedKey(userID, key)).Result()
+	if err != nil {
+		log.Printf("⚠️ Failed to check idempotency key: %v", err)
+		return false
+	}
+	return n > 0
+}
+
+// MarkConsumed records persisted trades so later replays are dropped.
+// keys maps user ids to the idempotency keys they persisted.
+func MarkConsumed(ctx context.Context, keys map[int][]string) {
+	if len(keys) == 0 {
+		return
+	}
+	pipe := redisClient.Client.Pipeline()
+	for userID, userKeys := range keys {
+		for _, key := range userKeys {
+			pipe.Set(ctx, consumedKey(userID, key), 1, idempotencyTTL)
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		log.Printf("❌ Failed to mark idempotency keys consumed: %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+package orders
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"trading-service/pkg/redisClient"
+)
+
+// Lifecycle stages, in the order an accepted order moves through them.
+const (
+	StageAccepted  = "ACCEPTED"  // persisted and handed to the book, triggers or TradeJobQueue
+	StageRejected  = "REJECTED"  // refused by a trade worker, see Reason
+	StageFilled    = "FILLED"    // executed in Redis and appended to buy_stream
+	StagePublished = "PUBLISHED" // forwarded from buy_stream to trade_events
+	StagePersisted = "PERSISTED" // committed to Postgres
+)
+
+// Rejection reason codes.
+const (
+	ReasonInvalidQuantity    = "INVALID_QUANTITY"
+	ReasonInvalidOrder       = "INVALID_ORDER"
+	ReasonUnknownUser        = "UNKNOWN_USER"
+	ReasonPriceUnavailable   = "PRICE_UNAVAILABLE"
+	ReasonStalePrice         = "STALE_PRICE"
+	ReasonInsufficientFunds  = "INSUFFICIENT_FUNDS"
+	ReasonInsufficientShares = "INSUFFICIENT_SHARES"
+	ReasonExecutionFailed    = "EXECUTION_FAILED"
+)
+
+// lifecycle records are kept for a week after their last update
+const lifecycleTTL = 7 * 24 * time.Hour
+
+// Lifecycle is the pipeline view of an order, as returned by
+// GET /api/orders/{id}.
+type Lifecycle struct {
+	Stage        string `json:"stage"`
+	Reason       string `json:"reason,omitempty"`
+	AcceptedAt   string `json:"accepted_at,omitempty"`
+	RejectedAt   string `json:"rejected_at,omitempty"`
+	FilledAt     string `json:"filled_at,omitempty"`
+	PublishedAt  string `json:"published_at,omitempty"`
+	PersistedAt  string `json:"persisted_at,omitempty"`
+	PersistError string `json:"persist_error,omitempty"`
+}
+
+func lifecycleKey(id int) string {
+	return fmt.Sprintf("order_lifecycle:%d", id)
+}
+
+// Record marks an order as having reached stage. reason is only stored for
+// rejections.
+func Record(ctx context.Context, id int, stage string, reason string) {
+	if id == 0 {
+		return
+	}
+	fields := map[string]interface{}{
+		"stage":                        stage,
+		strings.ToLower(stage) + "_at": time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	if reason != "" {
+		fields["reason"] = reason
+	}
+	pipeline := redisClient.Client.Pipeline()
+	pipeline.HSet(ctx, lifecycleKey(id), fields)
+	pipeline.Expire(ctx, lifecycleKey(id), lifecycleTTL)
+	if _, err := pipeline.Exec(ctx); err != nil {
+		log.Printf("❌ Failed to record %s for order %d: %v", stage, id, err)
+	}
+}
+
+// RecordBatch marks every order in ids as having reached stage in a single
+// round trip. A non-nil persistErr is stored instead of advancing the stage.
+func RecordBatch(ctx context.Context, ids []int, stage string, persistErr error) {
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+	pipeline := redisClient.Client.Pipeline()
+	queued := 0
+	for _, id := range ids {
+		if id == 0 {
+			continue
+		}
+		if persistErr != nil {
+			pipeline.HSet(ctx, lifecycleKey(id), "persist_error", persistErr.Error())
+		} else {
+			pipeline.HSet(ctx, lifecycleKey(id), "stage", stage, strings.ToLower(stage)+"_at", now)
+		}
+		pipeline.Expire(ctx, lifecycleKey(id), lifecycleTTL)
+		queued++
+	}
+	if queued == 0 {
+		return
+	}
+	if _, err := pipeline.Exec(ctx); err != nil {
+		log.Printf("❌ Failed to record %s for %d orders: %v", stage, queued, err)
+	}
+}
+
+// GetLifecycle reads the pipeline view of an order.
+func GetLifecycle(ctx context.Context, id int) (Lifecycle, error) {
+	fields, err := redisClient.Client.HGetAll(ctx, lifecycleKey(id)).Result()
+	if err != nil {
+		return Lifecycle{}, err
+	}
+	return Lifecycle{
+		Stage:        fields["stage"],
+		Reason:       fields["reason"],
+		AcceptedAt:   fields["accepted_at"],
+		RejectedAt:   fields["rejected_at"],
+		FilledAt:     fields["filled_at"],
+		PublishedAt:  fields["published_at"],
+		PersistedAt:  fields["persisted_at"],
+		PersistError: fields["persist_error"],
+	}, nil
+}
@@ -0,0 +1,141 @@
+package orders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"trading-service/pkg/money"
+	"trading-service/pkg/shares"
+)
+
+var (
+	ErrFilled    = errors.New("order is already filled")
+	ErrNotOpen   = errors.New("order is no longer open")
+	ErrExecuting = errors.New("order is already executing")
+	ErrInvalid   = errors.New("invalid amendment")
+)
+
+// queued holds orders sitting in the trade job queue. A worker claims an
+// order before executing it, so anything still here can be canceled.
+var (
+	queued      = make(map[int]Order)
+	queuedMutex sync.Mutex
+)
+
+// Amendment lists the fields PATCH /api/orders/{id} may change.
+type Amendment struct {
+	Quantity   *shares.Quantity `json:"quantity"`
+	LimitPrice *money.Money     `json:"limit_price"`
+	StopPrice  *money.Money     `json:"stop_price"`
+}
+
+type location int
+
+const (
+	inQueue location = iota
+	inBook
+	inTriggers
+)
+
+// Track records an order that has been handed to the trade job queue.
+func Track(o Order) {
+	queuedMutex.Lock()
+	queued[o.ID] = o
+	queuedMutex.Unlock()
+}
+
+// Claim takes a queued order for execution and returns its current,
+// possibly amended, state. It returns false if the order was canceled.
+func Claim(id int) (Order, bool) {
+	queuedMutex.Lock()
+	defer queuedMutex.Unlock()
+	o, ok := queued[id]
+	delete(queued, id)
+	return o, ok
+}
+
+// take removes a live order from wherever it is waiting.
+func take(id int) (Order, location, bool) {
+	if o, ok := Claim(id); ok {
+		return o, inQueue, true
+	}
+	if o, ok := unrest(id); ok {
+		return o, inBook, true
+	}
+	if o, ok := disarm(id); ok {
+		return o, inTriggers, true
+	}
+	return Order{}, 0, false
+}
+
+func put(o Order, where location) {
+	switch where {
+	case inQueue:
+		Track(o)
+	case inBook:
+		Rest(o)
+	case inTriggers:
+		Arm(o)
+	}
+}
+
+// notLive explains why an order could not be found waiting anywhere.
+func notLive(ctx context.Context, id int) error {
+	o, err := Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	switch o.Status {
+	case "FILLED":
+		return ErrFilled
+	case "OPEN":
+		return ErrExecuting
+	default:
+		return ErrNotOpen
+	}
+}
+
+// Cancel withdraws an order that is still queued, resting or armed.
+func Cancel(ctx context.Context, id int) (Order, error) {
+	o, where, ok := take(id)
+	if !ok {
+		return Order{}, notLive(ctx, id)
+	}
+	if err := SetStatus(ctx, id, "CANCELED"); err != nil {
+		put(o, where)
+		return Order{}, err
+	}
+	o.Status = "CANCELED"
+	return o, nil
+}
+
+// Amend changes the quantity or prices of an order that is still queued,
+// resting or armed. An amended limit order loses its time priority.
+func Amend(ctx context.Context, id int, a Amendment) (Order, error) {
+	o, where, ok := take(id)
+	if !ok {
+		return Order{}, notLive(ctx, id)
+	}
+	amended := o
+	if a.Quantity != nil {
+		amended.Quantity = *a.Quantity
+	}
+	if a.LimitPrice != nil {
+		amended.Price = *a.LimitPrice
+	}
+	if a.StopPrice != nil {
+		amended.StopPrice = *a.StopPrice
+	}
+	if err := Validate(amended.ToTrade()); err != nil {
+		put(o, where)
+		return Order{}, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if err := Update(ctx, amended); err != nil {
+		put(o, where)
+		return Order{}, err
+	}
+	put(amended, where)
+	return amended, nil
+}
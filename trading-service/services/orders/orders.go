@@ -0,0 +1,242 @@
+package orders
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"trading-service/db"
+	"trading-service/pkg/money"
+	"trading-service/pkg/shares"
+	trade_service "trading-service/services/trade"
+)
+
+var ErrNotFound = errors.New("order not found")
+
+const orderColumns = `id, user_id, symbol, order_type, trade_type, status, quantity, COALESCE(price, 0),
+	COALESCE(stop_price, 0), COALESCE(triggered_price, 0), triggered_at, COALESCE(idempotency_key, '')`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanOrder(row scanner) (Order, error) {
+	var o Order
+	err := row.Scan(&o.ID, &o.UserID, &o.Symbol, &o.OrderType, &o.TradeType, &o.Status, &o.Quantity, &o.Price,
+		&o.StopPrice, &o.TriggeredPrice, &o.TriggeredAt, &o.IdempotencyKey)
+	return o, err
+}
+
+// Order mirrors a row of the orders table.
+type Order struct {
+	ID        int             `json:"id"`
+	UserID    int             `json:"user_id"`
+	Symbol    string          `json:"symbol"`
+	OrderType string          `json:"order_type"`
+	TradeType string          `json:"trade_type"`
+	Status    string          `json:"status"`
+	Quantity  shares.Quantity `json:"quantity"`
+	Price     money.Money     `json:"price"`
+	StopPrice money.Money     `json:"stop_price,omitempty"`
+	// TriggeredPrice and TriggeredAt record the quote that fired a stop.
+	TriggeredPrice money.Money `json:"triggered_price,omitempty"`
+	TriggeredAt    *time.Time  `json:"triggered_at,omitempty"`
+	// IdempotencyKey is the client key the order was submitted with.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
+
+// Validate checks that a request carries the prices its order type needs.
+// Limit and stop orders rest on a single symbol, so they must have exactly
+// one leg; market trades may buy or sell several stocks at once, and are
+// placed as one order per stock, see Legs.
+func Validate(trade trade_service.TradeRequest) error {
+	orderType := trade.OrderTypeOrMarket()
+	if len(trade.Stock) == 0 {
+		return fmt.Errorf("a trade must contain at least one stock")
+	}
+	if orderType != "MARKET" && len(trade.Stock) != 1 {
+		return fmt.Errorf("%s orders must contain exactly one stock, got %d", orderType, len(trade.Stock))
+	}
+	for _, stock := range trade.Stock {
+		if err := shares.Validate(stock.Symbol, stock.Quantity); err != nil {
+			return err
+		}
+	}
+	switch orderType {
+	case "MARKET":
+	case "LIMIT":
+		if trade.LimitPrice <= 0 {
+			return fmt.Errorf("limit orders need a positive limit_price")
+		}
+	case "STOP_LOSS":
+		if trade.StopPrice <= 0 {
+			return fmt.Errorf("stop-loss orders need a positive stop_price")
+		}
+	case "STOP_LIMIT":
+		if trade.StopPrice <= 0 || trade.LimitPrice <= 0 {
+			return fmt.Errorf("stop-limit orders need a positive stop_price and limit_price")
+		}
+	default:
+		return fmt.Errorf("unsupported order type %q", trade.OrderType)
+	}
+	return nil
+}
+
+// Legs splits a market trade of several stocks into one single-leg trade per
+// stock, so that each is persisted, tracked and canceled as an order of its
+// own. Each leg gets the trade's idempotency key suffixed with its position
+// so the Kafka consumer does not drop the later legs as replays of the first.
+func Legs(trade trade_service.TradeRequest) []trade_service.TradeRequest {
+	if len(trade.Stock) <= 1 {
+		return []trade_service.TradeRequest{trade}
+	}
+	legs := make([]trade_service.TradeRequest, len(trade.Stock))
+	for i, stock := range trade.Stock {
+		leg := trade
+		leg.Stock = []trade_service.TradeStock{stock}
+		if trade.IdempotencyKey != "" {
+			leg.IdempotencyKey = fmt.Sprintf("%s#%d", trade.IdempotencyKey, i+1)
+		}
+		legs[i] = leg
+	}
+	return legs
+}
+
+// Create persists a validated single-leg trade as an OPEN order and returns
+// the new order id.
+func Create(ctx context.Context, trade trade_service.TradeRequest) (int, error) {
+	stock := trade.Stock[0]
+	var price, stopPrice interface{}
+	if trade.LimitPrice > 0 {
+		price = trade.LimitPrice
+	}
+	if trade.StopPrice > 0 {
+		stopPrice = trade.StopPrice
+	}
+	var id int
+	err := db.DB.QueryRowContext(ctx, `
+		INSERT INTO orders (user_id, symbol, order_type, trade_type, status, quantity, price, stop_price, idempotency_key)
+		VALUES ($1, $2, $3::order_type_enum, $4::trade_type_enum, 'OPEN', $5, $6, $7, NULLIF($8, ''))
+		RETURNING id`,
+		trade.UserID, stock.Symbol, trade.OrderTypeOrMarket(), trade_service.TradeType(trade.Action), stock.Quantity, price, stopPrice,
+		trade.IdempotencyKey,
+	).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to persist order: %v", err)
+	}
+	return id, nil
+}
+
+// SetStatus moves an order to one of order_status_enum.
+func SetStatus(ctx context.Context, id int, status string) error {
+	_, err := db.DB.ExecContext(ctx, `
+		UPDATE orders
+		SET status = $2::order_status_enum, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1`, id, status)
+	if err != nil {
+		return fmt.Errorf("failed to update order %d: %v", id, err)
+	}
+	return nil
+}
+
+// Get loads a single order by id.
+func Get(ctx context.Context, id int) (Order, error) {
+	o, err := scanOrder(db.DB.QueryRowContext(ctx, `
+		SELECT `+orderColumns+`
+		FROM orders
+		WHERE id = $1`, id))
+	if err == sql.ErrNoRows {
+		return o, ErrNotFound
+	}
+	return o, err
+}
+
+// Update rewrites the amendable fields of an OPEN order.
+func Update(ctx context.Context, o Order) error {
+	var price, stopPrice interface{}
+	if o.Price > 0 {
+		price = o.Price
+	}
+	if o.StopPrice > 0 {
+		stopPrice = o.StopPrice
+	}
+	_, err := db.DB.ExecContext(ctx, `
+		UPDATE orders
+		SET quantity = $2, price = $3, stop_price = $4, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND status = 'OPEN'`, o.ID, o.Quantity, price, stopPrice)
+	if err != nil {
+		return fmt.Errorf("failed to amend order %d: %v", o.ID, err)
+	}
+	return nil
+}
+
+// RecordTrigger stores the price that fired a stop order and when it fired.
+func RecordTrigger(ctx context.Context, id int, price money.Money) (time.Time, error) {
+	var at time.Time
+	err := db.DB.QueryRowContext(ctx, `
+		UPDATE orders
+		SET triggered_price = $2, triggered_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+		RETURNING triggered_at`, id, price).Scan(&at)
+	if err != nil {
+		return at, fmt.Errorf("failed to record trigger for order %d: %v", id, err)
+	}
+	return at, nil
+}
+
+// ToTrade rebuilds the trade request an order was created from.
+func (o Order) ToTrade() trade_service.TradeRequest {
+	trade := trade_service.TradeRequest{
+		UserID:     o.UserID,
+		Action:     o.TradeType,
+		OrderType:  o.OrderType,
+		LimitPrice: o.Price,
+		StopPrice:  o.StopPrice,
+		OrderID:    o.ID,
+		// carried so the Kafka consumer can drop replays of this order
+		IdempotencyKey: o.IdempotencyKey,
+	}
+	trade.Stock = append(trade.Stock, trade_service.TradeStock{Symbol: o.Symbol, Quantity: o.Quantity})
+	return trade
+}
+
+// FromTrade builds the order view of a single-leg trade request.
+func FromTrade(trade trade_service.TradeRequest) Order {
+	return Order{
+		ID:             trade.OrderID,
+		UserID:         trade.UserID,
+		Symbol:         trade.Stock[0].Symbol,
+		OrderType:      trade.OrderTypeOrMarket(),
+		TradeType:      trade_service.TradeType(trade.Action),
+		Status:         "OPEN",
+		Quantity:       trade.Stock[0].Quantity,
+		Price:          trade.LimitPrice,
+		StopPrice:      trade.StopPrice,
+		IdempotencyKey: trade.IdempotencyKey,
+	}
+}
+
+// LoadOpen returns every OPEN order of the given type, oldest first.
+func LoadOpen(ctx context.Context, orderType string) ([]Order, error) {
+	rows, err := db.DB.QueryContext(ctx, `
+		SELECT `+orderColumns+`
+		FROM orders
+		WHERE status = 'OPEN' AND order_type = $1::order_type_enum
+		ORDER BY id`, orderType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var open []Order
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			return nil, err
+		}
+		open = append(open, o)
+	}
+	return open, rows.Err()
+}
@@ -0,0 +1,104 @@
+package orders
+
+import (
+	"testing"
+	"time"
+
+	"trading-service/pkg/money"
+	"trading-service/pkg/shares"
+	trade_service "trading-service/services/trade"
+)
+
+func legs(symbols ...string) []trade_service.TradeStock {
+	stocks := make([]trade_service.TradeStock, len(symbols))
+	for i, symbol := range symbols {
+		stocks[i] = trade_service.TradeStock{Symbol: symbol, Quantity: shares.FromInt(1)}
+	}
+	return stocks
+}
+
+// Only resting orders are limited to one leg.
+func TestValidateLegs(t *testing.T) {
+	cases := []struct {
+		name  string
+		trade trade_service.TradeRequest
+		ok    bool
+	}{
+		{"market single leg", trade_service.TradeRequest{Stock: legs("AAPL")}, true},
+		{"market multi-leg", trade_service.TradeRequest{Stock: legs("AAPL", "MSFT")}, true},
+		{"no legs", trade_service.TradeRequest{}, false},
+		{"limit multi-leg", trade_service.TradeRequest{OrderType: "LIMIT", LimitPrice: money.Money(100), Stock: legs("AAPL", "MSFT")}, false},
+		{"stop multi-leg", trade_service.TradeRequest{OrderType: "STOP_LOSS", StopPrice: money.Money(100), Stock: legs("AAPL", "MSFT")}, false},
+		{"limit single leg", trade_service.TradeRequest{OrderType: "LIMIT", LimitPrice: money.Money(100), Stock: legs("AAPL")}, true},
+		{"market bad leg", trade_service.TradeRequest{Stock: append(legs("AAPL"), trade_service.TradeStock{Symbol: "MSFT"})}, false},
+	}
+	for _, c := range cases {
+		if err := Validate(c.trade); (err == nil) != c.ok {
+			t.Errorf("%s: Validate returned %v", c.name, err)
+		}
+	}
+}
+
+// A market trade of several stocks becomes one order per stock, each with
+// a key of its own.
+func TestLegs(t *testing.T) {
+	trade := trade_service.TradeRequest{UserID: 7, Action: "BUY", IdempotencyKey: "k", Stock: legs("AAPL", "MSFT")}
+	split := Legs(trade)
+	if len(split) != 2 {
+		t.Fatalf("got %d legs, want 2", len(split))
+	}
+	for i, want := range []struct{ symbol, key string }{{"AAPL", "k#1"}, {"MSFT", "k#2"}} {
+		leg := split[i]
+		if len(leg.Stock) != 1 || leg.Stock[0].Symbol != want.symbol || leg.IdempotencyKey != want.key || leg.UserID != 7 {
+			t.Errorf("leg %d is %+v, want %s with key %s", i, leg, want.symbol, want.key)
+		}
+	}
+	if single := Legs(trade_service.TradeRequest{IdempotencyKey: "k", Stock: legs("AAPL")}); len(single) != 1 || single[0].IdempotencyKey != "k" {
+		t.Errorf("single-leg trade split into %+v", single)
+	}
+}
+
+// A crossing price never waits for the trade job queue; crossed orders are
+// handed over in price-time order once it has room.
+func TestCrossedOrdersDoNotBlockPriceUpdates(t *testing.T) {
+	queue := make(chan trade_service.TradeRequest)
+	previous := dispatch
+	dispatch = func(trade trade_service.TradeRequest) { queue <- trade }
+	t.Cleanup(func() { dispatch = previous })
+	go runHandoff()
+
+	bookMutex.Lock()
+	books["TEST"] = &symbolBook{buys: []Order{
+		{ID: 1, Symbol: "TEST", OrderType: "LIMIT", TradeType: "BUY", Price: money.Money(500), Quantity: shares.FromInt(1)},
+		{ID: 2, Symbol: "TEST", OrderType: "LIMIT", TradeType: "BUY", Price: money.Money(400), Quantity: shares.FromInt(1)},
+	}}
+	bookMutex.Unlock()
+	t.Cleanup(func() {
+		bookMutex.Lock()
+		delete(books, "TEST")
+		bookMutex.Unlock()
+		Claim(1)
+		Claim(2)
+	})
+
+	done := make(chan struct{})
+	go func() {
+		onPrice("TEST", money.Money(300))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("onPrice blocked on a trade job queue with no room")
+	}
+	for _, want := range []int{1, 2} {
+		select {
+		case trade := <-queue:
+			if trade.OrderID != want {
+				t.Fatalf("dispatched order %d, want %d", trade.OrderID, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("order %d was never dispatched", want)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package orders
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"trading-service/pkg/money"
+	redisStorage "trading-service/redis"
+)
+
+// armed holds the untriggered STOP_LOSS and STOP_LIMIT orders per symbol.
+var (
+	armed      = make(map[string][]Order)
+	armedMutex sync.Mutex
+)
+
+// StartTriggers reloads open stop orders and starts watching prices for the
+// symbols they cover. Stop-limits that already fired before a restart go
+// straight back into the limit book. StartBook must run first so triggered
+// orders have somewhere to go.
+func StartTriggers() {
+	count := 0
+	for _, orderType := range []string{"STOP_LOSS", "STOP_LIMIT"} {
+		open, err := LoadOpen(context.Background(), orderType)
+		if err != nil {
+			log.Printf("❌ Failed to load open %s orders: %v", orderType, err)
+			continue
+		}
+		for _, o := range open {
+			if o.TriggeredAt != nil {
+				release(o)
+				continue
+			}
+			Arm(o)
+			count++
+		}
+	}
+	redisStorage.OnPriceUpdate(onStopPrice)
+	log.Printf("✅ Stop trigger engine ready with %d armed orders", count)
+}
+
+// Arm registers a stop order and fires it immediately if the cached price
+// is already through the stop.
+func Arm(o Order) {
+	armedMutex.Lock()
+	armed[o.Symbol] = append(armed[o.Symbol], o)
+	armedMutex.Unlock()
+
+	if price, err := redisStorage.GetStockPrice(o.Symbol); err == nil {
+		onStopPrice(o.Symbol, price)
+	}
+}
+
+// Triggered reports whether price has reached a stop: a sell stop fires as
+// the price falls to it, a buy stop as the price rises to it.
+func Triggered(tradeType string, stop money.Money, price money.Money) bool {
+	if tradeType == "SELL" {
+		return price <= stop
+	}
+	return price >= stop
+}
+
+func onStopPrice(symbol string, price money.Money) {
+	armedMutex.Lock()
+	var fired []Order
+	waiting := armed[symbol][:0]
+	for _, o := range armed[symbol] {
+		if Triggered(o.TradeType, o.StopPrice, price) {
+			fired = append(fired, o)
+		} else {
+			waiting = append(waiting, o)
+		}
+	}
+	if len(waiting) == 0 {
+		delete(armed, symbol)
+	} else {
+		armed[symbol] = waiting
+	}
+	// queued until the trigger is recorded, where a cancel still finds
+	// them; the listener must not wait on Postgres
+	for _, o := range fired {
+		Track(o)
+	}
+	armedMutex.Unlock()
+
+	for _, o := range fired {
+		id := o.ID
+		later(func() { fire(id, price) })
+	}
+}
+
+// fire records that a stop order triggered at price and releases it, unless
+// it was canceled in the meantime.
+func fire(id int, price money.Money) {
+	o, ok := Claim(id)
+	if !ok {
+		return
+	}
+	at, err := RecordTrigger(context.Background(), o.ID, price)
+	if err != nil {
+		log.Printf("❌ %v", err)
+	}
+	o.TriggeredPrice = price
+	o.TriggeredAt = &at
+	log.Printf("🔔 %s order %d for %s triggered at %s (stop %s)", o.OrderType, o.ID, o.Symbol, price, o.StopPrice)
+	release(o)
+}
+
+// release turns a triggered stop into the order it stands for: a stop-loss
+// becomes a market order, a stop-limit a resting limit order.
+func release(o Order) {
+	if o.OrderType == "STOP_LIMIT" {
+		o.OrderType = "LIMIT"
+		Rest(o)
+		return
+	}
+	o.OrderType = "MARKET"
+	if dispatch == nil {
+		log.Printf("❌ Stop order %d triggered before the book was started", o.ID)
+		return
+	}
+	Track(o)
+	send(o.ToTrade())
+}
+
+// disarm removes an untriggered stop order.
+func disarm(id int) (Order, bool) {
+	armedMutex.Lock()
+	defer armedMutex.Unlock()
+	for symbol, stops := range armed {
+		for i, o := range stops {
+			if o.ID == id {
+				armed[symbol] = append(stops[:i], stops[i+1:]...)
+				return o, true
+			}
+		}
+	}
+	return Order{}, false
+}
@@ -0,0 +1,566 @@
+package reconcile
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"trading-service/db"
+	"trading-service/pkg/money"
+	"trading-service/pkg/redisClient"
+	"trading-service/pkg/shares"
+
+	"github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis user_balance and positions:<id> are the hot copy of every account;
+// Postgres users.balance and positions catch up as the workers persist
+// buy_stream. The reconciler compares the two per user and, for each user
+// that differs, lists the buy_stream entries of theirs that have no trade in
+// Postgres. A difference explained only by entries younger than the settle
+// window is a trade in flight and is not reported.
+
+// Repair sources: the side that is copied over the other.
+const (
+	SourceRedis    = "redis"
+	SourcePostgres = "postgres"
+)
+
+var (
+	ErrUnknownUser   = errors.New("user not found")
+	ErrUnknownSource = fmt.Errorf("repair source must be %s or %s", SourceRedis, SourcePostgres)
+	// ErrTradesInFlight is returned when Postgres would be repaired from
+	// Redis while some of the user's trades are not written yet: they would
+	// be applied twice once they are.
+	ErrTradesInFlight = errors.New("user has trades not yet written to Postgres")
+)
+
+// streamBatch is how many buy_stream entries are read per XRANGE.
+const streamBatch = 5000
+
+type Position struct {
+	Quantity     shares.Quantity `json:"quantity"`
+	AveragePrice money.Money     `json:"average_price"`
+}
+
+// account is one user's balance and positions on one side.
+type account struct {
+	balance   money.Money
+	positions map[string]Position
+}
+
+// PositionDiff is a symbol whose position differs; a nil side holds none.
+type PositionDiff struct {
+	Symbol   string    `json:"symbol"`
+	Redis    *Position `json:"redis"`
+	Postgres *Position `json:"postgres"`
+}
+
+// Mismatch is a user whose Redis and Postgres state differ.
+type Mismatch struct {
+	UserID          int            `json:"user_id"`
+	Missing         string         `json:"missing,omitempty"` // the side without the user at all
+	RedisBalance    money.Money    `json:"redis_balance"`
+	PostgresBalance money.Money    `json:"postgres_balance"`
+	Positions       []PositionDiff `json:"positions,omitempty"`
+	// UnpersistedTrades are the user's buy_stream entry ids without a trade
+	// in Postgres, oldest first.
+	UnpersistedTrades []string `json:"unpersisted_trades,omitempty"`
+}
+
+type Report struct {
+	Users      int        `json:"users"`
+	InFlight   int        `json:"in_flight"` // users only behind by trades younger than the settle window
+	Mismatches []Mismatch `json:"mismatches"`
+	CheckedAt  string     `json:"checked_at"`
+}
+
+// parsePosition reads a positions:<id> field, "quantity,average_price".
+func parsePosition(value string) (Position, error) {
+	quantity, average, ok := strings.Cut(value, ",")
+	if !ok {
+		return Position{}, fmt.Errorf("invalid position %q", value)
+	}
+	q, err := shares.Parse(quantity)
+	if err != nil {
+		return Position{}, err
+	}
+	price, err := money.Parse(average)
+	if err != nil {
+		return Position{}, err
+	}
+	return Position{Quantity: q, AveragePrice: price}, nil
+}
+
+func redisAccounts(ctx context.Context) (map[int]*account, error) {
+	balances, err := redisClient.Client.HGetAll(ctx, "user_balance").Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read user_balance: %v", err)
+	}
+	accounts := make(map[int]*account, len(balances))
+	pipe := redisClient.Client.Pipeline()
+	cmds := make(map[int]*redis.MapStringStringCmd, len(balances))
+	for field, value := range balances {
+		userID, err := strconv.Atoi(field)
+		if err != nil {
+			continue
+		}
+		balance, err := money.Parse(value)
+		if err != nil {
+			log.Printf("⚠️ Unreadable Redis balance for user %d: %q", userID, value)
+		}
+		accounts[userID] = &account{balance: balance, positions: make(map[string]Position)}
+		cmds[userID] = pipe.HGetAll(ctx, fmt.Sprintf("positions:%d", userID))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to read positions: %v", err)
+	}
+	for userID, cmd := range cmds {
+		for symbol, value := range cmd.Val() {
+			position, err := parsePosition(value)
+			if err != nil {
+				log.Printf("⚠️ Unreadable Redis position %s for user %d: %v", symbol, userID, err)
+				continue
+			}
+			accounts[userID].positions[symbol] = position
+		}
+	}
+	return accounts, nil
+}
+
+func postgresAccounts(ctx context.Context) (map[int]*account, error) {
+	accounts := make(map[int]*account)
+	rows, err := db.DB.QueryContext(ctx, `SELECT id, balance FROM users`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read users: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID int
+		a := &account{positions: make(map[string]Position)}
+		if err := rows.Scan(&userID, &a.balance); err != nil {
+			return nil, err
+		}
+		accounts[userID] = a
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	positionRows, err := db.DB.QueryContext(ctx, `SELECT user_id, symbol, quantity, average_price FROM positions`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read positions: %v", err)
+	}
+	defer positionRows.Close()
+	for positionRows.Next() {
+		var userID int
+		var symbol string
+		var p Position
+		if err := positionRows.Scan(&userID, &symbol, &p.Quantity, &p.AveragePrice); err != nil {
+			return nil, err
+		}
+		if a, ok := accounts[userID]; ok {
+			a.positions[symbol] = p
+		}
+	}
+	return accounts, positionRows.Err()
+}
+
+// compare returns how user's accounts differ, or nil if they match.
+func compare(userID int, r, p *account) *Mismatch {
+	m := &Mismatch{UserID: userID}
+	switch {
+	case r == nil:
+		m.Missing = SourceRedis
+		m.PostgresBalance = p.balance
+		return m
+	case p == nil:
+		m.Missing = SourcePostgres
+		m.RedisBalance = r.balance
+		return m
+	}
+	m.RedisBalance, m.PostgresBalance = r.balance, p.balance
+	for symbol, rp := range r.positions {
+		rp := rp
+		if pp, ok := p.positions[symbol]; !ok || pp != rp {
+			diff := PositionDiff{Symbol: symbol, Redis: &rp}
+			if ok {
+				diff.Postgres = &pp
+			}
+			m.Positions = append(m.Positions, diff)
+		}
+	}
+	for symbol, pp := range p.positions {
+		pp := pp
+		if _, ok := r.positions[symbol]; !ok {
+			m.Positions = append(m.Positions, PositionDiff{Symbol: symbol, Postgres: &pp})
+		}
+	}
+	if m.RedisBalance == m.PostgresBalance && len(m.Positions) == 0 {
+		return nil
+	}
+	sort.Slice(m.Positions, func(i, j int) bool { return m.Positions[i].Symbol < m.Positions[j].Symbol })
+	return m
+}
+
+// streamTrades returns the buy_stream entry ids of each of users, oldest
+// first. Entries trimmed by retention are gone, so this only covers what is
+// still in the stream.
+func streamTrades(ctx context.Context, users map[int]bool) (map[int][]string, error) {
+	trades := make(map[int][]string)
+	start := "-"
+	for {
+		messages, err := redisClient.Client.XRangeN(ctx, "buy_stream", start, "+", streamBatch).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read buy_stream: %v", err)
+		}
+		for _, message := range messages {
+			value, _ := message.Values["user_id"].(string)
+			if userID, err := strconv.Atoi(value); err == nil && users[userID] {
+				trades[userID] = append(trades[userID], message.ID)
+			}
+		}
+		if len(messages) < streamBatch {
+			return trades, nil
+		}
+		start = "(" + messages[len(messages)-1].ID
+	}
+}
+
+// unacked returns the user's buy_stream entries some consumer group has not
+// acked: ones it has pending or has not read yet.
+func unacked(ctx context.Context, userID int) ([]string, error) {
+	groups, err := redisClient.Client.XInfoGroups(ctx, "buy_stream").Result()
+	if err != nil {
+		if strings.Contains(err.Error(), "no such key") {
+			return nil, nil
+		}
+		return nil, err
+	}
+	pending := make(map[string]bool)
+	for _, group := range groups {
+		start := "-"
+		for {
+			entries, err := redisClient.Client.XPendingExt(ctx, &redis.XPendingExtArgs{
+				Stream: "buy_stream",
+				Group:  group.Name,
+				Start:  start,
+				End:    "+",
+				Count:  streamBatch,
+			}).Result()
+			if err != nil {
+				return nil, fmt.Errorf("failed to read pending entries of %s: %v", group.Name, err)
+			}
+			for _, entry := range entries {
+				pending[entry.ID] = true
+			}
+			if len(entries) < streamBatch {
+				break
+			}
+			start = "(" + entries[len(entries)-1].ID
+		}
+	}
+	trades, err := streamTrades(ctx, map[int]bool{userID: true})
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, id := range trades[userID] {
+		unread := false
+		for _, group := range groups {
+			if streamIDAfter(id, group.LastDeliveredID) {
+				unread = true
+			}
+		}
+		if unread || pending[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// inFlight returns the user's buy_stream entries that may still be written
+// to Postgres: ones a consumer group has not acked, and ones with no trade
+// in Postgres. kafka_workers acks an entry once it is on trade_events, so
+// the second catches trades postgres-writer has not written yet.
+func inFlight(ctx context.Context, userID int) ([]string, error) {
+	ids, err := unacked(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	trades, err := streamTrades(ctx, map[int]bool{userID: true})
+	if err != nil || len(trades[userID]) == 0 {
+		return ids, err
+	}
+	missing, err := unpersisted(ctx, trades[userID])
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		seen[id] = true
+	}
+	for _, id := range missing {
+		if !seen[id] {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return streamIDAfter(ids[j], ids[i]) })
+	return ids, nil
+}
+
+// streamIDAfter reports whether stream entry id a comes after b.
+func streamIDAfter(a, b string) bool {
+	aMillis, aSeq, _ := strings.Cut(a, "-")
+	bMillis, bSeq, _ := strings.Cut(b, "-")
+	am, _ := strconv.ParseUint(aMillis, 10, 64)
+	bm, _ := strconv.ParseUint(bMillis, 10, 64)
+	if am != bm {
+		return am > bm
+	}
+	as, _ := strconv.ParseUint(aSeq, 10, 64)
+	bs, _ := strconv.ParseUint(bSeq, 10, 64)
+	return as > bs
+}
+
+// unpersisted filters ids down to the entries with no trade in Postgres. An
+// entry's legs are written in one transaction, so its first leg is checked.
+func unpersisted(ctx context.Context, ids []string) ([]string, error) {
+	eventIDs := make([]string, len(ids))
+	for i, id := range ids {
+		eventIDs[i] = id + ":0"
+	}
+	rows, err := db.DB.QueryContext(ctx, `SELECT event_id FROM trades WHERE event_id = ANY($1)`, pq.Array(eventIDs))
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up trades: %v", err)
+	}
+	defer rows.Close()
+	persisted := make(map[string]bool)
+	for rows.Next() {
+		var eventID string
+		if err := rows.Scan(&eventID); err != nil {
+			return nil, err
+		}
+		persisted[strings.TrimSuffix(eventID, ":0")] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var missing []string
+	for _, id := range ids {
+		if !persisted[id] {
+			missing = append(missing, id)
+		}
+	}
+	return missing, nil
+}
+
+// streamIDTime is when a buy_stream entry was added.
+func streamIDTime(id string) time.Time {
+	ms, _, _ := strings.Cut(id, "-")
+	millis, _ := strconv.ParseInt(ms, 10, 64)
+	return time.UnixMilli(millis)
+}
+
+// Run compares every user's Redis and Postgres state. Users that differ only
+// by trades added to buy_stream within settle are counted as in flight.
+func Run(ctx context.Context, settle time.Duration) (Report, error) {
+	redisSide, err := redisAccounts(ctx)
+	if err != nil {
+		return Report{}, err
+	}
+	postgresSide, err := postgresAccounts(ctx)
+	if err != nil {
+		return Report{}, err
+	}
+
+	var mismatches []*Mismatch
+	differing := make(map[int]bool)
+	for userID, r := range redisSide {
+		if m := compare(userID, r, postgresSide[userID]); m != nil {
+			mismatches = append(mismatches, m)
+			differing[userID] = true
+		}
+	}
+	for userID, p := range postgresSide {
+		if _, ok := redisSide[userID]; !ok {
+			mismatches = append(mismatches, compare(userID, nil, p))
+			differing[userID] = true
+		}
+	}
+
+	report := Report{
+		Users:      len(postgresSide),
+		Mismatches: []Mismatch{},
+		CheckedAt:  time.Now().UTC().Format(time.RFC3339),
+	}
+	trades, err := streamTrades(ctx, differing)
+	if err != nil {
+		return Report{}, err
+	}
+	settled := time.Now().Add(-settle)
+	for _, m := range mismatches {
+		if ids := trades[m.UserID]; len(ids) > 0 {
+			if m.UnpersistedTrades, err = unpersisted(ctx, ids); err != nil {
+				return Report{}, err
+			}
+		}
+		if n := len(m.UnpersistedTrades); n > 0 && streamIDTime(m.UnpersistedTrades[0]).After(settled) {
+			report.InFlight++
+			continue
+		}
+		report.Mismatches = append(report.Mismatches, *m)
+	}
+	sort.Slice(report.Mismatches, func(i, j int) bool { return report.Mismatches[i].UserID < report.Mismatches[j].UserID })
+	return report, nil
+}
+
+// Repair overwrites one user's state on the other side with source's.
+// Repairing Postgres from Redis fails with ErrTradesInFlight while any of
+// the user's buy_stream entries may still be written, see inFlight. Redis
+// is read before buy_stream, so a trade executed in between is either
+// caught by the check or not in what is written, and is persisted on top
+// of it.
+func Repair(ctx context.Context, userID int, source string) error {
+	switch source {
+	case SourceRedis:
+		accounts, err := redisAccounts(ctx)
+		if err != nil {
+			return err
+		}
+		a, ok := accounts[userID]
+		if !ok {
+			return ErrUnknownUser
+		}
+		ids, err := inFlight(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if len(ids) > 0 {
+			return fmt.Errorf("%w: %d entries, oldest %s", ErrTradesInFlight, len(ids), ids[0])
+		}
+		return writePostgres(ctx, userID, a)
+	case SourcePostgres:
+		a, err := postgresAccount(ctx, userID)
+		if err != nil {
+			return err
+		}
+		return writeRedis(ctx, userID, a)
+	}
+	return ErrUnknownSource
+}
+
+func postgresAccount(ctx context.Context, userID int) (*account, error) {
+	a := &account{positions: make(map[string]Position)}
+	err := db.DB.QueryRowContext(ctx, `SELECT balance FROM users WHERE id = $1`, userID).Scan(&a.balance)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrUnknownUser
+		}
+		return nil, err
+	}
+	rows, err := db.DB.QueryContext(ctx, `SELECT symbol, quantity, average_price FROM positions WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var symbol string
+		var p Position
+		if err := rows.Scan(&symbol, &p.Quantity, &p.AveragePrice); err != nil {
+			return nil, err
+		}
+		a.positions[symbol] = p
+	}
+	return a, rows.Err()
+}
+
+func writePostgres(ctx context.Context, userID int, a *account) error {
+	tx, err := db.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.ExecContext(ctx, `UPDATE users SET balance = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $1`, userID, a.balance)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrUnknownUser
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM positions WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	for symbol, p := range a.positions {
+		_, err := tx.ExecContext(ctx, `INSERT INTO positions (user_id, symbol, quantity, average_price) VALUES ($1, $2, $3, $4)`,
+			userID, symbol, p.Quantity, p.AveragePrice)
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("🔧 Rewrote Postgres account of user %d from Redis", userID)
+	return nil
+}
+
+// writeRedis replaces the user's balance and positions in one MULTI/EXEC,
+// retried if a trade touches them in between.
+func writeRedis(ctx context.Context, userID int, a *account) error {
+	positionsKey := fmt.Sprintf("positions:%d", userID)
+	fields := make([]interface{}, 0, 2*len(a.positions))
+	for symbol, p := range a.positions {
+		fields = append(fields, symbol, p.Quantity.String()+","+p.AveragePrice.String())
+	}
+	rewrite := func(tx *redis.Tx) error {
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, "user_balance", strconv.Itoa(userID), a.balance.String())
+			pipe.Del(ctx, positionsKey)
+			if len(fields) > 0 {
+				pipe.HSet(ctx, positionsKey, fields...)
+			}
+			return nil
+		})
+		return err
+	}
+	var err error
+	for attempt := 0; attempt < 10; attempt++ {
+		if err = redisClient.Client.Watch(ctx, rewrite, "user_balance", positionsKey); err != redis.TxFailedErr {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("🔧 Rewrote Redis account of user %d from Postgres", userID)
+	return nil
+}
+
+// Start runs the reconciler every interval and logs what it finds.
+func Start(interval, settle time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			report, err := Run(context.Background(), settle)
+			if err != nil {
+				log.Printf("❌ Reconciliation failed: %v", err)
+				continue
+			}
+			for _, m := range report.Mismatches {
+				log.Printf("⚠️ User %d differs: Redis balance %s, Postgres balance %s, %d positions differ, unpersisted trades %v",
+					m.UserID, m.RedisBalance, m.PostgresBalance, len(m.Positions), m.UnpersistedTrades)
+			}
+			log.Printf("🔎 Reconciled %d users: %d mismatched, %d in flight", report.Users, len(report.Mismatches), report.InFlight)
+		}
+	}()
+	log.Printf("✅ Reconciler running every %s (settle window %s)", interval, settle)
+}
@@ -0,0 +1,166 @@
+package reconcile
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"trading-service/db"
+	"trading-service/pkg/redisClient"
+
+	_ "github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+// useTestRedis points redisClient at an empty database 15 on REDIS_ADDR
+// (default localhost:6379), or skips the test when Redis is not running.
+func useTestRedis(t *testing.T) {
+	t.Helper()
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr, DB: 15})
+	ctx := context.Background()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		t.Skipf("Redis is not available at %s: %v", addr, err)
+	}
+	if err := client.FlushDB(ctx).Err(); err != nil {
+		t.Fatalf("failed to flush the test database: %v", err)
+	}
+	previous := redisClient.Client
+	redisClient.Client = client
+	t.Cleanup(func() {
+		client.FlushDB(ctx)
+		client.Close()
+		redisClient.Client = previous
+	})
+}
+
+// useTestDB points db.DB at the Postgres database in DB_HOST, DB_PORT,
+// DB_USER, DB_PASSWORD and DB_DATABASE, loaded with db.sql, or skips the
+// test when none is configured.
+func useTestDB(t *testing.T) {
+	t.Helper()
+	if os.Getenv("DB_HOST") == "" {
+		t.Skip("DB_HOST is not set")
+	}
+	conn, err := sql.Open("postgres", fmt.Sprintf(
+		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		os.Getenv("DB_HOST"),
+		os.Getenv("DB_PORT"),
+		os.Getenv("DB_USER"),
+		os.Getenv("DB_PASSWORD"),
+		os.Getenv("DB_DATABASE"),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		t.Skipf("Postgres is not available: %v", err)
+	}
+	previous := db.DB
+	db.DB = conn
+	t.Cleanup(func() {
+		conn.Close()
+		db.DB = previous
+	})
+}
+
+func TestStreamIDAfter(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want bool
+	}{
+		{"2-0", "1-5", true},
+		{"1-5", "2-0", false},
+		{"10-0", "9-0", true},
+		{"1-10", "1-9", true},
+		{"1-1", "1-1", false},
+		{"1-0", "0-0", true},
+	}
+	for _, c := range cases {
+		if got := streamIDAfter(c.a, c.b); got != c.want {
+			t.Errorf("streamIDAfter(%s, %s) = %v", c.a, c.b, got)
+		}
+	}
+}
+
+// An entry counts as unacked while any group has it pending or has not
+// read it yet.
+func TestUnackedEntries(t *testing.T) {
+	useTestRedis(t)
+	ctx := context.Background()
+	client := redisClient.Client
+	add := func(userID int) string {
+		return client.XAdd(ctx, &redis.XAddArgs{Stream: "buy_stream", Values: map[string]interface{}{"user_id": userID}}).Val()
+	}
+	acked, pending, unread := add(1), add(1), add(1)
+	add(2)
+	client.XGroupCreate(ctx, "buy_stream", "fast", "0")
+	client.XGroupCreate(ctx, "buy_stream", "slow", "0")
+	client.XReadGroup(ctx, &redis.XReadGroupArgs{Group: "fast", Consumer: "c", Streams: []string{"buy_stream", ">"}})
+	client.XAck(ctx, "buy_stream", "fast", acked, pending, unread)
+	client.XReadGroup(ctx, &redis.XReadGroupArgs{Group: "slow", Consumer: "c", Streams: []string{"buy_stream", ">"}, Count: 2})
+	client.XAck(ctx, "buy_stream", "slow", acked)
+
+	ids, err := unacked(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(ids), fmt.Sprint([]string{pending, unread}); got != want {
+		t.Fatalf("unacked entries %s, want %s", got, want)
+	}
+}
+
+// A trade every group has acked is still in flight until it has a trade row:
+// kafka_workers acks it once it is on trade_events, before postgres-writer
+// writes it.
+func TestInFlightEntries(t *testing.T) {
+	useTestRedis(t)
+	useTestDB(t)
+	ctx := context.Background()
+	client := redisClient.Client
+
+	var userID int
+	name := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	err := db.DB.QueryRow(`
+		INSERT INTO users (username, email, password_hash)
+		VALUES ($1, $1 || '@example.com', 'x')
+		RETURNING id`, name).Scan(&userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.DB.Exec(`DELETE FROM trades WHERE user_id = $1`, userID)
+		db.DB.Exec(`DELETE FROM users WHERE id = $1`, userID)
+	})
+
+	add := func() string {
+		return client.XAdd(ctx, &redis.XAddArgs{Stream: "buy_stream", Values: map[string]interface{}{"user_id": userID}}).Val()
+	}
+	written, forwarded := add(), add()
+	client.XGroupCreate(ctx, "buy_stream", "kafka_workers", "0")
+	client.XReadGroup(ctx, &redis.XReadGroupArgs{Group: "kafka_workers", Consumer: "c", Streams: []string{"buy_stream", ">"}})
+	client.XAck(ctx, "buy_stream", "kafka_workers", written, forwarded)
+	_, err = db.DB.Exec(`
+		INSERT INTO trades (user_id, symbol, trade_type, executed_price, quantity, event_id)
+		VALUES ($1, 'AAPL', 'BUY', 1, 1, $2)`, userID, written+":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unread := add()
+
+	ids, err := inFlight(ctx, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(ids), fmt.Sprint([]string{forwarded, unread}); got != want {
+		t.Fatalf("in-flight entries %s, want %s", got, want)
+	}
+}
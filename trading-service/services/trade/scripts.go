@@ -0,0 +1,205 @@
+package trade_service
+
+import "github.com/redis/go-redis/v9"
+
+// The trade scripts run the whole Redis side of a trade atomically: the
+// balance check, the balance change, the positions:<id> update and the
+// buy_stream XADD either all happen or none do, so concurrent trade
+// workers can never overspend a balance or oversell a position.
+//
+// buy_stream is the outbox for user_balance and positions:<id>: a balance
+// or position change is only ever visible together with the entry that
+// carries it to Postgres. That holds as long as a script never fails
+// halfway, because Redis does not undo the writes a script already made.
+// So each script reads and checks everything first, including the types
+// of its keys, and only then writes:
+//
+//   - every error reply is returned before the first write
+//   - the #!lua line makes Redis refuse the whole script up front when it
+//     is out of memory, instead of failing one of the writes
+//   - a script that has written cannot be killed, and Redis replicates and
+//     appends its writes to the AOF as one MULTI/EXEC block, so replicas and
+//     a restart after a crash see all of them or none
+//
+// KEYS: user_balance, positions:<id>, buy_stream, HydrationLockKey
+// ARGV: user_id, action, total in cents, stocks JSON, order_id,
+//       idempotency_key, then one symbol/quantity-in-millionths/price-in-cents
+//       triple per leg
+//
+// Both return {new balance, stream entry id} or an error reply whose
+// message is one of the reason codes mapped in scriptError.
+//
+// Balances and prices are kept as integer cents and quantities as integer
+// millionths of a share (shares.Quantity) inside the scripts. Only a new
+// average price is ever rounded, half away from zero like money.USD.
+
+// positions:<id> fields are "quantity,average_price", the same encoding the
+// Node storePositionsToRedis loader writes. Decimal strings are parsed
+// digit by digit so "0.29" is exactly 29 cents.
+const helpersLua = `
+local function to_fixed(value, scale)
+	local sign, whole, frac = string.match(value, '^%s*(-?)(%d*)%.?(%d*)%s*$')
+	if not sign then
+		return nil
+	end
+	local units = (tonumber(whole) or 0) * (10 ^ scale) + (tonumber(string.sub(frac .. string.rep('0', scale), 1, scale)) or 0)
+	if (tonumber(string.sub(frac, scale + 1, scale + 1)) or 0) >= 5 then
+		units = units + 1
+	end
+	if sign == '-' then
+		return -units
+	end
+	return units
+end
+
+local function to_cents(value)
+	return to_fixed(value, 2)
+end
+
+local function format_cents(cents)
+	local sign = ''
+	if cents < 0 then
+		sign, cents = '-', -cents
+	end
+	return string.format('%s%d.%02d', sign, math.floor(cents / 100), cents % 100)
+end
+
+-- quantities are written without trailing zeros, like shares.Quantity.String
+local function format_quantity(units)
+	local sign = ''
+	if units < 0 then
+		sign, units = '-', -units
+	end
+	local frac = string.gsub(string.format('%06d', units % 1000000), '0+$', '')
+	if frac == '' then
+		return sign .. string.format('%d', math.floor(units / 1000000))
+	end
+	return sign .. string.format('%d', math.floor(units / 1000000)) .. '.' .. frac
+end
+
+local function round_cents(value)
+	if value < 0 then
+		return -math.floor(-value + 0.5)
+	end
+	return math.floor(value + 0.5)
+end
+
+-- parse_position returns nil for a value it cannot read
+local function parse_position(value)
+	if not value then
+		return 0, 0
+	end
+	local comma = string.find(value, ',', 1, true)
+	if not comma then
+		return nil
+	end
+	return to_fixed(string.sub(value, 1, comma - 1), 6), to_cents(string.sub(value, comma + 1))
+end
+
+-- check_keys returns an error reply if Redis is being hydrated or a key
+-- holds a type the script would fail to write, or nil
+local function check_keys()
+	if redis.call('EXISTS', KEYS[4]) == 1 then
+		return redis.error_reply('HYDRATING')
+	end
+	local types = {'hash', 'hash', 'stream'}
+	for i, want in ipairs(types) do
+		local got = redis.call('TYPE', KEYS[i]).ok
+		if got ~= want and got ~= 'none' then
+			return redis.error_reply('WRONGTYPE ' .. KEYS[i] .. ' is a ' .. got)
+		end
+	end
+	return nil
+end
+`
+
+var buyScript = redis.NewScript("#!lua\n" + helpersLua + `
+local bad = check_keys()
+if bad then
+	return bad
+end
+local stored = redis.call('HGET', KEYS[1], ARGV[1])
+local balance = stored and to_cents(stored)
+if not balance then
+	return redis.error_reply('UNKNOWN_USER')
+end
+local cost = tonumber(ARGV[3])
+if cost > balance then
+	return redis.error_reply('INSUFFICIENT_FUNDS')
+end
+
+-- legs of the same symbol add up, so positions are tracked in a table and
+-- written after every leg has been read
+local positions, order = {}, {}
+for i = 7, #ARGV, 3 do
+	local symbol, quantity, price = ARGV[i], tonumber(ARGV[i + 1]), tonumber(ARGV[i + 2])
+	local position = positions[symbol]
+	if not position then
+		local held, average = parse_position(redis.call('HGET', KEYS[2], symbol))
+		if not held or not average then
+			return redis.error_reply('CORRUPT_POSITION ' .. symbol)
+		end
+		position = {held = held, average = average}
+		positions[symbol] = position
+		table.insert(order, symbol)
+	end
+	local total = position.held + quantity
+	position.average = round_cents(((position.held * position.average) + (quantity * price)) / total)
+	position.held = total
+end
+
+for _, symbol in ipairs(order) do
+	local position = positions[symbol]
+	redis.call('HSET', KEYS[2], symbol, format_quantity(position.held) .. ',' .. format_cents(position.average))
+end
+local new_balance = format_cents(balance - cost)
+redis.call('HSET', KEYS[1], ARGV[1], new_balance)
+local id = redis.call('XADD', KEYS[3], '*',
+	'user_id', ARGV[1], 'action', ARGV[2], 'balance', new_balance, 'stocks', ARGV[4], 'order_id', ARGV[5], 'idempotency_key', ARGV[6])
+return {new_balance, id}
+`)
+
+var sellScript = redis.NewScript("#!lua\n" + helpersLua + `
+local bad = check_keys()
+if bad then
+	return bad
+end
+local stored = redis.call('HGET', KEYS[1], ARGV[1])
+local balance = stored and to_cents(stored)
+if not balance then
+	return redis.error_reply('UNKNOWN_USER')
+end
+
+local remaining, averages = {}, {}
+for i = 7, #ARGV, 3 do
+	local symbol, quantity = ARGV[i], tonumber(ARGV[i + 1])
+	if remaining[symbol] == nil then
+		local value = redis.call('HGET', KEYS[2], symbol)
+		if not value then
+			return redis.error_reply('INSUFFICIENT_SHARES')
+		end
+		remaining[symbol], averages[symbol] = parse_position(value)
+		if not remaining[symbol] or not averages[symbol] then
+			return redis.error_reply('CORRUPT_POSITION ' .. symbol)
+		end
+	end
+	remaining[symbol] = remaining[symbol] - quantity
+	if remaining[symbol] < 0 then
+		return redis.error_reply('INSUFFICIENT_SHARES')
+	end
+end
+
+for symbol, quantity in pairs(remaining) do
+	if quantity == 0 then
+		redis.call('HDEL', KEYS[2], symbol)
+	else
+		redis.call('HSET', KEYS[2], symbol, format_quantity(quantity) .. ',' .. format_cents(averages[symbol]))
+	end
+end
+
+local new_balance = format_cents(balance + tonumber(ARGV[3]))
+redis.call('HSET', KEYS[1], ARGV[1], new_balance)
+local id = redis.call('XADD', KEYS[3], '*',
+	'user_id', ARGV[1], 'action', ARGV[2], 'balance', new_balance, 'stocks', ARGV[4], 'order_id', ARGV[5], 'idempotency_key', ARGV[6])
+return {new_balance, id}
+`)
@@ -3,54 +3,126 @@ package trade_service
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"strings"
 
+	"trading-service/pkg/money"
 	"trading-service/pkg/redisClient"
+	"trading-service/pkg/shares"
 
 	"github.com/redis/go-redis/v9"
 )
 
+var (
+	ErrUnknownUser        = errors.New("user not found")
+	ErrInsufficientFunds  = errors.New("insufficient funds")
+	ErrInsufficientShares = errors.New("insufficient shares")
+	// ErrHydrating means Redis is being reloaded from Postgres; the trade
+	// did not run and can be tried again once the load is done.
+	ErrHydrating = errors.New("redis is being hydrated")
+)
+
+// HydrationLockKey is held while user_balance and positions:* are being
+// reloaded from Postgres. The trade scripts refuse to run while it exists.
+const HydrationLockKey = "redis_snapshot:lock"
+
 type StockData struct {
 	Symbol string  `json:"symbol"`
 	Price  float64 `json:"price"`
 }
 
+// TradeStock is one leg of a trade: a symbol, how many shares and the price
+// they executed at.
+type TradeStock struct {
+	Symbol   string          `json:"symbol"`
+	Quantity shares.Quantity `json:"quantity"`
+	Price    money.Money     `json:"price"`
+}
+
 type TradeRequest struct {
 	UserID int    `json:"user_id"`
 	Action string `json:"action"`
-	Stock  []struct {
-		Symbol   string  `json:"symbol"`
-		Quantity float64 `json:"quantity"`
-		Price    float64 `json:"price"`
-	} `json:"stock"`
+	// OrderType is one of order_type_enum; empty means MARKET.
+	OrderType  string      `json:"order_type,omitempty"`
+	LimitPrice money.Money `json:"limit_price,omitempty"`
+	StopPrice  money.Money `json:"stop_price,omitempty"`
+	// OrderID is the orders row backing this request, if one was persisted.
+	OrderID int `json:"order_id,omitempty"`
+	// IdempotencyKey comes from the Idempotency-Key header or this field.
+	IdempotencyKey string       `json:"idempotency_key,omitempty"`
+	Stock          []TradeStock `json:"stock"`
+}
+
+// TradeType maps a request action onto trade_type_enum; anything that is
+// not a sell is treated as a buy, matching the original buy-only pipeline.
+func TradeType(action string) string {
+	if strings.EqualFold(action, "sell") {
+		return "SELL"
+	}
+	return "BUY"
+}
+
+// OrderTypeOrMarket normalizes the request's order type onto order_type_enum.
+func (t TradeRequest) OrderTypeOrMarket() string {
+	if t.OrderType == "" {
+		return "MARKET"
+	}
+	return strings.ToUpper(t.OrderType)
 }
 
-func ExecuteBuy(ctx context.Context, trade TradeRequest, balance float64, totalCost float64) {
+// executeScript runs a trade script for trade and returns the new balance.
+func executeScript(ctx context.Context, script *redis.Script, trade TradeRequest, action string, total money.Money) (money.Money, error) {
 	stockJSON, err := json.Marshal(trade.Stock)
 	if err != nil {
-		log.Fatalf("Failed to serialize stock data: %v", err)
-		return
+		return 0, fmt.Errorf("failed to serialize stock data: %v", err)
+	}
+	keys := []string{"user_balance", fmt.Sprintf("positions:%d", trade.UserID), "buy_stream", HydrationLockKey}
+	// amounts cross into Lua as integer cents and quantities as integer
+	// millionths of a share, so the script never rounds on the way in
+	args := []interface{}{trade.UserID, action, total.Cents(), string(stockJSON), trade.OrderID, trade.IdempotencyKey}
+	for _, stock := range trade.Stock {
+		args = append(args, stock.Symbol, stock.Quantity.Units(), stock.Price.Cents())
 	}
-	pipeline := redisClient.Client.TxPipeline()
-	pipeline.HSet(ctx, "user_balance", fmt.Sprint(trade.UserID), balance-totalCost)
-	_, err = pipeline.XAdd(ctx, &redis.XAddArgs{
-		Stream: "buy_stream",
-		Values: map[string]interface{}{
-			"user_id": trade.UserID,
-			"action":  trade.Action,
-			"balance": balance - totalCost,
-			"stocks":  string(stockJSON),
-		},
-	}).Result()
+	result, err := script.Run(ctx, redisClient.Client, keys, args...).StringSlice()
 	if err != nil {
-		log.Fatalf("Failed to push trade to Redis Stream: %v", err)
-		redisClient.Client.HSet(ctx, "user_balance", fmt.Sprint(trade.UserID), balance)
-		return
-	} 
-	_, err = pipeline.Exec(ctx)
+		return 0, scriptError(err)
+	}
+	balance, err := money.Parse(result[0])
 	if err != nil {
-		log.Fatalf("Failed to execute pipeline: %v", err)
+		return 0, fmt.Errorf("invalid balance from trade script: %v", err)
+	}
+	return balance, nil
+}
+
+// scriptError maps the reason codes returned by the trade scripts onto the
+// package's error values.
+func scriptError(err error) error {
+	switch err.Error() {
+	case "UNKNOWN_USER":
+		return ErrUnknownUser
+	case "INSUFFICIENT_FUNDS":
+		return ErrInsufficientFunds
+	case "INSUFFICIENT_SHARES":
+		return ErrInsufficientShares
+	case "HYDRATING":
+		return ErrHydrating
 	}
-	// log.Println("✅ Trade successfully added to Redis Stream!")
+	return fmt.Errorf("trade script failed: %v", err)
+}
+
+// ExecuteBuy debits totalCost, adds the bought legs to the buyer's positions
+// and publishes the trade on buy_stream in one atomic step. The balance is
+// checked inside the same step, so it fails with ErrInsufficientFunds
+// rather than ever going negative.
+func ExecuteBuy(ctx context.Context, trade TradeRequest, totalCost money.Money) (money.Money, error) {
+	return executeScript(ctx, buyScript, trade, "BUY", totalCost)
+}
+
+// ExecuteSell credits the sale proceeds, reduces the seller's positions and
+// publishes a SELL event on buy_stream, which the Kafka and SQL workers
+// consume alongside buys. Selling more than is held fails with
+// ErrInsufficientShares and changes nothing.
+func ExecuteSell(ctx context.Context, trade TradeRequest, proceeds money.Money) (money.Money, error) {
+	return executeScript(ctx, sellScript, trade, "SELL", proceeds)
 }
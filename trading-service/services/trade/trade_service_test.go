@@ -0,0 +1,143 @@
+package trade_service
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"testing"
+
+	"trading-service/pkg/money"
+	"trading-service/pkg/redisClient"
+	"trading-service/pkg/shares"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// testRedisDB keeps the test's user_balance and buy_stream away from the
+// service's keys in database 0.
+const testRedisDB = 15
+
+// useTestRedis points redisClient at an empty test database on REDIS_ADDR
+// (default localhost:6379), or skips the test when Redis is not running.
+func useTestRedis(t *testing.T) {
+	t.Helper()
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr, DB: testRedisDB, PoolSize: 100})
+	ctx := context.Background()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		t.Skipf("Redis is not available at %s: %v", addr, err)
+	}
+	if err := client.FlushDB(ctx).Err(); err != nil {
+		t.Fatalf("failed to flush the test database: %v", err)
+	}
+	previous := redisClient.Client
+	redisClient.Client = client
+	t.Cleanup(func() {
+		client.FlushDB(ctx)
+		client.Close()
+		redisClient.Client = previous
+	})
+}
+
+// Parallel buys by one user must never take the balance below zero, and
+// every debit that succeeded must be accounted for.
+func TestExecuteBuyNeverOverspends(t *testing.T) {
+	useTestRedis(t)
+	ctx := context.Background()
+
+	const (
+		userID  = 4242
+		buyers  = 200
+		opening = "1000.00"
+	)
+	if err := redisClient.Client.HSet(ctx, "user_balance", userID, opening).Err(); err != nil {
+		t.Fatal(err)
+	}
+	price := money.FromFloat(7)
+	trade := TradeRequest{
+		UserID: userID,
+		Action: "BUY",
+		Stock:  []TradeStock{{Symbol: "AAPL", Quantity: shares.FromInt(1), Price: price}},
+	}
+	cost, err := price.Times(shares.FromInt(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		wg        sync.WaitGroup
+		mutex     sync.Mutex
+		succeeded int
+		failures  []error
+	)
+	for i := 0; i < buyers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := ExecuteBuy(ctx, trade, cost)
+			mutex.Lock()
+			defer mutex.Unlock()
+			switch {
+			case err == nil:
+				succeeded++
+			case !errors.Is(err, ErrInsufficientFunds):
+				failures = append(failures, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(failures) > 0 {
+		t.Fatalf("unexpected buy errors: %v", failures)
+	}
+
+	stored, err := redisClient.Client.HGet(ctx, "user_balance", "4242").Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	final, err := money.Parse(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start, _ := money.Parse(opening)
+	if final < 0 {
+		t.Fatalf("balance went negative: %s", final)
+	}
+	if spent := start - final; spent != cost*money.Money(succeeded) {
+		t.Fatalf("%d buys of %s succeeded but %s was spent", succeeded, cost, spent)
+	}
+	if final >= cost {
+		t.Fatalf("balance %s could still afford a buy of %s after %d buys", final, cost, buyers)
+	}
+	if entries := redisClient.Client.XLen(ctx, "buy_stream").Val(); entries != int64(succeeded) {
+		t.Fatalf("%d buys succeeded but buy_stream has %d entries", succeeded, entries)
+	}
+}
+
+// While Redis is being hydrated the trade scripts change nothing.
+func TestTradesWaitForHydration(t *testing.T) {
+	useTestRedis(t)
+	ctx := context.Background()
+	redisClient.Client.HSet(ctx, "user_balance", 7, "100.00")
+	redisClient.Client.Set(ctx, HydrationLockKey, 1, 0)
+
+	trade := TradeRequest{UserID: 7, Action: "BUY", Stock: []TradeStock{{Symbol: "AAPL", Quantity: shares.FromInt(1)}}}
+	if _, err := ExecuteBuy(ctx, trade, money.FromFloat(10)); !errors.Is(err, ErrHydrating) {
+		t.Fatalf("buy during hydration returned %v, want ErrHydrating", err)
+	}
+	if balance := redisClient.Client.HGet(ctx, "user_balance", "7").Val(); balance != "100.00" {
+		t.Fatalf("balance changed to %s during hydration", balance)
+	}
+	if n := redisClient.Client.XLen(ctx, "buy_stream").Val(); n != 0 {
+		t.Fatalf("buy_stream got %d entries during hydration", n)
+	}
+
+	redisClient.Client.Del(ctx, HydrationLockKey)
+	if _, err := ExecuteBuy(ctx, trade, money.FromFloat(10)); err != nil {
+		t.Fatalf("buy after hydration: %v", err)
+	}
+}
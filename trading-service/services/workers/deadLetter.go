@@ -0,0 +1,202 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"trading-service/pkg/redisClient"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Messages that cannot be processed are moved aside instead of being skipped
+// or retried forever. Every dead letter is recorded in buy_stream_dlq, which
+// the admin endpoints inspect, replay and discard. Failures in the Kafka stage
+// are also published to trade_events_dlq on the event bus, so Kafka-side
+// tooling sees them.
+const (
+	DeadLetterStream = "buy_stream_dlq"
+	DeadLetterTopic  = "trade_events_dlq"
+
+	// the pipeline stage a message failed in
+	StageRedisToKafka = "redis_to_kafka" // processRedisStream
+	StageRedisToSQL   = "redis_to_sql"   // processTrade
+	StageKafkaToSQL   = "kafka_to_sql"   // processKafka
+
+	// how many times a message is tried before it is dead-lettered
+	maxAttempts = 3
+)
+
+var (
+	ErrDeadLetterNotFound = errors.New("dead letter not found")
+	ErrUnreplayable       = errors.New("dead letter payload cannot be replayed")
+)
+
+// DeadLetter is one entry of buy_stream_dlq.
+type DeadLetter struct {
+	ID       string `json:"id"`
+	Stage    string `json:"stage"`
+	Reason   string `json:"reason"`
+	Attempts int    `json:"attempts"`
+	// SourceID is the id of the failed event: a buy_stream entry id, or its
+	// id on the trade_events bus.
+	SourceID string `json:"source_id"`
+	// Payload is the original event: the stream fields as a JSON object for
+	// the buy_stream stages, the trade JSON for kafka_to_sql.
+	Payload  string `json:"payload"`
+	FailedAt string `json:"failed_at"`
+}
+
+// withRetries runs fn up to maxAttempts times with a short backoff and
+// returns how many attempts were made and the last error.
+func withRetries(fn func() error) (int, error) {
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if err = fn(); err == nil {
+			return attempt, nil
+		}
+		if attempt < maxAttempts {
+			time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+		}
+	}
+	return maxAttempts, err
+}
+
+func addDeadLetter(ctx context.Context, stage, sourceID, payload string, attempts int, reason error) error {
+	return redisClient.Client.XAdd(ctx, &redis.XAddArgs{
+		Stream: DeadLetterStream,
+		Values: map[string]interface{}{
+			"stage":     stage,
+			"reason":    reason.Error(),
+			"attempts":  attempts,
+			"source_id": sourceID,
+			"payload":   payload,
+			"failed_at": time.Now().UTC().Format(time.RFC3339Nano),
+		},
+	}).Err()
+}
+
+// deadLetter moves an event that failed in stage to the dead-letter stream.
+// Events from trade_events are also published to trade_events_dlq on the
+// event bus. The caller acks the event only if this succeeds.
+func deadLetter(stage string, e Event, attempts int, reason error) error {
+	ctx := context.Background()
+	if err := addDeadLetter(ctx, stage, e.ID, string(e.Payload), attempts, reason); err != nil {
+		log.Printf("❌ Failed to dead-letter %s event %s: %v", stage, e.ID, err)
+		return err
+	}
+	if stage == StageKafkaToSQL {
+		letter, _ := json.Marshal(DeadLetter{
+			Stage:    stage,
+			Reason:   reason.Error(),
+			Attempts: attempts,
+			SourceID: e.ID,
+			Payload:  string(e.Payload),
+			FailedAt: time.Now().UTC().Format(time.RFC3339Nano),
+		})
+		errs := eventBus().Publish(ctx, DeadLetterTopic, []Event{{Key: e.Key, Payload: letter}})
+		if errs[0] != nil {
+			log.Printf("❌ Failed to publish event %s to %s: %v", e.ID, DeadLetterTopic, errs[0])
+		}
+	}
+	log.Printf("☠️ Dead-lettered %s event %s after %d attempts: %v", stage, e.ID, attempts, reason)
+	return nil
+}
+
+func toDeadLetter(message redis.XMessage) DeadLetter {
+	field := func(name string) string {
+		value, _ := message.Values[name].(string)
+		return value
+	}
+	attempts, _ := strconv.Atoi(field("attempts"))
+	return DeadLetter{
+		ID:       message.ID,
+		Stage:    field("stage"),
+		Reason:   field("reason"),
+		Attempts: attempts,
+		SourceID: field("source_id"),
+		Payload:  field("payload"),
+		FailedAt: field("failed_at"),
+	}
+}
+
+// ListDeadLetters returns up to count dead letters, oldest first.
+func ListDeadLetters(ctx context.Context, count int64) ([]DeadLetter, error) {
+	messages, err := redisClient.Client.XRangeN(ctx, DeadLetterStream, "-", "+", count).Result()
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]DeadLetter, 0, len(messages))
+	for _, message := range messages {
+		letters = append(letters, toDeadLetter(message))
+	}
+	return letters, nil
+}
+
+// GetDeadLetter loads one dead letter by its buy_stream_dlq id.
+func GetDeadLetter(ctx context.Context, id string) (DeadLetter, error) {
+	messages, err := redisClient.Client.XRange(ctx, DeadLetterStream, id, id).Result()
+	if err != nil {
+		return DeadLetter{}, err
+	}
+	if len(messages) == 0 {
+		return DeadLetter{}, ErrDeadLetterNotFound
+	}
+	return toDeadLetter(messages[0]), nil
+}
+
+// ReplayDeadLetter sends a dead letter back to the stage it failed in and
+// removes it. Replays keep the original event id, so a trade that was
+// persisted after all is not written twice, and one older than the user's
+// newest persisted trade does not put back the balance it left.
+func ReplayDeadLetter(ctx context.Context, id string) error {
+	letter, err := GetDeadLetter(ctx, id)
+	if err != nil {
+		return err
+	}
+	switch letter.Stage {
+	case StageRedisToKafka, StageRedisToSQL:
+		var values map[string]interface{}
+		if err := json.Unmarshal([]byte(letter.Payload), &values); err != nil {
+			return fmt.Errorf("%w: %v", ErrUnreplayable, err)
+		}
+		if _, ok := values["event_id"]; !ok {
+			values["event_id"] = letter.SourceID
+		}
+		payload, _ := json.Marshal(values)
+		userID, _ := values["user_id"].(string)
+		if err := streamBus.Publish(ctx, "buy_stream", []Event{{Key: userID, Payload: payload}})[0]; err != nil {
+			return err
+		}
+	case StageKafkaToSQL:
+		var trade Trade
+		if err := json.Unmarshal([]byte(letter.Payload), &trade); err != nil {
+			return fmt.Errorf("%w: %v", ErrUnreplayable, err)
+		}
+		err := eventBus().Publish(ctx, "trade_events", []Event{{Key: strconv.Itoa(trade.UserID), Payload: []byte(letter.Payload)}})[0]
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%w: unknown stage %q", ErrUnreplayable, letter.Stage)
+	}
+	log.Printf("♻️ Replayed dead letter %s to %s", id, letter.Stage)
+	return DiscardDeadLetter(ctx, id)
+}
+
+// DiscardDeadLetter deletes a dead letter without replaying it.
+func DiscardDeadLetter(ctx context.Context, id string) error {
+	deleted, err := redisClient.Client.XDel(ctx, DeadLetterStream, id).Result()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrDeadLetterNotFound
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Event is one message on an event bus topic.
+type Event struct {
+	// ID identifies the event within its topic: a stream entry id, a Kafka
+	// "partition/offset", or a sequence number for the in-memory bus.
+	ID string
+	// Key groups related events; trades are keyed by user id. A group that
+	// reads a topic with a single consumer gets each key's events in the
+	// order they were published. Consumers sharing a group may get one key's
+	// events split between them (on Kafka a key's partition goes to one
+	// consumer, but the other backends hand out events in turn), so the
+	// workers read each group with one consumer and fan out by key
+	// themselves, see inShards.
+	Key     string
+	Payload []byte
+
+	// ref is whatever the backend needs to ack or nack the event.
+	ref interface{}
+}
+
+// EventBus moves events between pipeline stages. Consumers in the same group
+// share a topic's events; every group sees every event.
+type EventBus interface {
+	// Publish sends events to topic and returns once the backend has durably
+	// accepted them. The result has one error per event, nil for success.
+	Publish(ctx context.Context, topic string, events []Event) []error
+	// Subscribe returns up to max events for group, waiting at most wait
+	// for the first one. consumer names the caller within the group.
+	Subscribe(ctx context.Context, topic, group, consumer string, max int, wait time.Duration) ([]Event, error)
+	// Ack marks events as processed by group.
+	Ack(ctx context.Context, topic, group string, events []Event) error
+	// Nack hands events back so they are delivered again, to the same
+	// consumer and before anything published after them.
+	Nack(ctx context.Context, topic, group string, events []Event) error
+	// Backlog returns how many events on topic group has not acked yet,
+	// read or not. It fails if the backend cannot tell.
+	Backlog(ctx context.Context, topic, group string) (int64, error)
+}
+
+// NewEventBus builds a bus by name: "kafka", "redis" or "memory".
+func NewEventBus(kind string) (EventBus, error) {
+	switch kind {
+	case "", "kafka":
+		return NewKafkaBus("localhost:9092"), nil
+	case "redis":
+		return NewRedisBus(), nil
+	case "memory":
+		return NewMemoryBus(), nil
+	}
+	return nil, fmt.Errorf("unknown event bus %q", kind)
+}
+
+// The trade scripts append to buy_stream atomically with the balance change,
+// so buy_stream always lives in Redis. trade_events, between the forwarding
+// workers and the Postgres writers, can be on any bus.
+var (
+	streamBus EventBus = NewRedisBus()
+
+	eventsMutex sync.Mutex
+	events      EventBus
+)
+
+// SetEventBus picks the bus trade_events runs on. It must be called before
+// the producer and consumer workers start; the default is Kafka.
+func SetEventBus(bus EventBus) {
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+	events = bus
+}
+
+func eventBus() EventBus {
+	eventsMutex.Lock()
+	defer eventsMutex.Unlock()
+	if events == nil {
+		events = NewKafkaBus("localhost:9092")
+	}
+	return events
+}
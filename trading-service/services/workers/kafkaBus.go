@@ -0,0 +1,286 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+)
+
+// deliveryTimeout bounds how long Publish waits for delivery reports. It is a
+// little longer than the producer's own delivery.timeout.ms, after which
+// librdkafka reports the message as failed anyway.
+const deliveryTimeout = 35 * time.Second
+
+// queryTimeout bounds each metadata and offset query of Backlog.
+const queryTimeout = 5 * time.Second
+
+// KafkaBus is an EventBus on Kafka. Each (group, consumer) pair gets its own
+// consumer with manual offset commits: Ack commits past the acked events and
+// Nack seeks back to the first of them.
+type KafkaBus struct {
+	brokers string
+
+	producerOnce sync.Once
+	producer     *kafka.Producer
+
+	consumersMutex sync.Mutex
+	consumers      map[string]*kafka.Consumer
+}
+
+// kafkaRef is what a KafkaBus event needs to be acked or nacked.
+type kafkaRef struct {
+	consumer  *kafka.Consumer
+	partition kafka.TopicPartition
+}
+
+func NewKafkaBus(brokers string) *KafkaBus {
+	return &KafkaBus{brokers: brokers, consumers: make(map[string]*kafka.Consumer)}
+}
+
+func (b *KafkaBus) initProducer() {
+	var err error
+	b.producer, err = kafka.NewProducer(&kafka.ConfigMap{
+		"bootstrap.servers":            b.brokers,
+		"queue.buffering.max.messages": 8000000, // default is 100000
+		"queue.buffering.max.kbytes":   8048576, // 1GB
+		// idempotence makes librdkafka's own retries safe: no duplicates or
+		// reordering within a partition, and acks from all in-sync replicas
+		"enable.idempotence":       true,
+		"acks":                     "all",
+		"message.send.max.retries": 10,
+		"retry.backoff.ms":         200,
+		"delivery.timeout.ms":      30000,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create Kafka producer: %v", err)
+	}
+	go b.logProducerEvents()
+}
+
+// logProducerEvents drains the producer's events channel, which only carries
+// client errors since every Publish waits on its own delivery channel.
+func (b *KafkaBus) logProducerEvents() {
+	for e := range b.producer.Events() {
+		if err, ok := e.(kafka.Error); ok {
+			log.Printf("❌ Kafka producer error: %v", err)
+		}
+	}
+}
+
+// Publish produces events and waits for Kafka's delivery report of each.
+func (b *KafkaBus) Publish(ctx context.Context, topic string, events []Event) []error {
+	b.producerOnce.Do(b.initProducer)
+	errs := make([]error, len(events))
+	deliveries := make(chan kafka.Event, len(events))
+	waiting := make(map[int]bool)
+	for i, e := range events {
+		err := b.producer.Produce(&kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+			Key:            []byte(e.Key),
+			Value:          e.Payload,
+			Opaque:         i,
+		}, deliveries)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		waiting[i] = true
+	}
+
+	timeout := time.NewTimer(deliveryTimeout)
+	defer timeout.Stop()
+	for len(waiting) > 0 {
+		select {
+		case e := <-deliveries:
+			m, ok := e.(*kafka.Message)
+			if !ok {
+				continue
+			}
+			i, _ := m.Opaque.(int)
+			delete(waiting, i)
+			errs[i] = m.TopicPartition.Error
+		case <-timeout.C:
+			// a late delivery after this is only a duplicate, which the
+			// Postgres writer drops by event id
+			for i := range waiting {
+				errs[i] = fmt.Errorf("no delivery report within %s", deliveryTimeout)
+			}
+			return errs
+		}
+	}
+	return errs
+}
+
+func (b *KafkaBus) consumer(topic, group, name string) (*kafka.Consumer, error) {
+	b.consumersMutex.Lock()
+	defer b.consumersMutex.Unlock()
+	key := topic + "/" + group + "/" + name
+	if c, ok := b.consumers[key]; ok {
+		return c, nil
+	}
+	c, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers": b.brokers,
+		"group.id":          group,
+		"auto.offset.reset": "earliest",
+		// offsets are committed by Ack only
+		"enable.auto.commit": false,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := c.SubscribeTopics([]string{topic}, nil); err != nil {
+		c.Close()
+		return nil, err
+	}
+	b.consumers[key] = c
+	return c, nil
+}
+
+func (b *KafkaBus) Subscribe(ctx context.Context, topic, group, consumer string, max int, wait time.Duration) ([]Event, error) {
+	c, err := b.consumer(topic, group, consumer)
+	if err != nil {
+		return nil, err
+	}
+	var events []Event
+	deadline := time.Now().Add(wait)
+	for len(events) < max {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			break
+		}
+		m, err := c.ReadMessage(remaining)
+		if err != nil {
+			if kafkaErr, ok := err.(kafka.Error); ok && kafkaErr.Code() == kafka.ErrTimedOut {
+				break
+			}
+			return events, err
+		}
+		events = append(events, Event{
+			ID:      fmt.Sprintf("%d/%d", m.TopicPartition.Partition, m.TopicPartition.Offset),
+			Key:     string(m.Key),
+			Payload: m.Value,
+			ref:     kafkaRef{consumer: c, partition: m.TopicPartition},
+		})
+	}
+	return events, nil
+}
+
+// kafkaOffsets returns, per consumer, the lowest or highest offset of events in
+// each partition.
+func kafkaOffsets(events []Event, highest bool) map[*kafka.Consumer]map[int32]kafka.TopicPartition {
+	offsets := make(map[*kafka.Consumer]map[int32]kafka.TopicPartition)
+	for _, e := range events {
+		ref, ok := e.ref.(kafkaRef)
+		if !ok {
+			continue
+		}
+		partitions, ok := offsets[ref.consumer]
+		if !ok {
+			partitions = make(map[int32]kafka.TopicPartition)
+			offsets[ref.consumer] = partitions
+		}
+		tp := ref.partition
+		current, seen := partitions[tp.Partition]
+		if !seen || (highest && tp.Offset > current.Offset) || (!highest && tp.Offset < current.Offset) {
+			partitions[tp.Partition] = tp
+		}
+	}
+	return offsets
+}
+
+// Ack commits each partition past the last acked event. Events of a
+// partition must be acked in the order they were read.
+func (b *KafkaBus) Ack(ctx context.Context, topic, group string, events []Event) error {
+	for c, partitions := range kafkaOffsets(events, true) {
+		var commit []kafka.TopicPartition
+		for _, tp := range partitions {
+			tp.Offset++
+			commit = append(commit, tp)
+		}
+		if _, err := c.CommitOffsets(commit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Nack rewinds each partition to the first nacked event so it and everything
+// read after it is delivered again.
+func (b *KafkaBus) Nack(ctx context.Context, topic, group string, events []Event) error {
+	for c, partitions := range kafkaOffsets(events, false) {
+		for _, tp := range partitions {
+			if err := c.Seek(tp, 0); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Backlog sums, over topic's partitions, the events past group's committed
+// offset. It queries through a consumer of its own that never joins the
+// group, so it does not take partitions from the group's reader.
+func (b *KafkaBus) Backlog(ctx context.Context, topic, group string) (int64, error) {
+	c, err := b.inspector(group)
+	if err != nil {
+		return 0, err
+	}
+	timeout := int(queryTimeout.Milliseconds())
+	metadata, err := c.GetMetadata(&topic, false, timeout)
+	if err != nil {
+		return 0, err
+	}
+	info, ok := metadata.Topics[topic]
+	if !ok || info.Error.Code() == kafka.ErrUnknownTopicOrPart {
+		return 0, nil
+	}
+	if info.Error.Code() != kafka.ErrNoError {
+		return 0, info.Error
+	}
+	partitions := make([]kafka.TopicPartition, len(info.Partitions))
+	for i, p := range info.Partitions {
+		partitions[i] = kafka.TopicPartition{Topic: &topic, Partition: p.ID}
+	}
+	committed, err := c.Committed(partitions, timeout)
+	if err != nil {
+		return 0, err
+	}
+	var backlog int64
+	for _, tp := range committed {
+		low, high, err := c.QueryWatermarkOffsets(topic, tp.Partition, timeout)
+		if err != nil {
+			return 0, err
+		}
+		offset := int64(tp.Offset)
+		if offset < 0 {
+			// nothing committed yet: the reader starts at the earliest offset
+			offset = low
+		}
+		backlog += high - offset
+	}
+	return backlog, nil
+}
+
+// inspector returns the consumer Backlog queries group's offsets with.
+func (b *KafkaBus) inspector(group string) (*kafka.Consumer, error) {
+	b.consumersMutex.Lock()
+	defer b.consumersMutex.Unlock()
+	key := "backlog/" + group
+	if c, ok := b.consumers[key]; ok {
+		return c, nil
+	}
+	c, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers":  b.brokers,
+		"group.id":           group,
+		"enable.auto.commit": false,
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.consumers[key] = c
+	return c, nil
+}
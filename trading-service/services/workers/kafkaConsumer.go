@@ -6,249 +6,217 @@ import (
 	"fmt"
 	"log"
 	"strconv"
-	redis "github.com/redis/go-redis/v9"
-	redisClient "trading-service/pkg/redisClient"
+	"time"
 
-	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"trading-service/pkg/money"
+	"trading-service/services/orders"
 )
 
-func addToKafka(userId int, action string, balance float64, stocks []struct {
-	Symbol   string  `json:"symbol"`
-	Quantity float64 `json:"quantity"`
-	Price    float64 `json:"price"`
-}) error {
+// streamWait is how long buy_stream readers block waiting for new entries.
+const streamWait = 5 * time.Second
 
-	return nil
-}
-
-var producer *kafka.Producer
-
-func initKafkaProducer() {
-	var err error
-	producer, err = kafka.NewProducer(&kafka.ConfigMap{
-		"bootstrap.servers": "localhost:9092", // update if needed
-		"queue.buffering.max.messages": 8000000, // default is 100000
-		"queue.buffering.max.kbytes": 8048576,   // 1GB
-	})
+// parseStreamTrade reads a buy_stream entry written by the trade scripts.
+// Replayed entries carry the event_id of the entry they were copied from.
+func parseStreamTrade(entry Event) (Trade, error) {
+	var trade Trade
+	var values map[string]interface{}
+	if err := json.Unmarshal(entry.Payload, &values); err != nil {
+		return trade, fmt.Errorf("invalid stream entry: %v", err)
+	}
+	field := func(name string) (string, error) {
+		value, ok := values[name].(string)
+		if !ok || value == "" {
+			return "", fmt.Errorf("missing or invalid %s", name)
+		}
+		return value, nil
+	}
+	userID, err := field("user_id")
+	if err != nil {
+		return trade, err
+	}
+	if trade.UserID, err = strconv.Atoi(userID); err != nil {
+		return trade, fmt.Errorf("invalid user_id %q", userID)
+	}
+	if trade.Action, err = field("action"); err != nil {
+		return trade, err
+	}
+	balance, err := field("balance")
 	if err != nil {
-		log.Fatalf("Failed to create Kafka producer: %v", err)
+		return trade, err
 	}
+	if trade.Balance, err = money.Parse(balance); err != nil {
+		return trade, fmt.Errorf("invalid balance: %v", err)
+	}
+	stocks, err := field("stocks")
+	if err != nil {
+		return trade, err
+	}
+	if err := json.Unmarshal([]byte(stocks), &trade.Stocks); err != nil {
+		return trade, fmt.Errorf("invalid stocks: %v", err)
+	}
+	orderID, _ := values["order_id"].(string)
+	trade.OrderID, _ = strconv.Atoi(orderID)
+	trade.IdempotencyKey, _ = values["idempotency_key"].(string)
+	trade.EventID, _ = values["event_id"].(string)
+	if trade.EventID == "" {
+		trade.EventID = entry.ID
+	}
+	return trade, nil
 }
-func processRedisStream(workerId int) error {
-	if producer == nil{
-		log.Fatal("kafka producer is NIL ")
+
+// ackForwarded acks buy_stream entries kafka_workers is done with.
+func ackForwarded(entries []Event) {
+	if len(entries) == 0 {
+		return
 	}
-	for {
-		// log.Printf("📥 Worker %d attempting to read from `buy_stream`...", workerId)
-		messages, err := redisClient.Client.XReadGroup(context.Background(), &redis.XReadGroupArgs{
-			Group:    "kafka_workers",
-			Consumer: fmt.Sprintf("redisConsumer-%d", workerId),
-			Streams:  []string{"buy_stream", ">"},
-			Count:    10,
-		}).Result()
-		// log.Printf("reading message now!")
+	ctx := context.Background()
+	if err := streamBus.Ack(ctx, "buy_stream", "kafka_workers", entries); err != nil {
+		log.Printf("❌ Failed to ack forwarded entries: %v", err)
+	}
+}
+
+// streamTrade is a parsed buy_stream entry on its way to trade_events.
+type streamTrade struct {
+	source Event
+	trade  Trade
+	event  Event
+}
+
+// forwardEntries publishes buy_stream entries to trade_events and returns
+// the ones it had to hold back, in stream order. An entry is acked only once
+// the event bus has confirmed it, e.g. by a Kafka delivery report. Entries
+// go out in rounds holding at most one entry per user, so when a user's
+// entry still fails after maxAttempts none of their later entries is
+// published ahead of it; those are held back with it, so an outage delays
+// trades instead of losing or reordering them. Malformed entries are
+// dead-lettered straight away.
+func forwardEntries(entries []Event) []Event {
+	ctx := context.Background()
+	var users []int
+	queues := make(map[int][]streamTrade)
+	for _, entry := range entries {
+		trade, err := parseStreamTrade(entry)
+		var payload []byte
+		if err == nil {
+			payload, err = json.Marshal(trade)
+		}
 		if err != nil {
-			log.Println("Error reading from Redis Stream: ", err)
-			break
-		} else {
-			if len(messages) == 0 || len(messages[0].Messages) == 0 {
-				log.Printf("⚠️ Worker %d found no messages", workerId)
-				continue
+			log.Printf("❌ Failed to parse stream entry %s: %v", entry.ID, err)
+			if deadLetter(StageRedisToKafka, entry, 1, err) == nil {
+				ackForwarded([]Event{entry})
 			}
+			continue
 		}
-		for _, message := range messages[0].Messages {
-			jobID := message.ID
-			values := message.Values
-			userID, _ := strconv.Atoi(values["user_id"].(string))
-			balance, _ := strconv.ParseFloat(values["balance"].(string), 64)
-			action := values["action"].(string)
+		if _, ok := queues[trade.UserID]; !ok {
+			users = append(users, trade.UserID)
+		}
+		// keyed by user so a user's trades stay in order
+		event := Event{Key: strconv.Itoa(trade.UserID), Payload: payload}
+		queues[trade.UserID] = append(queues[trade.UserID], streamTrade{entry, trade, event})
+	}
 
-			var stocks []struct {
-				Symbol   string  `json:"symbol"`
-				Quantity float64 `json:"quantity"`
-				Price    float64 `json:"price"`
+	held := make(map[string]bool)
+	for {
+		var round []streamTrade
+		for _, userID := range users {
+			if queue := queues[userID]; len(queue) > 0 {
+				round = append(round, queue[0])
 			}
-			err = json.Unmarshal([]byte(values["stocks"].(string)), &stocks)
-			if err != nil {
-				log.Printf("❌ Failed to parse stocks JSON: %v", err)
+		}
+		if len(round) == 0 {
+			break
+		}
+		failed := publishRound(ctx, round)
+		for _, st := range round {
+			queue := queues[st.trade.UserID]
+			if !failed[st.source.ID] {
+				queues[st.trade.UserID] = queue[1:]
 				continue
 			}
-
-			tradePayload := Trade{
-				UserID:  userID,
-				Action:  action,
-				Balance: balance,
-				Stocks:  stocks,
+			for _, later := range queue {
+				held[later.source.ID] = true
 			}
+			delete(queues, st.trade.UserID)
+		}
+	}
+	if len(held) == 0 {
+		return nil
+	}
+	var kept []Event
+	for _, entry := range entries {
+		if held[entry.ID] {
+			kept = append(kept, entry)
+		}
+	}
+	log.Printf("❌ %d stream entries held back after %d publish attempts", len(kept), maxAttempts)
+	return kept
+}
 
-			jsonPayload, err := json.Marshal(tradePayload)
+// publishRound publishes one entry per user, retrying failures up to
+// maxAttempts times, acks what was delivered and returns the ids of the
+// entries that never were.
+func publishRound(ctx context.Context, round []streamTrade) map[string]bool {
+	for attempt := 1; attempt <= maxAttempts && len(round) > 0; attempt++ {
+		if attempt > 1 {
+			time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+		}
+		pending := make([]Event, len(round))
+		for i, st := range round {
+			pending[i] = st.event
+		}
+		errs := eventBus().Publish(ctx, "trade_events", pending)
+		var delivered []Event
+		var retry []streamTrade
+		for i, err := range errs {
 			if err != nil {
-				log.Printf("❌ Failed to marshal tradePayload: %v", err)
+				log.Printf("⚠️ Attempt %d to publish stream entry %s failed: %v", attempt, round[i].source.ID, err)
+				retry = append(retry, round[i])
 				continue
 			}
-			err = producer.Produce(&kafka.Message{
-				TopicPartition: kafka.TopicPartition{Topic: ptr("trade_events"), Partition: kafka.PartitionAny},
-				Value:          jsonPayload,
-			}, nil)
-			if err != nil {
-				log.Printf("Kafka publish error %v", err)
-			}
-			_, err = redisClient.Client.XAck(context.Background(), "buy_stream", "kafka_workers", jobID).Result()
-			_, _ = redisClient.Client.XDel(context.Background(), "buy_stream", jobID).Result()
-			// if err != nil {
-			// 	log.Println("Error acknowledging job: ", err)
-			// } else {
-			// 	_, trimErr := redisClient.Client.XDel(context.Background(), "buy_stream", jobID).Result()
-			// 	if trimErr != nil {
-			// 		log.Println("Error trimming Redis stream:", trimErr)
-			// 	}else{
-			// 		log.Println("Successfully trimmed!")
-			// 	}
-			// }
+			orders.Record(ctx, round[i].trade.OrderID, orders.StagePublished, "")
+			delivered = append(delivered, round[i].source)
 		}
+		ackForwarded(delivered)
+		round = retry
 	}
-	return nil
+	failed := make(map[string]bool, len(round))
+	for _, st := range round {
+		failed[st.source.ID] = true
+	}
+	return failed
 }
 
-func StartKafkaProducer(workerCount int) {
-	initKafkaProducer()
-	for i := 1; i <= workerCount; i++ {
-		go processRedisStream(i)
+// forwardBatch is how many buy_stream entries the forwarder takes at once.
+const forwardBatch = 100
 
+// processRedisStream is the only kafka_workers consumer. Forwarding from one
+// reader keeps buy_stream order: readers sharing the group would get
+// disjoint ranges and publish them concurrently, so a user's later trade
+// could reach trade_events before an earlier one.
+func processRedisStream() {
+	for {
+		entries, err := streamBus.Subscribe(context.Background(), "buy_stream", "kafka_workers", forwardConsumer, forwardBatch, streamWait)
+		if err != nil {
+			log.Printf("❌ Failed to read buy_stream: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		if held := forwardEntries(entries); len(held) > 0 {
+			// read them again before anything newer once the bus recovers
+			if err := streamBus.Nack(context.Background(), "buy_stream", "kafka_workers", held); err != nil {
+				log.Printf("❌ Failed to rewind buy_stream: %v", err)
+			}
+			time.Sleep(time.Second)
+		}
 	}
-
-}
-func ptr(s string) *string {
-	return &s
 }
 
-// package workers
-
-// import (
-// 	"context"
-// 	"encoding/json"
-// 	"fmt"
-// 	"log"
-// 	"strconv"
-// 	"time"
-
-// 	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
-// 	redis "github.com/redis/go-redis/v9"
-
-// 	"trading-service/pkg/redisClient"
-// )
-
-// /* -------- data model -------- */
-
-
-// /* -------- kafka producer -------- */
-
-// var producer *kafka.Producer
-
-// func initKafkaProducer() {
-// 	if producer != nil {
-// 		return // already initialised
-// 	}
-// 	var err error
-// 	producer, err = kafka.NewProducer(&kafka.ConfigMap{
-// 		"bootstrap.servers": "localhost:9092", // adjust for your env
-// 	})
-// 	if err != nil {
-// 		log.Fatalf("❌ Failed to create Kafka producer: %v", err)
-// 	}
-// }
-
-// /* -------- redis‑stream worker -------- */
-
-// func processRedisStream(workerID int) {
-// 	ctx := context.Background()
-
-// 	for {
-// 		msgs, err := redisClient.Client.XReadGroup(ctx, &redis.XReadGroupArgs{
-// 			Group:    "kafka_workers",
-// 			Consumer: fmt.Sprintf("redisConsumer-%d", workerID),
-// 			Streams:  []string{"buy_stream", ">"}, // only new msgs; we always ack/del
-// 			Count:    10,
-// 			Block:    5 * time.Second,
-// 		}).Result()
-
-// 		switch {
-// 		case err == redis.Nil, len(msgs) == 0, len(msgs[0].Messages) == 0:
-// 			log.Printf("⚠️ Worker %d: no messages", workerID)
-// 			continue
-// 		case err != nil:
-// 			log.Printf("❌ Worker %d: XReadGroup error: %v", workerID, err)
-// 			continue
-// 		}
-
-// 		for _, m := range msgs[0].Messages {
-// 			handleMessage(ctx, m)
-// 		}
-// 	}
-// }
-
-// func handleMessage(ctx context.Context, m redis.XMessage) {
-// 	defer func() {
-// 		redisClient.Client.XAck(ctx, "buy_stream", "kafka_workers", m.ID)
-// 		redisClient.Client.XDel(ctx, "buy_stream", m.ID)
-// 	}()
-
-// 	/* ---- parse redis payload ---- */
-
-// 	vals := m.Values
-// 	userID, _ := strconv.Atoi(vals["user_id"].(string))
-// 	balance, _ := strconv.ParseFloat(vals["balance"].(string), 64)
-// 	action := vals["action"].(string)
-
-
-// 	type Stock struct {
-// 		Symbol   string  `json:"symbol"`
-// 		Quantity float64 `json:"quantity"`
-// 		Price    float64 `json:"price"`
-// 	}
-
-// 	type Trade struct {
-// 		UserID  int      `json:"user_id"`
-// 		Action  string   `json:"action"`
-// 		Balance float64  `json:"balance"`
-// 		Stocks  []Stock  `json:"stocks"`
-// 	}
-// 	var stocks []Stock
-// 	if err := json.Unmarshal([]byte(vals["stocks"].(string)), &stocks); err != nil {
-// 		log.Printf("❌ Bad stocks JSON for %s: %v", m.ID, err)
-// 		return
-// 	}
-
-// 	payload, err := json.Marshal(Trade{
-// 		UserID:  userID,
-// 		Action:  action,
-// 		Balance: balance,
-// 		Stocks:  stocks,
-// 	})
-// 	if err != nil {
-// 		log.Printf("❌ Marshal error for %s: %v", m.ID, err)
-// 		return
-// 	}
-
-// 	/* ---- publish to kafka ---- */
-
-// 	if err = producer.Produce(&kafka.Message{
-// 		TopicPartition: kafka.TopicPartition{Topic: ptr("trade_events"), Partition: kafka.PartitionAny},
-// 		Value:          payload,
-// 	}, nil); err != nil {
-// 		log.Printf("❌ Kafka publish error for %s: %v", m.ID, err)
-// 	}
-// }
-
-// /* -------- public entry point -------- */
-
-// func StartKafkaProducer(workerCount int) {
-// 	initKafkaProducer()
-// 	for i := 1; i <= workerCount; i++ {
-// 		go processRedisStream(i)
-// 	}
-// }
-
-// /* -------- helpers -------- */
-
-// func ptr(s string) *string { return &s }
+// StartKafkaProducer starts forwarding buy_stream to trade_events on the
+// configured event bus.
+func StartKafkaProducer() {
+	eventBus()
+	go processRedisStream()
+}
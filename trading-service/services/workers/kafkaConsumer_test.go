@@ -0,0 +1,156 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// useMemoryBuses runs buy_stream and trade_events on in-process buses.
+func useMemoryBuses(t *testing.T) (stream, trades *MemoryBus) {
+	t.Helper()
+	previousStream := streamBus
+	stream, trades = NewMemoryBus(), NewMemoryBus()
+	streamBus = stream
+	SetEventBus(trades)
+	t.Cleanup(func() {
+		streamBus = previousStream
+		SetEventBus(nil)
+	})
+	return stream, trades
+}
+
+// streamEntry is a buy_stream entry as the trade scripts write it.
+func streamEntry(userID, n int) Event {
+	fields := map[string]string{
+		"user_id":         strconv.Itoa(userID),
+		"action":          "BUY",
+		"balance":         fmt.Sprintf("%d.00", 10000-n),
+		"stocks":          `[{"symbol":"AAPL","quantity":"1","price":"1.00"}]`,
+		"order_id":        "0",
+		"idempotency_key": "",
+	}
+	payload, _ := json.Marshal(fields)
+	return Event{Key: fields["user_id"], Payload: payload}
+}
+
+// Forwarding several trades per user per batch loses none of them and
+// keeps each user's trades in execution order.
+func TestForwardEntriesKeepsEveryTradeInOrder(t *testing.T) {
+	stream, trades := useMemoryBuses(t)
+	ctx := context.Background()
+
+	const users, perUser = 20, 10
+	var entries []Event
+	for n := 0; n < perUser; n++ {
+		for user := 1; user <= users; user++ {
+			entries = append(entries, streamEntry(user, n))
+		}
+	}
+	for _, err := range stream.Publish(ctx, "buy_stream", entries) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for {
+		batch, err := stream.Subscribe(ctx, "buy_stream", "kafka_workers", "redisConsumer-1", forwardBatch, 10*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+		forwardEntries(batch)
+	}
+
+	published, err := trades.Subscribe(ctx, "trade_events", "postgres-writer", "postgres-writer-1", users*perUser+1, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(published) != users*perUser {
+		t.Fatalf("forwarded %d trades, want %d", len(published), users*perUser)
+	}
+	last := make(map[int]int)
+	for _, e := range published {
+		var trade Trade
+		if err := json.Unmarshal(e.Payload, &trade); err != nil {
+			t.Fatal(err)
+		}
+		if e.Key != strconv.Itoa(trade.UserID) {
+			t.Fatalf("trade of user %d keyed %q", trade.UserID, e.Key)
+		}
+		// memory bus ids count up in publish order
+		seq, _ := strconv.Atoi(trade.EventID)
+		if seq <= last[trade.UserID] {
+			t.Fatalf("user %d: trade %d forwarded after trade %d", trade.UserID, seq, last[trade.UserID])
+		}
+		last[trade.UserID] = seq
+	}
+	if pending := len(stream.topics["buy_stream"].groups["kafka_workers"].pending); pending != 0 {
+		t.Fatalf("%d forwarded entries left unacked", pending)
+	}
+}
+
+// failingBus fails every event published with key until failures run out.
+type failingBus struct {
+	*MemoryBus
+	key      string
+	failures int
+}
+
+func (b *failingBus) Publish(ctx context.Context, topic string, events []Event) []error {
+	var passed []Event
+	var index []int
+	errs := make([]error, len(events))
+	for i, e := range events {
+		if e.Key == b.key && b.failures > 0 {
+			b.failures--
+			errs[i] = fmt.Errorf("broker unavailable")
+			continue
+		}
+		passed = append(passed, e)
+		index = append(index, i)
+	}
+	for i, err := range b.MemoryBus.Publish(ctx, topic, passed) {
+		errs[index[i]] = err
+	}
+	return errs
+}
+
+// When a user's trade cannot be published their later trades are held back
+// with it instead of overtaking it; other users' trades still go out.
+func TestForwardEntriesHoldsLaterTradesOfFailedUser(t *testing.T) {
+	stream, trades := useMemoryBuses(t)
+	SetEventBus(&failingBus{MemoryBus: trades, key: "1", failures: maxAttempts})
+	ctx := context.Background()
+
+	stream.Publish(ctx, "buy_stream", []Event{streamEntry(1, 0), streamEntry(2, 0), streamEntry(1, 1), streamEntry(2, 1)})
+	batch, _ := stream.Subscribe(ctx, "buy_stream", "kafka_workers", "redisConsumer-1", forwardBatch, 10*time.Millisecond)
+	held := forwardEntries(batch)
+	if len(held) != 2 || held[0].ID != batch[0].ID || held[1].ID != batch[2].ID {
+		t.Fatalf("held %v, want both trades of user 1 in order", held)
+	}
+	published, _ := trades.Subscribe(ctx, "trade_events", "postgres-writer", "postgres-writer-1", 10, 10*time.Millisecond)
+	if len(published) != 2 || published[0].Key != "2" || published[1].Key != "2" {
+		t.Fatalf("published %v, want only the trades of user 2", payloads(published))
+	}
+
+	if held := forwardEntries(held); len(held) != 0 {
+		t.Fatalf("held %d entries once the bus recovered", len(held))
+	}
+	published, _ = trades.Subscribe(ctx, "trade_events", "postgres-writer", "postgres-writer-1", 10, 10*time.Millisecond)
+	if len(published) != 2 {
+		t.Fatalf("published %d trades after recovery, want 2", len(published))
+	}
+	for i, e := range published {
+		var trade Trade
+		json.Unmarshal(e.Payload, &trade)
+		if trade.UserID != 1 || trade.EventID != batch[i*2].ID {
+			t.Fatalf("trade %d after recovery is %s of user %d, want %s of user 1", i, trade.EventID, trade.UserID, batch[i*2].ID)
+		}
+	}
+}
@@ -4,123 +4,209 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"strings"
 	"time"
 
 	"trading-service/db"
-	"github.com/confluentinc/confluent-kafka-go/v2/kafka"
+	"trading-service/pkg/money"
+	"trading-service/pkg/shares"
+	"trading-service/services/orders"
+	trade_service "trading-service/services/trade"
 )
 
 type Trade struct {
-	UserID  int     `json:"user_id"`
-	Action  string  `json:"action"`
-	Balance float64 `json:"balance"`
-	Stocks  []struct {
-		Symbol   string  `json:"symbol"`
-		Quantity float64 `json:"quantity"`
-		Price    float64 `json:"price"`
-	} `json:"stocks"`
+	UserID  int         `json:"user_id"`
+	Action  string      `json:"action"`
+	Balance money.Money `json:"balance"`
+	OrderID int         `json:"order_id,omitempty"`
+	// IdempotencyKey lets the consumer drop replays of a trade it already
+	// persisted.
+	IdempotencyKey string                     `json:"idempotency_key,omitempty"`
+	Stocks         []trade_service.TradeStock `json:"stocks"`
+	// EventID is the buy_stream entry id the trade was executed as; each leg
+	// is stored in trades.event_id as "<id>:<leg>" so a redelivered trade is
+	// recognised and skipped.
+	EventID string `json:"event_id,omitempty"`
+}
+
+// legEventID is the trades.event_id of one leg of a stream entry.
+func legEventID(eventID string, leg int) string {
+	if eventID == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", eventID, leg)
+}
+
+// newerTrade is an SQL condition that holds when the user in userColumn has
+// a trade from a later buy_stream entry than the entry id in eventID. The
+// balance a trade carries is the user's balance right after it, so it is
+// only written while no newer trade is in Postgres: a replayed dead letter
+// must not put back the balance of an old trade.
+func newerTrade(userColumn, eventID string) string {
+	return fmt.Sprintf(`EXISTS (
+		SELECT 1 FROM trades newer
+		WHERE newer.user_id = %[1]s
+			AND CASE WHEN newer.event_id ~ '^[0-9]+-[0-9]+:' THEN
+				(split_part(newer.event_id, '-', 1)::bigint, split_part(split_part(newer.event_id, '-', 2), ':', 1)::bigint)
+					> (split_part(%[2]s, '-', 1)::bigint, split_part(%[2]s, '-', 2)::bigint)
+			END)`, userColumn, eventID)
 }
 
 var (
 	batchSize     = 2000
 	batchTimeout  = 50 * time.Millisecond
 	consumerTopic = "trade_events"
+	// how long a consumer waits before re-reading a batch that failed
+	batchRetryBackoff = time.Second
 )
 
-func processKafka(workerId int, db *sql.DB) error {
-	r, err := kafka.NewConsumer(&kafka.ConfigMap{
-		"bootstrap.servers": "localhost:9092",
-		"group.id":          "postgres-writer",
-		"auto.offset.reset": "earliest",
-		"enable.auto.commit": true,
-	})
-	if err != nil {
-		log.Fatalf("Failed to create Kafka Consumer: %v", err)
-	}
-	err = r.SubscribeTopics([]string{consumerTopic}, nil)
-	if err != nil {
-		log.Fatalf("Subscription Error: %v", err)
-	}
+// persistEvents writes a batch of trade_events to Postgres. Trades already
+// persisted under their idempotency key are dropped. On the last attempt a
+// failing batch is written one trade at a time and the trades that still
+// fail are dead-lettered, so the batch as a whole succeeds. Malformed events
+// are dead-lettered once the rest of the batch is in. An event that could
+// not be dead-lettered fails the batch, which is read again; what was
+// written meanwhile is skipped by event id.
+func persistEvents(db *sql.DB, events []Event, lastAttempt bool) error {
 	var batch []Trade
-	ticker := time.NewTicker(batchTimeout)
-	defer ticker.Stop()
-	// Before the for loop:
-	seenUsers := make(map[int]bool)
-
-	for {
-		event, err := r.ReadMessage(100 * time.Millisecond)
-		// log.Printf("✅ Kafka Message: %s", string(event))
-		if err == nil {
-			var t Trade
-			if err := json.Unmarshal(event.Value, &t); err != nil {
-				continue
-			}
-			if seenUsers[t.UserID] {
-				log.Printf("Skipping user %d (already in batch)", t.UserID)
+	var sources, malformed []Event
+	// idempotency keys already in the batch
+	batchKeys := make(map[string]bool)
+	for _, e := range events {
+		var t Trade
+		if err := json.Unmarshal(e.Payload, &t); err != nil {
+			malformed = append(malformed, e)
+			continue
+		}
+		if t.IdempotencyKey != "" {
+			batchKey := fmt.Sprintf("%d:%s", t.UserID, t.IdempotencyKey)
+			if batchKeys[batchKey] || orders.Consumed(context.Background(), t.UserID, t.IdempotencyKey) {
+				log.Printf("🔁 Dropping replayed trade for user %d (idempotency key %s)", t.UserID, t.IdempotencyKey)
 				continue
 			}
-			seenUsers[t.UserID] = true
-			batch = append(batch, t)
+			batchKeys[batchKey] = true
+		}
+		batch = append(batch, t)
+		sources = append(sources, e)
+	}
 
-			if len(batch) >= batchSize {
-				insertBatchToPostgres(db, batch)
-				batch = nil
-				seenUsers = make(map[int]bool)
+	err := insertBatchToPostgres(db, batch)
+	if err != nil && lastAttempt {
+		var errs []error
+		for i, t := range batch {
+			if tradeErr := insertBatchToPostgres(db, []Trade{t}); tradeErr != nil {
+				errs = append(errs, deadLetter(StageKafkaToSQL, sources[i], maxAttempts, tradeErr))
 			}
 		}
+		err = errors.Join(errs...)
+	}
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, e := range malformed {
+		errs = append(errs, deadLetter(StageKafkaToSQL, e, 1, fmt.Errorf("invalid trade payload: %s", e.Payload)))
+	}
+	return errors.Join(errs...)
+}
 
-		// flush once per second, only if there's something
-		select {
-		case <-ticker.C:
-			if len(batch) > 0 {
-				insertBatchToPostgres(db, batch)
-				batch = nil
-				seenUsers = make(map[int]bool)
+// processKafka writes trade_events to Postgres. It is the only
+// postgres-writer consumer, so batches come in order; each batch is split by
+// user over up to writers transactions at once. trade_events is keyed by
+// user id, so a user's trades are applied one after another in execution
+// order and the positions and balance written for them are the latest. A
+// batch is acked only once every shard is committed; otherwise it is nacked
+// and read again before anything newer, and trade event ids make the retry
+// skip what the committed shards already wrote.
+func processKafka(writers int, db *sql.DB) {
+	bus := eventBus()
+	ctx := context.Background()
+	// consecutive failed attempts at a batch
+	failures := 0
+	for {
+		batch, err := bus.Subscribe(ctx, consumerTopic, "postgres-writer", writerConsumer, batchSize, batchTimeout)
+		if err != nil {
+			log.Printf("❌ Failed to read %s: %v", consumerTopic, err)
+			time.Sleep(batchRetryBackoff)
+			continue
+		}
+		if len(batch) == 0 {
+			continue
+		}
+		lastAttempt := failures+1 >= maxAttempts
+		err = inShards(batch, writers, func(shard []Event) error {
+			return persistEvents(db, shard, lastAttempt)
+		})
+		if err != nil {
+			failures++
+			if err := bus.Nack(ctx, consumerTopic, "postgres-writer", batch); err != nil {
+				log.Printf("❌ Failed to rewind %s: %v", consumerTopic, err)
 			}
-		default:
-			// nothing to do
+			time.Sleep(batchRetryBackoff)
+			continue
+		}
+		failures = 0
+		// an unacked batch is only redelivered and skipped as already persisted
+		if err := bus.Ack(ctx, consumerTopic, "postgres-writer", batch); err != nil {
+			log.Printf("⚠️ Failed to ack %s: %v", consumerTopic, err)
 		}
 	}
+}
 
-	// for {
-	// 	select {
-	// 	case <-ticker.C:
-	// 		if len(batch) > 0 {
-	// 			insertBatchToPostgres(db, batch)
-	// 			batch = nil
-	// 		}
-	// 	default:
-	// 		event, err := r.ReadMessage(10 * time.Millisecond)
-	// 		if err != nil {
-	// 			continue
-	// 		}
-	// 		var trade Trade
-	// 		// log.Printf("🔥 RAW Kafka payload: %s", string(event.Value))
-	// 		err = json.Unmarshal(event.Value, &trade)
-	// 		if err != nil {
-	// 			log.Println("Invalid Trade Payload", err)
-	// 			continue
-	// 		}
-
-	// 		batch = append(batch, trade)
+// positionKey identifies one row of the positions table.
+type positionKey struct {
+	userID int
+	symbol string
+}
 
-	// 		if len(batch) >= batchSize {
-	// 			err := insertBatchToPostgres(db, batch)
-	// 			if err != nil {
-	// 				log.Printf("Failed to insert Batch %v, err")
-	// 			}
-	// 			batch = nil
-	// 		}
+// position is a holding as it stands while a batch is being applied.
+type position struct {
+	quantity     shares.Quantity
+	averagePrice money.Money
+}
 
-	// 	}
+// lockPositions loads and locks the current positions of users.
+func lockPositions(ctx context.Context, tx *sql.Tx, users []int) (map[positionKey]position, error) {
+	var placeholders []string
+	var args []interface{}
+	for _, userID := range users {
+		args = append(args, userID)
+		placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+	}
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(`
+		SELECT user_id, symbol, quantity, average_price
+		FROM positions
+		WHERE user_id IN (%s)
+		ORDER BY user_id, symbol
+		FOR UPDATE`, strings.Join(placeholders, ",")), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	// }
+	held := make(map[positionKey]position)
+	for rows.Next() {
+		var key positionKey
+		var p position
+		if err := rows.Scan(&key.userID, &key.symbol, &p.quantity, &p.averagePrice); err != nil {
+			return nil, err
+		}
+		held[key] = p
+	}
+	return held, rows.Err()
 }
+
+// upsertBalancePositionsAndTradeHistory persists a batch in one transaction.
+// A user may have many trades in a batch, so their positions are locked and
+// the trades are applied in batch order in Go; a single SQL upsert can only
+// change each row once. The user's balance is the one from their last trade,
+// unless a newer trade of theirs is already in Postgres.
+// Trades whose event id is already in trades are skipped, so a redelivered
+// batch changes nothing.
 func upsertBalancePositionsAndTradeHistory(db *sql.DB, trades []Trade) error {
-	fmt.Printf("Starting")
 	if len(trades) == 0 {
 		return nil
 	}
@@ -131,40 +217,153 @@ func upsertBalancePositionsAndTradeHistory(db *sql.DB, trades []Trade) error {
 		return err
 	}
 	var insert_trades []string
-	var positions []string
 	var args []interface{}
+	for _, trade := range trades {
+		side := trade_service.TradeType(trade.Action)
+		for leg, stock := range trade.Stocks {
+			pos := len(args) + 1
+			insert_trades = append(insert_trades, fmt.Sprintf(" ($%d, $%d, $%d, $%d, $%d::trade_type_enum, NULLIF($%d, '')) ", pos, pos+1, pos+2, pos+3, pos+4, pos+5))
+			args = append(args, trade.UserID, stock.Symbol, stock.Quantity, stock.Price, side, legEventID(trade.EventID, leg))
+		}
+	}
+	if len(insert_trades) == 0 {
+		tx.Rollback()
+		return fmt.Errorf("no valid inserts/upserts")
+	}
+	final_trades := fmt.Sprintf(`
+		INSERT INTO trades (user_id, symbol, quantity, executed_price, trade_type, event_id)
+		VALUES %s
+		ON CONFLICT (event_id) DO NOTHING
+		RETURNING COALESCE(event_id, '')`, strings.Join(insert_trades, ", "))
+	rows, err := tx.QueryContext(ctx, final_trades, args...)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	inserted := make(map[string]bool)
+	for rows.Next() {
+		var eventID string
+		if err := rows.Scan(&eventID); err != nil {
+			rows.Close()
+			tx.Rollback()
+			return err
+		}
+		inserted[eventID] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// a trade's legs are written together, so a trade whose first leg
+	// already existed was persisted by an earlier delivery
+	var fresh []Trade
+	for _, trade := range trades {
+		if trade.EventID == "" || inserted[legEventID(trade.EventID, 0)] {
+			fresh = append(fresh, trade)
+		}
+	}
+	if skipped := len(trades) - len(fresh); skipped > 0 {
+		log.Printf("🔁 Skipping %d already persisted trades", skipped)
+	}
+	if len(fresh) == 0 {
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		countPersisted(ModeKafka, 0, len(trades))
+		return nil
+	}
+	duplicates := len(trades) - len(fresh)
+	trades = fresh
+
+	var users []int
+	balances := make(map[int]money.Money)
+	// the entry id of each user's last trade in the batch
+	lastEvents := make(map[int]string)
+	for _, trade := range trades {
+		if _, ok := balances[trade.UserID]; !ok {
+			users = append(users, trade.UserID)
+		}
+		balances[trade.UserID] = trade.Balance
+		lastEvents[trade.UserID] = trade.EventID
+	}
+
+	held, err := lockPositions(ctx, tx, users)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	var changed []positionKey
+	touched := make(map[positionKey]bool)
+	for _, trade := range trades {
+		side := trade_service.TradeType(trade.Action)
+		for _, stock := range trade.Stocks {
+			key := positionKey{trade.UserID, stock.Symbol}
+			p := held[key]
+			if side == "SELL" {
+				p.quantity -= stock.Quantity
+			} else {
+				p.averagePrice = money.WeightedAverage(p.quantity, p.averagePrice, stock.Quantity, stock.Price)
+				p.quantity += stock.Quantity
+			}
+			held[key] = p
+			if !touched[key] {
+				touched[key] = true
+				changed = append(changed, key)
+			}
+		}
+	}
+
+	var positions []string
+	var sold []string
+	var position_args []interface{}
+	var sold_args []interface{}
+	for _, key := range changed {
+		p := held[key]
+		if p.quantity > 0 {
+			pos := len(position_args) + 1
+			positions = append(positions, fmt.Sprintf("($%d, $%d, $%d, $%d)", pos, pos+1, pos+2, pos+3))
+			position_args = append(position_args, key.userID, key.symbol, p.quantity, p.averagePrice)
+			continue
+		}
+		if p.quantity < 0 {
+			log.Printf("⚠️ User %d sold more %s than Postgres holds, dropping the position", key.userID, key.symbol)
+		}
+		pos := len(sold_args) + 1
+		sold = append(sold, fmt.Sprintf("($%d::int, $%d::varchar)", pos, pos+1))
+		sold_args = append(sold_args, key.userID, key.symbol)
+	}
+
 	var (
 		statement    strings.Builder
 		whereIn      []string
 		balance_args []interface{}
 	)
-	for i, trade := range trades {
-		pos := i*2 + 1
-		statement.WriteString(fmt.Sprintf("When id = $%d THEN $%d ", pos, pos+1))
+	for _, userID := range users {
+		pos := len(balance_args) + 1
 		whereIn = append(whereIn, fmt.Sprintf("$%d", pos))
-		balance_args = append(balance_args, trade.UserID, trade.Balance)
-		for _, stock := range trade.Stocks {
-			pos = len(args) + 1
-			insert_trades = append(insert_trades, fmt.Sprintf(" ($%d, $%d, $%d, $%d, 'BUY') ", pos, pos+1, pos+2, pos+3))
-			positions = append(positions, fmt.Sprintf("($%d, $%d, $%d, $%d)", pos, pos+1, pos+2, pos+3))
-			args = append(args, trade.UserID, stock.Symbol, stock.Quantity, stock.Price)
+		balance_args = append(balance_args, userID, balances[userID])
+		if lastEvents[userID] == "" {
+			statement.WriteString(fmt.Sprintf("When id = $%d THEN $%d ", pos, pos+1))
+			continue
 		}
+		balance_args = append(balance_args, lastEvents[userID])
+		statement.WriteString(fmt.Sprintf("When id = $%d AND NOT %s THEN $%d ", pos, newerTrade("users.id", fmt.Sprintf("$%d::text", pos+2)), pos+1))
 	}
-	if len(insert_trades) == 0 || len(positions) == 0 {
-		return fmt.Errorf("no valid inserts/upserts")
-	}
-	final_trades := fmt.Sprintf(`
-		INSERT INTO trades (user_id, symbol, quantity, executed_price, trade_type)
-		VALUES %s`, strings.Join(insert_trades, ", "))
 
-	insert_update_positions := fmt.Sprintf(
-		`Insert INTO positions (user_id, symbol, quantity, average_price)
+	upsert_positions := fmt.Sprintf(`
+		INSERT INTO positions (user_id, symbol, quantity, average_price)
 		VALUES %s
 		ON CONFLICT(user_id, symbol)
 		DO UPDATE SET
-			quantity = positions.quantity + EXCLUDED.quantity,
-			average_price = ((positions.quantity * positions.average_price) + (EXCLUDED.quantity * EXCLUDED.average_price))/ (positions.quantity + EXCLUDED.quantity),
-			updated_at = CURRENT_TIMESTAMP;`, strings.Join(positions, ", "))
+			quantity = EXCLUDED.quantity,
+			average_price = EXCLUDED.average_price,
+			updated_at = CURRENT_TIMESTAMP`, strings.Join(positions, ", "))
+	delete_positions := fmt.Sprintf(`
+		DELETE FROM positions
+		USING (VALUES %s) AS sold(user_id, symbol)
+		WHERE positions.user_id = sold.user_id AND positions.symbol = sold.symbol`, strings.Join(sold, ", "))
 	query := fmt.Sprintf(`
 			UPDATE users
 			SET balance = CASE
@@ -173,45 +372,62 @@ func upsertBalancePositionsAndTradeHistory(db *sql.DB, trades []Trade) error {
 			END
 			WHERE id IN (%s)
 		`, statement.String(), strings.Join(whereIn, ","))
-	_, err = tx.ExecContext(ctx, final_trades, args...)
-	if err != nil {
-		tx.Rollback()
-		return err
+	if len(positions) > 0 {
+		_, err = tx.ExecContext(ctx, upsert_positions, position_args...)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
 	}
-	_, err = tx.ExecContext(ctx, insert_update_positions, args...)
-	if err != nil {
-		tx.Rollback()
-		return err
+	if len(sold) > 0 {
+		_, err = tx.ExecContext(ctx, delete_positions, sold_args...)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
 	}
 	_, err = tx.ExecContext(ctx, query, balance_args...)
 	if err != nil {
 		tx.Rollback()
-		fmt.Printf("Failed to insert/update positions: %v\n", err) // Log exact failure
+		log.Printf("❌ Failed to update balances: %v", err)
 		return err
 	}
 	err = tx.Commit()
 	if err != nil {
 		tx.Rollback()
-		log.Printf("Transaction cimmit failed: %v\n", err)
+		log.Printf("❌ Failed to commit trade batch: %v", err)
 		return err
 	}
+	countPersisted(ModeKafka, len(trades), duplicates)
 	return nil
 }
 func insertBatchToPostgres(db *sql.DB, trades []Trade) error {
+	orderIDs := make([]int, 0, len(trades))
+	for _, trade := range trades {
+		orderIDs = append(orderIDs, trade.OrderID)
+	}
 	err := upsertBalancePositionsAndTradeHistory(db, trades)
 	if err != nil {
 		log.Printf("Error upserting balance, positions, and trade history %v", err)
+		orders.RecordBatch(context.Background(), orderIDs, orders.StagePersisted, err)
 		return err
 	}
+	orders.RecordBatch(context.Background(), orderIDs, orders.StagePersisted, nil)
+	consumed := make(map[int][]string)
+	for _, trade := range trades {
+		if trade.IdempotencyKey != "" {
+			consumed[trade.UserID] = append(consumed[trade.UserID], trade.IdempotencyKey)
+		}
+	}
+	orders.MarkConsumed(context.Background(), consumed)
 	return nil
 
 }
-func StartKafkaConsumer(workerCount int, db *sql.DB) {
-	for i := 1; i <= workerCount; i++ {
-		go func(id int) {
-			processKafka(id, db)
-		}(i)
-	}
+
+// StartKafkaConsumer starts writing trade_events to Postgres with up to
+// writers transactions at once.
+func StartKafkaConsumer(writers int, db *sql.DB) {
+	go processKafka(writers, db)
 }
 func getExecutedTradeCountFromDB() int {
 	row := db.DB.QueryRow("SELECT COUNT(*) FROM trades")
@@ -222,80 +438,3 @@ func getExecutedTradeCountFromDB() int {
 	}
 	return count
 }
-
-
-// func updateBalances(db *sql.DB, trades []Trade) error {
-// 	if len(trades) == 0 {
-// 		return nil
-// 	}
-// 	var (
-// 		statement strings.Builder
-// 		whereIn   []string
-// 		args      []interface{}
-// 	)
-// 	for i, trade := range trades {
-// 		pos := i*2 + 1
-// 		statement.WriteString(fmt.Sprintf("When id = $%d THEN $%d ", pos, pos+1))
-// 		whereIn = append(whereIn, fmt.Sprintf("$%d", pos))
-// 		args = append(args, trade.UserID, trade.Balance)
-
-// 	}
-
-// 	query := fmt.Sprintf(`
-// 		UPDATE users
-// 		SET balance = CASE
-// 			%s
-// 			ELSE balance
-// 		END
-// 		WHERE id IN (%s)
-// 	`, statement.String(), strings.Join(whereIn, ","))
-
-// 	_, err := db.Exec(query, args...)
-// 	return err
-// }
-// func insertTradeToPostgres(ctx context.Context, db *sql.DB, trade Trade) error {
-// 	tx, err := db.BeginTx(ctx, nil)
-// 	trade.Balance
-// 	_, err := tx.ExecContext(ctx, "Update USERS SET balance = balance - $1 WHERE id = $2", totalCost, userId)
-// 	if err != nil {
-// 		return fmt.Errorf("error updating user: %w", err)
-// 	}
-// 	var trades []string
-// 	var positions []string
-// 	var args []interface{}
-// 	for _, stock := range stockData.Stock {
-// 		price, _ := redis.GetStockPrice(stock.Symbol)
-
-// 		trades = append(trades, fmt.Sprintf(" ($%d, $%d, $%d, $%d, 'BUY') ", len(args)+1, len(args)+2, len(args)+3, len(args)+4))
-// 		positions = append(positions, fmt.Sprintf("($%d, $%d, $%d, $%d)", len(args)+1, len(args)+2, len(args)+3, len(args)+4))
-// 		args = append(args, userId, stock.Symbol, stock.Quantity, price.Price)
-// 	}
-// 	if len(trades) == 0 {
-// 		return fmt.Errorf("no valid inserts")
-// 	}
-// 	if len(positions) == 0 {
-// 		return fmt.Errorf("no valid position to insert")
-// 	}
-// 	insert_trades := fmt.Sprintf(`
-// 		INSERT INTO trades (user_id, symbol, quantity, executed_price, trade_type)
-// 		VALUES %s`, strings.Join(trades, ", "))
-// 	_, err = tx.ExecContext(ctx, insert_trades, args...)
-// 	if err != nil {
-// 		return fmt.Errorf("failed to insert trades")
-// 	}
-
-//		insert_update_positions := fmt.Sprintf(
-//			`Insert INTO positions (user_id, symbol, quantity, average_price)
-//			VALUES %s
-//			ON CONFLICT(user_id, symbol)
-//	        DO UPDATE SET
-//	            quantity = positions.quantity + EXCLUDED.quantity,
-//	            average_price = ((positions.quantity * positions.average_price) + (EXCLUDED.quantity * EXCLUDED.average_price))/ (positions.quantity + EXCLUDED.quantity),
-//	            updated_at = CURRENT_TIMESTAMP;`, strings.Join(positions, ", "))
-//		_, err = tx.ExecContext(ctx, insert_update_positions, args...)
-//		if err != nil {
-//			fmt.Printf("Failed to insert/update positions: %v\n", err) // Log exact failure
-//			return fmt.Errorf("Failed to insert/update positions: %v", err)
-//		}
-//		return nil
-//	}
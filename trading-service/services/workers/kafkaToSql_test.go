@@ -0,0 +1,161 @@
+package workers
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"trading-service/pkg/money"
+	"trading-service/pkg/redisClient"
+	"trading-service/pkg/shares"
+	trade_service "trading-service/services/trade"
+
+	_ "github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
+)
+
+// useTestDB connects to the Postgres database in DB_HOST, DB_PORT, DB_USER,
+// DB_PASSWORD and DB_DATABASE, loaded with db.sql, or skips the test when
+// none is configured.
+func useTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	if os.Getenv("DB_HOST") == "" {
+		t.Skip("DB_HOST is not set")
+	}
+	db, err := sql.Open("postgres", fmt.Sprintf(
+		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		os.Getenv("DB_HOST"),
+		os.Getenv("DB_PORT"),
+		os.Getenv("DB_USER"),
+		os.Getenv("DB_PASSWORD"),
+		os.Getenv("DB_DATABASE"),
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		t.Skipf("Postgres is not available: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// createTestUser inserts a user that is deleted, with their trades and
+// positions, when the test ends.
+func createTestUser(t *testing.T, db *sql.DB) int {
+	t.Helper()
+	name := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	var id int
+	err := db.QueryRow(`
+		INSERT INTO users (username, email, password_hash)
+		VALUES ($1, $1 || '@example.com', 'x')
+		RETURNING id`, name).Scan(&id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec(`DELETE FROM trades WHERE user_id = $1`, id)
+		db.Exec(`DELETE FROM users WHERE id = $1`, id)
+	})
+	return id
+}
+
+func testTrade(t *testing.T, userID int, eventID, action, balance, symbol, quantity, price string) Trade {
+	t.Helper()
+	b, err := money.Parse(balance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q, err := shares.Parse(quantity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := money.Parse(price)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Trade{
+		UserID:  userID,
+		Action:  action,
+		Balance: b,
+		EventID: eventID,
+		Stocks:  []trade_service.TradeStock{{Symbol: symbol, Quantity: q, Price: p}},
+	}
+}
+
+// A batch with several trades per user applies every one of them in order,
+// and delivering it again changes nothing.
+func TestUpsertAppliesSeveralTradesPerUser(t *testing.T) {
+	db := useTestDB(t)
+	users := []int{createTestUser(t, db), createTestUser(t, db), createTestUser(t, db)}
+
+	var batch []Trade
+	steps := []struct{ action, balance, symbol, quantity, price string }{
+		{"BUY", "9800.00", "AAPL", "2", "100.00"},
+		{"BUY", "9670.00", "AAPL", "1", "130.00"},
+		{"SELL", "9950.00", "AAPL", "2", "140.00"},
+		{"BUY", "9920.00", "MSFT", "3", "10.00"},
+	}
+	for i, step := range steps {
+		// interleave the users' trades the way the stream does
+		for _, userID := range users {
+			eventID := fmt.Sprintf("%d-%d", userID, i)
+			batch = append(batch, testTrade(t, userID, eventID, step.action, step.balance, step.symbol, step.quantity, step.price))
+		}
+	}
+
+	for delivery := 1; delivery <= 2; delivery++ {
+		if err := upsertBalancePositionsAndTradeHistory(db, batch); err != nil {
+			t.Fatalf("delivery %d: %v", delivery, err)
+		}
+		for _, userID := range users {
+			var count int
+			var balance money.Money
+			db.QueryRow(`SELECT COUNT(*) FROM trades WHERE user_id = $1`, userID).Scan(&count)
+			db.QueryRow(`SELECT balance FROM users WHERE id = $1`, userID).Scan(&balance)
+			if count != len(steps) {
+				t.Fatalf("delivery %d: user %d has %d trades, want %d", delivery, userID, count, len(steps))
+			}
+			if balance.String() != "9920.00" {
+				t.Fatalf("delivery %d: user %d has balance %s, want 9920.00", delivery, userID, balance)
+			}
+			held := make(map[string]string)
+			rows, err := db.Query(`SELECT symbol, quantity, average_price FROM positions WHERE user_id = $1`, userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for rows.Next() {
+				var symbol string
+				var quantity shares.Quantity
+				var average money.Money
+				if err := rows.Scan(&symbol, &quantity, &average); err != nil {
+					t.Fatal(err)
+				}
+				held[symbol] = quantity.String() + "@" + average.String()
+			}
+			rows.Close()
+			if want := "map[AAPL:1@110.00 MSFT:3@10.00]"; fmt.Sprint(held) != want {
+				t.Fatalf("delivery %d: user %d holds %v, want %s", delivery, userID, held, want)
+			}
+		}
+	}
+}
+
+// An event that cannot be dead-lettered fails the batch, so it is nacked and
+// read again rather than acked and lost.
+func TestPersistEventsFailsWhenDeadLetteringFails(t *testing.T) {
+	previous := redisClient.Client
+	redisClient.Client = redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	t.Cleanup(func() {
+		redisClient.Client.Close()
+		redisClient.Client = previous
+	})
+
+	err := persistEvents(nil, []Event{{ID: "0/1", Payload: []byte("not a trade")}}, true)
+	if err == nil {
+		t.Fatal("the batch succeeded although its malformed event was not dead-lettered")
+	}
+}
@@ -0,0 +1,158 @@
+package workers
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MemoryBus is an in-process EventBus for tests and single-node deployments.
+// Nothing survives a restart. A group only receives events published after
+// it first subscribed, except that the first group on a topic also gets
+// everything published before anyone subscribed. Consumers of one group
+// take events off the group's queue in turn.
+type MemoryBus struct {
+	mutex  sync.Mutex
+	topics map[string]*memoryTopic
+	// wake is closed and replaced whenever events become available
+	wake chan struct{}
+	seq  int64
+}
+
+type memoryTopic struct {
+	unclaimed []Event
+	groups    map[string]*memoryGroup
+}
+
+type memoryGroup struct {
+	queue   []Event
+	pending map[string]Event
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{
+		topics: make(map[string]*memoryTopic),
+		wake:   make(chan struct{}),
+	}
+}
+
+func (b *MemoryBus) topic(name string) *memoryTopic {
+	t, ok := b.topics[name]
+	if !ok {
+		t = &memoryTopic{groups: make(map[string]*memoryGroup)}
+		b.topics[name] = t
+	}
+	return t
+}
+
+func (b *MemoryBus) group(topic, name string) *memoryGroup {
+	t := b.topic(topic)
+	g, ok := t.groups[name]
+	if !ok {
+		g = &memoryGroup{pending: make(map[string]Event)}
+		if len(t.groups) == 0 {
+			g.queue, t.unclaimed = t.unclaimed, nil
+		}
+		t.groups[name] = g
+	}
+	return g
+}
+
+// notify wakes every waiting subscriber; the caller holds the mutex.
+func (b *MemoryBus) notify() {
+	close(b.wake)
+	b.wake = make(chan struct{})
+}
+
+func (b *MemoryBus) Publish(ctx context.Context, topic string, events []Event) []error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	t := b.topic(topic)
+	for _, e := range events {
+		b.seq++
+		e.ID = strconv.FormatInt(b.seq, 10)
+		if len(t.groups) == 0 {
+			t.unclaimed = append(t.unclaimed, e)
+			continue
+		}
+		for _, g := range t.groups {
+			g.queue = append(g.queue, e)
+		}
+	}
+	b.notify()
+	return make([]error, len(events))
+}
+
+func (b *MemoryBus) Subscribe(ctx context.Context, topic, group, consumer string, max int, wait time.Duration) ([]Event, error) {
+	timeout := time.NewTimer(wait)
+	defer timeout.Stop()
+	for {
+		b.mutex.Lock()
+		g := b.group(topic, group)
+		if len(g.queue) > 0 {
+			n := max
+			if n > len(g.queue) {
+				n = len(g.queue)
+			}
+			batch := append([]Event(nil), g.queue[:n]...)
+			g.queue = g.queue[n:]
+			for _, e := range batch {
+				g.pending[e.ID] = e
+			}
+			b.mutex.Unlock()
+			return batch, nil
+		}
+		wake := b.wake
+		b.mutex.Unlock()
+
+		select {
+		case <-wake:
+		case <-timeout.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (b *MemoryBus) Ack(ctx context.Context, topic, group string, events []Event) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	g := b.group(topic, group)
+	for _, e := range events {
+		delete(g.pending, e.ID)
+	}
+	return nil
+}
+
+// Nack puts events back at the front of the group's queue, in order.
+func (b *MemoryBus) Nack(ctx context.Context, topic, group string, events []Event) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	g := b.group(topic, group)
+	var again []Event
+	for _, e := range events {
+		if _, ok := g.pending[e.ID]; ok {
+			delete(g.pending, e.ID)
+			again = append(again, e)
+		}
+	}
+	g.queue = append(again, g.queue...)
+	b.notify()
+	return nil
+}
+
+func (b *MemoryBus) Backlog(ctx context.Context, topic, group string) (int64, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	t := b.topic(topic)
+	if g, ok := t.groups[group]; ok {
+		return int64(len(g.queue) + len(g.pending)), nil
+	}
+	// the first group to subscribe takes what was published before it
+	if len(t.groups) == 0 {
+		return int64(len(t.unclaimed)), nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,136 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// publishKeyed publishes one event per payload, keyed by the payload's
+// first letter.
+func publishKeyed(t *testing.T, bus EventBus, topic string, payloads ...string) {
+	t.Helper()
+	events := make([]Event, len(payloads))
+	for i, payload := range payloads {
+		events[i] = Event{Key: payload[:1], Payload: []byte(payload)}
+	}
+	for _, err := range bus.Publish(context.Background(), topic, events) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func payloads(events []Event) []string {
+	out := make([]string, len(events))
+	for i, e := range events {
+		out[i] = string(e.Payload)
+	}
+	return out
+}
+
+// A nacked batch comes back to its consumer before anything published after
+// it, in the order it was first delivered.
+func TestMemoryBusNackRedeliversBeforeNewer(t *testing.T) {
+	ctx := context.Background()
+	bus := NewMemoryBus()
+	publishKeyed(t, bus, "topic", "a1", "b1", "a2")
+
+	first, err := bus.Subscribe(ctx, "topic", "group", "c1", 10, time.Second)
+	if err != nil || len(first) != 3 {
+		t.Fatalf("got %v, %v; want 3 events", payloads(first), err)
+	}
+	publishKeyed(t, bus, "topic", "a3")
+	if err := bus.Nack(ctx, "topic", "group", first); err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := bus.Subscribe(ctx, "topic", "group", "c1", 10, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"a1", "b1", "a2", "a3"}
+	if got := payloads(again); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("after nack got %v, want %v", got, want)
+	}
+	if err := bus.Ack(ctx, "topic", "group", again); err != nil {
+		t.Fatal(err)
+	}
+	if rest, _ := bus.Subscribe(ctx, "topic", "group", "c1", 10, 10*time.Millisecond); len(rest) != 0 {
+		t.Fatalf("acked events delivered again: %v", payloads(rest))
+	}
+}
+
+// Every group gets every event; a group created later only gets what was
+// published after it subscribed.
+func TestMemoryBusGroups(t *testing.T) {
+	ctx := context.Background()
+	bus := NewMemoryBus()
+	publishKeyed(t, bus, "topic", "a1")
+	early, _ := bus.Subscribe(ctx, "topic", "early", "c", 10, time.Second)
+	publishKeyed(t, bus, "topic", "b1")
+	late, _ := bus.Subscribe(ctx, "topic", "late", "c", 10, 10*time.Millisecond)
+	more, _ := bus.Subscribe(ctx, "topic", "early", "c", 10, time.Second)
+
+	if len(early) != 1 || len(more) != 1 {
+		t.Fatalf("first group got %v then %v", payloads(early), payloads(more))
+	}
+	if len(late) != 0 {
+		t.Fatalf("late group got events from before it subscribed: %v", payloads(late))
+	}
+}
+
+// inShards hands each key's events to one goroutine, in order.
+func TestInShardsKeepsKeyOrder(t *testing.T) {
+	const keys = 37
+	var events []Event
+	for i := 0; i < 1000; i++ {
+		events = append(events, Event{Key: strconv.Itoa(i % keys), ID: strconv.Itoa(i)})
+	}
+	var mutex sync.Mutex
+	seen := make(map[string][]string)
+	err := inShards(events, 8, func(shard []Event) error {
+		for _, e := range shard {
+			mutex.Lock()
+			seen[e.Key] = append(seen[e.Key], e.ID)
+			mutex.Unlock()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, ids := range seen {
+		k, _ := strconv.Atoi(key)
+		for i, id := range ids {
+			if want := strconv.Itoa(i*keys + k); id != want {
+				t.Fatalf("key %s: event %d is %s, want %s", key, i, id, want)
+			}
+		}
+	}
+	if len(seen) != keys {
+		t.Fatalf("got %d keys, want %d", len(seen), keys)
+	}
+}
+
+// A group's backlog counts what it has read but not acked as well as what it
+// has not read yet.
+func TestMemoryBusBacklog(t *testing.T) {
+	ctx := context.Background()
+	bus := NewMemoryBus()
+	publishKeyed(t, bus, "topic", "a1", "b1", "a2")
+	backlog := func(want int64) {
+		t.Helper()
+		if got, err := bus.Backlog(ctx, "topic", "group"); err != nil || got != want {
+			t.Fatalf("backlog %d, %v; want %d", got, err, want)
+		}
+	}
+	backlog(3)
+	read, _ := bus.Subscribe(ctx, "topic", "group", "c", 2, time.Second)
+	backlog(3)
+	bus.Ack(ctx, "topic", "group", read)
+	backlog(1)
+}
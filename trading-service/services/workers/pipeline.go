@@ -0,0 +1,213 @@
+package workers
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"strings"
+	"sync"
+
+	"trading-service/pkg/redisClient"
+)
+
+// Persistence modes: how executed trades get from buy_stream to Postgres.
+const (
+	// ModeDirect has the sql_workers group write buy_stream straight to SQL.
+	ModeDirect = "direct"
+	// ModeKafka forwards buy_stream to trade_events with kafka_workers and
+	// writes trade_events to SQL in batches.
+	ModeKafka = "kafka"
+	// ModeBoth runs both paths side by side for shadow comparison. Trade
+	// event ids make whichever path is second skip the trade; both write a
+	// trade's balance with its trade rows and apply a user's trades in
+	// order, so the balance left is that of the user's latest trade either
+	// way. PersistenceStats shows how the work split between them.
+	ModeBoth = "both"
+)
+
+// PipelineConfig selects the persistence mode and its worker counts.
+type PipelineConfig struct {
+	Mode         string
+	KafkaWriters int // transactions writing trade_events at once
+	SQLWorkers   int // goroutines writing buy_stream entries at once
+}
+
+// pipelineGroups are the buy_stream groups each mode reads with.
+var pipelineGroups = map[string][]string{
+	ModeDirect: {"sql_workers"},
+	ModeKafka:  {"kafka_workers"},
+	ModeBoth:   {"kafka_workers", "sql_workers"},
+}
+
+// StartPersistence validates cfg, makes sure buy_stream has exactly the
+// groups the mode reads with, and starts the workers for it.
+func StartPersistence(cfg PipelineConfig, db *sql.DB) error {
+	if cfg.Mode == "" {
+		cfg.Mode = ModeKafka
+	}
+	groups, ok := pipelineGroups[cfg.Mode]
+	if !ok {
+		return fmt.Errorf("unknown persistence mode %q, want %s, %s or %s", cfg.Mode, ModeDirect, ModeKafka, ModeBoth)
+	}
+	if db == nil {
+		return fmt.Errorf("persistence needs a database connection")
+	}
+	if err := ensureStreamGroups(groups); err != nil {
+		return err
+	}
+	persistenceMutex.Lock()
+	persistenceMode = cfg.Mode
+	persistenceMutex.Unlock()
+
+	if cfg.Mode != ModeDirect {
+		StartKafkaProducer()
+		StartKafkaConsumer(cfg.KafkaWriters, db)
+	}
+	if cfg.Mode != ModeKafka {
+		go StartSQLWorkerPool(cfg.SQLWorkers, db)
+	}
+	log.Printf("✅ Persistence pipeline running in %s mode (buy_stream groups: %s)", cfg.Mode, strings.Join(groups, ", "))
+	return nil
+}
+
+// ErrUndrained is returned by Drained while executed trades are still on
+// their way to Postgres.
+var ErrUndrained = errors.New("trades are still on their way to Postgres")
+
+// Drained returns ErrUndrained unless Postgres has every executed trade: no
+// buy_stream group has entries pending or unread and, unless trades are
+// written by sql_workers alone, postgres-writer has nothing left on
+// trade_events. kafka_workers acks an entry once it is on trade_events,
+// before it is written, so buy_stream alone can look drained while Postgres
+// is behind. A backlog that cannot be read counts as not drained.
+func Drained(ctx context.Context) error {
+	infos, err := redisClient.Client.XInfoGroups(ctx, "buy_stream").Result()
+	if err != nil && !strings.Contains(err.Error(), "no such key") {
+		return fmt.Errorf("failed to read buy_stream groups: %v", err)
+	}
+	for _, info := range infos {
+		if err := drainedGroup(ctx, streamBus, "buy_stream", info.Name); err != nil {
+			return err
+		}
+	}
+	persistenceMutex.Lock()
+	mode := persistenceMode
+	persistenceMutex.Unlock()
+	if mode == ModeDirect {
+		return nil
+	}
+	return drainedGroup(ctx, eventBus(), consumerTopic, "postgres-writer")
+}
+
+func drainedGroup(ctx context.Context, bus EventBus, topic, group string) error {
+	backlog, err := bus.Backlog(ctx, topic, group)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUndrained, err)
+	}
+	if backlog > 0 {
+		return fmt.Errorf("%w: group %s has %d entries of %s left", ErrUndrained, group, backlog, topic)
+	}
+	return nil
+}
+
+// ensureStreamGroups creates the buy_stream groups that are missing. Every
+// group starts at the beginning of the stream: entries still in it have not
+// been fully processed. A group the mode does not read is reported, because
+// it never acks anything and holds back trimming.
+func ensureStreamGroups(groups []string) error {
+	ctx := context.Background()
+	existing := make(map[string]bool)
+	infos, err := redisClient.Client.XInfoGroups(ctx, "buy_stream").Result()
+	if err != nil && !strings.Contains(err.Error(), "no such key") {
+		return fmt.Errorf("failed to read buy_stream groups: %v", err)
+	}
+	for _, info := range infos {
+		existing[info.Name] = true
+	}
+
+	wanted := make(map[string]bool)
+	for _, group := range groups {
+		wanted[group] = true
+		if existing[group] {
+			continue
+		}
+		err := redisClient.Client.XGroupCreateMkStream(ctx, "buy_stream", group, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return fmt.Errorf("failed to create buy_stream group %s: %v", group, err)
+		}
+		log.Printf("✅ Created buy_stream group %s", group)
+	}
+	for _, info := range infos {
+		if !wanted[info.Name] {
+			log.Printf("⚠️ buy_stream group %s is not used in this mode (%d pending, lag %d); destroy it if it is stale", info.Name, info.Pending, info.Lag)
+		}
+	}
+	return nil
+}
+
+// inShards splits events by key into at most n shards and runs fn on each
+// shard in its own goroutine. A shard keeps the order of events, so events
+// with the same key are handled one after another in the order they were
+// read, while different keys are handled in parallel. It returns once every
+// shard is done, with the errors of the shards that failed.
+func inShards(events []Event, n int, fn func(shard []Event) error) error {
+	if n < 1 {
+		n = 1
+	}
+	shards := make([][]Event, n)
+	for _, e := range events {
+		h := fnv.New32a()
+		h.Write([]byte(e.Key))
+		i := int(h.Sum32() % uint32(n))
+		shards[i] = append(shards[i], e)
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i, shard := range shards {
+		if len(shard) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, shard []Event) {
+			defer wg.Done()
+			errs[i] = fn(shard)
+		}(i, shard)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// PathStats counts what one persistence path did with the trades it read.
+type PathStats struct {
+	Written    int64 `json:"written"`
+	Duplicates int64 `json:"duplicates"` // already written by the other path or an earlier delivery
+}
+
+var (
+	persistenceMutex sync.Mutex
+	persistenceStats = map[string]*PathStats{ModeDirect: {}, ModeKafka: {}}
+	// persistenceMode is the mode StartPersistence started, "" before then
+	persistenceMode string
+)
+
+func countPersisted(path string, written, duplicates int) {
+	persistenceMutex.Lock()
+	defer persistenceMutex.Unlock()
+	persistenceStats[path].Written += int64(written)
+	persistenceStats[path].Duplicates += int64(duplicates)
+}
+
+// PersistenceStats returns the per-path counts, keyed by ModeDirect and
+// ModeKafka.
+func PersistenceStats() map[string]PathStats {
+	persistenceMutex.Lock()
+	defer persistenceMutex.Unlock()
+	stats := make(map[string]PathStats, len(persistenceStats))
+	for path, s := range persistenceStats {
+		stats[path] = *s
+	}
+	return stats
+}
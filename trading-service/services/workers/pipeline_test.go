@@ -0,0 +1,41 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// In kafka mode buy_stream is acked once a trade is on trade_events, so the
+// pipeline is only drained once postgres-writer has written it too.
+func TestDrainedWaitsForPostgresWriter(t *testing.T) {
+	useTestRedis(t)
+	_, trades := useMemoryBuses(t)
+	previousStream := streamBus
+	streamBus = NewRedisBus()
+	t.Cleanup(func() { streamBus = previousStream })
+	ctx := context.Background()
+
+	if err := Drained(ctx); err != nil {
+		t.Fatalf("empty pipeline: %v", err)
+	}
+	if err := streamBus.Publish(ctx, "buy_stream", []Event{streamEntry(1, 0)})[0]; err != nil {
+		t.Fatal(err)
+	}
+	if err := Drained(ctx); !errors.Is(err, ErrUndrained) {
+		t.Fatalf("unread buy_stream entry: got %v", err)
+	}
+	entries, _ := streamBus.Subscribe(ctx, "buy_stream", "kafka_workers", forwardConsumer, 10, time.Second)
+	if held := forwardEntries(entries); len(entries) != 1 || len(held) != 0 {
+		t.Fatalf("forwarded %d entries, held %d", len(entries), len(held))
+	}
+	if err := Drained(ctx); !errors.Is(err, ErrUndrained) {
+		t.Fatalf("forwarded but unwritten trade: got %v", err)
+	}
+	events, _ := trades.Subscribe(ctx, consumerTopic, "postgres-writer", writerConsumer, 10, time.Second)
+	trades.Ack(ctx, consumerTopic, "postgres-writer", events)
+	if err := Drained(ctx); err != nil {
+		t.Fatalf("written trade: %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"trading-service/pkg/redisClient"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Entries read with XREADGROUP stay in the group's pending list until they
+// are acked, so a consumer that dies in between strands them. Handling them
+// on the side would reorder a user's trades, so instead they go back to the
+// group's reader: on its first read it claims everything the group has
+// pending, and the reclaimer periodically hands it entries another consumer
+// has left idle past a threshold. The reader reads them back in stream order
+// before anything new. An entry already delivered maxDeliveries times is
+// dead-lettered instead of being tried again.
+const (
+	maxDeliveries = 5
+	reclaimBatch  = 100
+)
+
+// Each consumer group on Redis Streams is read by one consumer of this name.
+const (
+	forwardConsumer = "redisConsumer-1"   // kafka_workers on buy_stream
+	sqlConsumer     = "worker-1"          // sql_workers on buy_stream
+	writerConsumer  = "postgres-writer-1" // postgres-writer on trade_events
+)
+
+// streamGroup is a consumer group, its reader and the stage it feeds.
+type streamGroup struct {
+	bus      *RedisBus
+	stream   string
+	name     string
+	consumer string
+	stage    string
+}
+
+// ReclaimStats are the pending-entry metrics of one consumer group.
+type ReclaimStats struct {
+	Pending      int64  `json:"pending"`
+	Reclaimed    int64  `json:"reclaimed"` // taken over from other consumers
+	DeadLettered int64  `json:"dead_lettered"`
+	LastRun      string `json:"last_run,omitempty"`
+}
+
+var (
+	reclaimMutex sync.Mutex
+	reclaimStats = make(map[string]*ReclaimStats)
+)
+
+// reclaimPending moves every pending entry of group on stream to consumer.
+func reclaimPending(ctx context.Context, stream, group, consumer string) (int64, error) {
+	var reclaimed int64
+	start := "0-0"
+	for {
+		messages, next, err := redisClient.Client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   stream,
+			Group:    group,
+			Consumer: consumer,
+			Start:    start,
+			Count:    reclaimBatch,
+		}).Result()
+		if err != nil {
+			return reclaimed, err
+		}
+		reclaimed += int64(len(messages))
+		if next == "0-0" {
+			break
+		}
+		start = next
+	}
+	if reclaimed > 0 {
+		log.Printf("♻️ %s reclaimed %d pending entries of %s", consumer, reclaimed, group)
+	}
+	reclaimMutex.Lock()
+	statsFor(group).Reclaimed += reclaimed
+	reclaimMutex.Unlock()
+	return reclaimed, nil
+}
+
+// statsFor returns group's stats; the caller holds reclaimMutex.
+func statsFor(group string) *ReclaimStats {
+	stats, ok := reclaimStats[group]
+	if !ok {
+		stats = &ReclaimStats{}
+		reclaimStats[group] = stats
+	}
+	return stats
+}
+
+// StartReclaimer checks the pending lists of kafka_workers and sql_workers,
+// and of postgres-writer when trade_events is on Redis Streams too, every
+// interval, and reclaims entries idle for at least minIdle.
+func StartReclaimer(interval, minIdle time.Duration) {
+	var groups []streamGroup
+	if bus, ok := streamBus.(*RedisBus); ok {
+		groups = append(groups,
+			streamGroup{bus: bus, stream: "buy_stream", name: "kafka_workers", consumer: forwardConsumer, stage: StageRedisToKafka},
+			streamGroup{bus: bus, stream: "buy_stream", name: "sql_workers", consumer: sqlConsumer, stage: StageRedisToSQL},
+		)
+	}
+	if bus, ok := eventBus().(*RedisBus); ok {
+		groups = append(groups, streamGroup{bus: bus, stream: consumerTopic, name: "postgres-writer", consumer: writerConsumer, stage: StageKafkaToSQL})
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			for _, group := range groups {
+				reclaimGroup(context.Background(), group, minIdle)
+			}
+		}
+	}()
+	log.Printf("✅ Pending entry reclaimer running every %s (idle threshold %s)", interval, minIdle)
+}
+
+// reclaimGroup dead-letters the group's idle entries that were delivered
+// maxDeliveries times and hands the rest of another consumer's idle entries
+// to the group's reader.
+func reclaimGroup(ctx context.Context, group streamGroup, minIdle time.Duration) {
+	pending, err := redisClient.Client.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: group.stream,
+		Group:  group.name,
+		Idle:   minIdle,
+		Start:  "-",
+		End:    "+",
+		Count:  reclaimBatch,
+	}).Result()
+	if err != nil {
+		// the group only exists once its workers have been started
+		if !strings.HasPrefix(err.Error(), "NOGROUP") {
+			log.Printf("❌ Failed to read pending entries of %s: %v", group.name, err)
+		}
+		return
+	}
+
+	var stranded, poisoned []string
+	deliveries := make(map[string]int64, len(pending))
+	for _, entry := range pending {
+		deliveries[entry.ID] = entry.RetryCount
+		switch {
+		case entry.RetryCount >= maxDeliveries:
+			poisoned = append(poisoned, entry.ID)
+		case entry.Consumer != group.consumer:
+			stranded = append(stranded, entry.ID)
+		}
+	}
+
+	var reclaimed, deadLettered int64
+	if len(poisoned) > 0 {
+		// MinIdle skips entries the reader picked up in the meantime
+		messages, err := redisClient.Client.XClaim(ctx, &redis.XClaimArgs{
+			Stream:   group.stream,
+			Group:    group.name,
+			Consumer: group.consumer,
+			MinIdle:  minIdle,
+			Messages: poisoned,
+		}).Result()
+		if err != nil {
+			log.Printf("❌ Failed to claim pending entries of %s: %v", group.name, err)
+		}
+		for _, message := range messages {
+			if message.Values != nil {
+				count := deliveries[message.ID]
+				reason := fmt.Errorf("delivered %d times without being acked", count)
+				if deadLetter(group.stage, streamEvent(message), int(count), reason) != nil {
+					continue
+				}
+				deadLettered++
+			}
+			// dead-lettered, or deleted from the stream: nothing left to process
+			redisClient.Client.XAck(ctx, group.stream, group.name, message.ID)
+		}
+	}
+	if len(stranded) > 0 {
+		claimed, err := redisClient.Client.XClaimJustID(ctx, &redis.XClaimArgs{
+			Stream:   group.stream,
+			Group:    group.name,
+			Consumer: group.consumer,
+			MinIdle:  minIdle,
+			Messages: stranded,
+		}).Result()
+		if err != nil {
+			log.Printf("❌ Failed to claim pending entries of %s: %v", group.name, err)
+		}
+		reclaimed = int64(len(claimed))
+	}
+	if reclaimed > 0 || deadLettered > 0 {
+		// the reader reads what it now owns before anything new
+		group.bus.replayPending(group.stream, group.name, group.consumer)
+		log.Printf("♻️ Reclaimed %d and dead-lettered %d pending entries of %s", reclaimed, deadLettered, group.name)
+	}
+
+	summary, err := redisClient.Client.XPending(ctx, group.stream, group.name).Result()
+	reclaimMutex.Lock()
+	defer reclaimMutex.Unlock()
+	stats := statsFor(group.name)
+	if err == nil {
+		stats.Pending = summary.Count
+	}
+	stats.Reclaimed += reclaimed
+	stats.DeadLettered += deadLettered
+	stats.LastRun = time.Now().UTC().Format(time.RFC3339)
+}
+
+// ReclaimMetrics returns the pending-entry metrics per consumer group.
+func ReclaimMetrics() map[string]ReclaimStats {
+	reclaimMutex.Lock()
+	defer reclaimMutex.Unlock()
+	metrics := make(map[string]ReclaimStats, len(reclaimStats))
+	for group, stats := range reclaimStats {
+		metrics[group] = *stats
+	}
+	return metrics
+}
@@ -0,0 +1,97 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"trading-service/pkg/redisClient"
+)
+
+const testIdle = 20 * time.Millisecond
+
+// testGroup is "group" on "topic", read by "reader".
+func testGroup(t *testing.T, bus *RedisBus) streamGroup {
+	t.Helper()
+	reclaimMutex.Lock()
+	delete(reclaimStats, "group")
+	reclaimMutex.Unlock()
+	t.Cleanup(func() {
+		reclaimMutex.Lock()
+		delete(reclaimStats, "group")
+		reclaimMutex.Unlock()
+	})
+	return streamGroup{bus: bus, stream: "topic", name: "group", consumer: "reader", stage: StageRedisToSQL}
+}
+
+// Entries a stuck consumer leaves idle are handed to the running reader,
+// which reads them before anything new.
+func TestReclaimerHandsStrandedEntriesToReader(t *testing.T) {
+	useTestRedis(t)
+	ctx := context.Background()
+	bus := NewRedisBus()
+	group := testGroup(t, bus)
+
+	if got := subscribeAll(t, bus, "reader"); len(got) != 0 {
+		t.Fatalf("reader got %v from an empty stream", got)
+	}
+	publishKeyed(t, bus, "topic", "a1", "b1")
+	if got := subscribeAll(t, NewRedisBus(), "stuck"); len(got) != 2 {
+		t.Fatalf("stuck consumer got %v, want 2 events", got)
+	}
+	publishKeyed(t, bus, "topic", "a2")
+
+	reclaimGroup(ctx, group, testIdle)
+	if stats := ReclaimMetrics()["group"]; stats.Reclaimed != 0 {
+		t.Fatalf("reclaimed %d entries before they were idle", stats.Reclaimed)
+	}
+	time.Sleep(2 * testIdle)
+	reclaimGroup(ctx, group, testIdle)
+	if stats := ReclaimMetrics()["group"]; stats.Reclaimed != 2 || stats.Pending != 2 {
+		t.Fatalf("stats %+v, want 2 reclaimed and pending", stats)
+	}
+
+	if got := subscribeAll(t, bus, "reader"); fmt.Sprint(got) != "[a1 b1]" {
+		t.Fatalf("reader got %v, want the stranded entries", got)
+	}
+	if got := subscribeAll(t, bus, "reader"); fmt.Sprint(got) != "[a2]" {
+		t.Fatalf("then got %v, want [a2]", got)
+	}
+}
+
+// An idle entry delivered maxDeliveries times is dead-lettered and acked.
+func TestReclaimerDeadLettersRedeliveredEntries(t *testing.T) {
+	useTestRedis(t)
+	ctx := context.Background()
+	bus := NewRedisBus()
+	group := testGroup(t, bus)
+
+	publishKeyed(t, bus, "topic", "a1", "b1")
+	events, err := bus.Subscribe(ctx, "topic", "group", "reader", 10, time.Second)
+	if err != nil || len(events) != 2 {
+		t.Fatalf("got %v, %v; want 2 events", payloads(events), err)
+	}
+	// as if a1 had been read and nacked over and over
+	err = redisClient.Client.Do(ctx, "XCLAIM", "topic", "group", "reader", 0, events[0].ID, "RETRYCOUNT", maxDeliveries).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * testIdle)
+	reclaimGroup(ctx, group, testIdle)
+
+	stats := ReclaimMetrics()["group"]
+	if stats.DeadLettered != 1 || stats.Reclaimed != 0 || stats.Pending != 1 {
+		t.Fatalf("stats %+v, want 1 dead-lettered and 1 pending", stats)
+	}
+	letters, err := ListDeadLetters(ctx, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(letters) != 1 || letters[0].SourceID != events[0].ID || letters[0].Stage != StageRedisToSQL || letters[0].Attempts != maxDeliveries {
+		t.Fatalf("dead letters %+v, want %s from %s", letters, events[0].ID, StageRedisToSQL)
+	}
+	if got := subscribeAll(t, bus, "reader"); fmt.Sprint(got) != "[b1]" {
+		t.Fatalf("reader got %v, want only the entry left pending", got)
+	}
+}
@@ -0,0 +1,212 @@
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"trading-service/pkg/redisClient"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisBus is an EventBus on Redis Streams, one stream per topic and one
+// consumer group per group. Published events are stored as key and payload
+// fields. Entries written directly with XADD, like the trade scripts'
+// buy_stream entries, are delivered with their fields as a JSON object.
+//
+// Each group is meant to be read by one consumer. On its first read a
+// consumer reclaims everything its group has pending, e.g. from consumers of
+// an earlier run, and it reads its own pending entries before new ones, in
+// stream order; the reclaimer hands it entries stranded later on. Nack
+// leaves entries pending and makes the consumer read its pending entries
+// again, so a nacked batch comes back before anything newer.
+type RedisBus struct {
+	groups sync.Map // "stream/group" -> struct{}
+	// started holds "stream/group/consumer" once the consumer's first read
+	// has reclaimed what the group had pending
+	started sync.Map
+	// replay holds, per "stream/group/consumer", the id after which the
+	// consumer's pending entries are still to be read again
+	replay sync.Map
+}
+
+// redisRef is what a RedisBus event needs to be nacked.
+type redisRef struct {
+	consumer string
+}
+
+func NewRedisBus() *RedisBus {
+	return &RedisBus{}
+}
+
+// streamEvent turns a stream entry into an Event.
+func streamEvent(message redis.XMessage) Event {
+	e := Event{ID: message.ID}
+	if payload, ok := message.Values["payload"].(string); ok {
+		e.Payload = []byte(payload)
+		e.Key, _ = message.Values["key"].(string)
+		return e
+	}
+	e.Payload, _ = json.Marshal(message.Values)
+	e.Key, _ = message.Values["user_id"].(string)
+	return e
+}
+
+// ensureGroup creates group on stream the first time it is used. New groups
+// start at the beginning of the stream so nothing published before the
+// first subscriber is missed.
+func (b *RedisBus) ensureGroup(ctx context.Context, stream, group string) error {
+	if _, ok := b.groups.Load(stream + "/" + group); ok {
+		return nil
+	}
+	err := redisClient.Client.XGroupCreateMkStream(ctx, stream, group, "0").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	b.groups.Store(stream+"/"+group, struct{}{})
+	return nil
+}
+
+func (b *RedisBus) Publish(ctx context.Context, topic string, events []Event) []error {
+	pipe := redisClient.Client.Pipeline()
+	cmds := make([]*redis.StringCmd, len(events))
+	for i, e := range events {
+		cmds[i] = pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: topic,
+			Values: map[string]interface{}{"key": e.Key, "payload": string(e.Payload)},
+		})
+	}
+	pipe.Exec(ctx)
+	errs := make([]error, len(events))
+	for i, cmd := range cmds {
+		errs[i] = cmd.Err()
+	}
+	return errs
+}
+
+func (b *RedisBus) Subscribe(ctx context.Context, topic, group, consumer string, max int, wait time.Duration) ([]Event, error) {
+	if err := b.ensureGroup(ctx, topic, group); err != nil {
+		return nil, err
+	}
+	key := topic + "/" + group + "/" + consumer
+	if _, seen := b.started.LoadOrStore(key, struct{}{}); !seen {
+		if _, err := reclaimPending(ctx, topic, group, consumer); err != nil {
+			b.started.Delete(key)
+			return nil, err
+		}
+		b.replay.Store(key, "0")
+	}
+	// pending entries first, then new ones
+	start, replaying := b.replay.Load(key)
+	if replaying {
+		events, last, err := b.read(ctx, topic, group, consumer, start.(string), max, 0)
+		if err != nil || last != "" {
+			if last != "" {
+				b.replay.Store(key, last)
+			}
+			return events, err
+		}
+		b.replay.Delete(key)
+	}
+	events, _, err := b.read(ctx, topic, group, consumer, ">", max, wait)
+	return events, err
+}
+
+// read runs XREADGROUP from id: ">" for new entries, or an entry id for the
+// consumer's pending entries after it. last is the id of the last entry
+// read, including entries skipped because they were deleted.
+func (b *RedisBus) read(ctx context.Context, topic, group, consumer, id string, max int, wait time.Duration) (events []Event, last string, err error) {
+	args := &redis.XReadGroupArgs{
+		Group:    group,
+		Consumer: consumer,
+		Streams:  []string{topic, id},
+		Count:    int64(max),
+		Block:    wait,
+	}
+	if id != ">" {
+		// reading pending entries never blocks; -1 leaves out BLOCK
+		args.Block = -1
+	}
+	streams, err := redisClient.Client.XReadGroup(ctx, args).Result()
+	if err == redis.Nil {
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	for _, stream := range streams {
+		for _, message := range stream.Messages {
+			last = message.ID
+			if message.Values == nil {
+				// deleted while pending, nothing left to deliver
+				redisClient.Client.XAck(ctx, topic, group, message.ID)
+				continue
+			}
+			e := streamEvent(message)
+			e.ref = redisRef{consumer: consumer}
+			events = append(events, e)
+		}
+	}
+	return events, last, nil
+}
+
+func (b *RedisBus) Ack(ctx context.Context, topic, group string, events []Event) error {
+	if len(events) == 0 {
+		return nil
+	}
+	ids := make([]string, len(events))
+	for i, e := range events {
+		ids[i] = e.ID
+	}
+	return redisClient.Client.XAck(ctx, topic, group, ids...).Err()
+}
+
+// Nack makes each consumer of events read its pending entries again from
+// the start; events stay pending until they are acked.
+func (b *RedisBus) Nack(ctx context.Context, topic, group string, events []Event) error {
+	for _, e := range events {
+		if ref, ok := e.ref.(redisRef); ok {
+			b.replayPending(topic, group, ref.consumer)
+		}
+	}
+	return nil
+}
+
+// replayPending makes consumer read its pending entries on topic again from
+// the start before anything new.
+func (b *RedisBus) replayPending(topic, group, consumer string) {
+	b.replay.Store(topic+"/"+group+"/"+consumer, "0")
+}
+
+// Backlog counts group's pending entries and the ones it has not read yet. A
+// group that does not exist yet will read the whole stream.
+func (b *RedisBus) Backlog(ctx context.Context, topic, group string) (int64, error) {
+	info, err := redisClient.Client.XInfoStream(ctx, topic).Result()
+	if err != nil {
+		if strings.Contains(err.Error(), "no such key") {
+			return 0, nil
+		}
+		return 0, err
+	}
+	groups, err := redisClient.Client.XInfoGroups(ctx, topic).Result()
+	if err != nil {
+		return 0, err
+	}
+	for _, g := range groups {
+		if g.Name != group {
+			continue
+		}
+		// Redis reports no lag when entries after the group's position were
+		// deleted, which go-redis reads as 0; only a group that has read up
+		// to the last entry certainly has nothing left to read
+		if g.Lag == 0 && g.LastDeliveredID != info.LastGeneratedID {
+			return 0, fmt.Errorf("lag of group %s on %s is unknown", group, topic)
+		}
+		return g.Pending + g.Lag, nil
+	}
+	return info.Length, nil
+}
@@ -0,0 +1,129 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"trading-service/pkg/redisClient"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// testRedisDB keeps test streams away from the service's keys in database 0.
+const testRedisDB = 15
+
+// useTestRedis points redisClient at an empty test database on REDIS_ADDR
+// (default localhost:6379), or skips the test when Redis is not running.
+func useTestRedis(t *testing.T) {
+	t.Helper()
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+	client := redis.NewClient(&redis.Options{Addr: addr, DB: testRedisDB})
+	ctx := context.Background()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		t.Skipf("Redis is not available at %s: %v", addr, err)
+	}
+	if err := client.FlushDB(ctx).Err(); err != nil {
+		t.Fatalf("failed to flush the test database: %v", err)
+	}
+	previous := redisClient.Client
+	redisClient.Client = client
+	t.Cleanup(func() {
+		client.FlushDB(ctx)
+		client.Close()
+		redisClient.Client = previous
+	})
+}
+
+func subscribeAll(t *testing.T, bus EventBus, consumer string) []string {
+	t.Helper()
+	events, err := bus.Subscribe(context.Background(), "topic", "group", consumer, 10, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payloads(events)
+}
+
+// A nacked batch is read again by its consumer before newer entries.
+func TestRedisBusNackRedeliversBeforeNewer(t *testing.T) {
+	useTestRedis(t)
+	ctx := context.Background()
+	bus := NewRedisBus()
+	publishKeyed(t, bus, "topic", "a1", "b1", "a2")
+
+	first, err := bus.Subscribe(ctx, "topic", "group", "c1", 10, time.Second)
+	if err != nil || len(first) != 3 {
+		t.Fatalf("got %v, %v; want 3 events", payloads(first), err)
+	}
+	publishKeyed(t, bus, "topic", "a3")
+	if err := bus.Nack(ctx, "topic", "group", first); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := subscribeAll(t, bus, "c1"); fmt.Sprint(got) != "[a1 b1 a2]" {
+		t.Fatalf("after nack got %v, want the nacked batch", got)
+	}
+	if got := subscribeAll(t, bus, "c1"); fmt.Sprint(got) != "[a3]" {
+		t.Fatalf("then got %v, want [a3]", got)
+	}
+}
+
+// A new consumer takes over what the group's earlier consumers left pending
+// and reads it before anything new.
+func TestRedisBusReclaimsPendingOnFirstRead(t *testing.T) {
+	useTestRedis(t)
+	publishKeyed(t, NewRedisBus(), "topic", "a1", "a2")
+	if got := subscribeAll(t, NewRedisBus(), "crashed"); len(got) != 2 {
+		t.Fatalf("got %v, want 2 events", got)
+	}
+
+	bus := NewRedisBus()
+	publishKeyed(t, bus, "topic", "a3")
+	if got := subscribeAll(t, bus, "restarted"); fmt.Sprint(got) != "[a1 a2]" {
+		t.Fatalf("got %v, want the entries left pending", got)
+	}
+	if got := subscribeAll(t, bus, "restarted"); fmt.Sprint(got) != "[a3]" {
+		t.Fatalf("then got %v, want [a3]", got)
+	}
+}
+
+// The backlog is pending plus unread entries, and cannot be told once
+// entries after the group's position have been deleted.
+func TestRedisBusBacklog(t *testing.T) {
+	useTestRedis(t)
+	ctx := context.Background()
+	bus := NewRedisBus()
+	if got, err := bus.Backlog(ctx, "topic", "group"); err != nil || got != 0 {
+		t.Fatalf("backlog of a missing stream is %d, %v", got, err)
+	}
+	publishKeyed(t, bus, "topic", "a1", "b1", "a2")
+	if got, err := bus.Backlog(ctx, "topic", "group"); err != nil || got != 3 {
+		t.Fatalf("backlog before the group exists is %d, %v; want 3", got, err)
+	}
+	read, err := bus.Subscribe(ctx, "topic", "group", "c", 1, time.Second)
+	if err != nil || len(read) != 1 {
+		t.Fatalf("got %v, %v; want 1 event", payloads(read), err)
+	}
+	if got, err := bus.Backlog(ctx, "topic", "group"); err != nil || got != 3 {
+		t.Fatalf("backlog with one read is %d, %v; want 3", got, err)
+	}
+	bus.Ack(ctx, "topic", "group", read)
+	if got, err := bus.Backlog(ctx, "topic", "group"); err != nil || got != 2 {
+		t.Fatalf("backlog with one acked is %d, %v; want 2", got, err)
+	}
+
+	last, err := redisClient.Client.XRevRangeN(ctx, "topic", "+", "-", 1).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	redisClient.Client.XDel(ctx, "topic", last[0].ID)
+	if got, err := bus.Backlog(ctx, "topic", "group"); err == nil {
+		t.Fatalf("backlog after a deletion is %d, want an error", got)
+	}
+}
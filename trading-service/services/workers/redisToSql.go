@@ -3,71 +3,113 @@ package workers
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"log"
-	"strconv"
 	"strings"
-	"sync"
 	"time"
 
-	"trading-service/pkg/redisClient"
-
-	"github.com/redis/go-redis/v9"
-)
-
-type SQLJob struct {
-	UserID  int
-	Action  string
-	Balance float64
-	Stock   string // Serialized JSON of stocks
-}
-
-var (
-	SqlMutex          sync.Mutex
-	SuccessfulInserts int64
-	FailedInserts     int64
-	TotalSQLTime      time.Duration
+	"trading-service/pkg/money"
+	"trading-service/services/orders"
+	trade_service "trading-service/services/trade"
 )
 
-var ProcessedTrades int64
-
-func addToSQL(db *sql.DB, userId int, action string, balance float64, stocks []struct {
-	Symbol   string  `json:"symbol"`
-	Quantity float64 `json:"quantity"`
-	Price    float64 `json:"price"`
-}) error {
-	// startSQL := time.Now()
-
+// addToSQL writes one buy_stream entry: its trade rows, positions and the
+// balance it left the user with, unless a newer trade of theirs is already
+// in Postgres. eventID is the entry id; a trade already written under it,
+// e.g. by the Kafka consumer, is left alone.
+func addToSQL(db *sql.DB, eventID string, userId int, action string, balance money.Money, stocks []trade_service.TradeStock) error {
+	if len(stocks) == 0 {
+		return fmt.Errorf("no valid inserts")
+	}
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	side := trade_service.TradeType(action)
 	var trades []string
-	var positions []string
 	var args []interface{}
-	for _, stock := range stocks {
-		trades = append(trades, fmt.Sprintf(" ($%d, $%d, $%d, $%d, 'BUY') ", len(args)+1, len(args)+2, len(args)+3, len(args)+4))
-		positions = append(positions, fmt.Sprintf("($%d, $%d, $%d, $%d)", len(args)+1, len(args)+2, len(args)+3, len(args)+4))
-		args = append(args, userId, stock.Symbol, stock.Quantity, stock.Price)
-	}
-	if len(trades) == 0 {
-		return fmt.Errorf("no valid inserts")
+	// legs of the same symbol are folded into one position change: a
+	// statement can only change each position row once
+	var symbols []string
+	bySymbol := make(map[string]trade_service.TradeStock)
+	for leg, stock := range stocks {
+		trades = append(trades, fmt.Sprintf(" ($%d, $%d, $%d, $%d, $%d::trade_type_enum, NULLIF($%d, '')) ", len(args)+1, len(args)+2, len(args)+3, len(args)+4, len(args)+5, len(args)+6))
+		args = append(args, userId, stock.Symbol, stock.Quantity, stock.Price, side, legEventID(eventID, leg))
+		folded, seen := bySymbol[stock.Symbol]
+		if !seen {
+			symbols = append(symbols, stock.Symbol)
+		}
+		folded.Symbol = stock.Symbol
+		folded.Price = money.WeightedAverage(folded.Quantity, folded.Price, stock.Quantity, stock.Price)
+		folded.Quantity += stock.Quantity
+		bySymbol[stock.Symbol] = folded
 	}
-	if len(positions) == 0 {
-		return fmt.Errorf("no valid position to insert")
+	var positions []string
+	var position_args []interface{}
+	for _, symbol := range symbols {
+		stock := bySymbol[symbol]
+		if side == "SELL" {
+			positions = append(positions, fmt.Sprintf("($%d::varchar, $%d::numeric)", len(position_args)+2, len(position_args)+3))
+			position_args = append(position_args, stock.Symbol, stock.Quantity)
+		} else {
+			positions = append(positions, fmt.Sprintf("($%d, $%d, $%d, $%d)", len(position_args)+1, len(position_args)+2, len(position_args)+3, len(position_args)+4))
+			position_args = append(position_args, userId, stock.Symbol, stock.Quantity, stock.Price)
+		}
 	}
 	insert_trades := fmt.Sprintf(`
-		INSERT INTO trades (user_id, symbol, quantity, executed_price, trade_type)
-		VALUES %s`, strings.Join(trades, ", "))
-	_, err = tx.ExecContext(ctx, insert_trades, args...)
+		INSERT INTO trades (user_id, symbol, quantity, executed_price, trade_type, event_id)
+		VALUES %s
+		ON CONFLICT (event_id) DO NOTHING`, strings.Join(trades, ", "))
+	result, err := tx.ExecContext(ctx, insert_trades, args...)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if inserted, err := result.RowsAffected(); err == nil && inserted == 0 {
+		// already persisted, so positions must not change again
+		countPersisted(ModeDirect, 0, 1)
+		return tx.Rollback()
+	}
+	// the balance the trade left, written with its trade rows so a path
+	// that finds them already there can skip the whole trade
+	if eventID == "" {
+		_, err = tx.ExecContext(ctx, "UPDATE users SET balance = $2 WHERE id = $1", userId, balance)
+	} else {
+		_, err = tx.ExecContext(ctx, "UPDATE users SET balance = $2 WHERE id = $1 AND NOT "+newerTrade("$1", "$3::text"), userId, balance, eventID)
+	}
 	if err != nil {
 		tx.Rollback()
 		return err
 	}
 
+	if side == "SELL" {
+		// $1 is the seller; each sold leg contributes a (symbol, quantity) pair.
+		position_args = append([]interface{}{userId}, position_args...)
+		reduce_positions := fmt.Sprintf(`
+		UPDATE positions
+		SET quantity = positions.quantity - sold.quantity,
+			updated_at = CURRENT_TIMESTAMP
+		FROM (VALUES %s) AS sold(symbol, quantity)
+		WHERE positions.user_id = $1 AND positions.symbol = sold.symbol`, strings.Join(positions, ", "))
+		_, err = tx.ExecContext(ctx, reduce_positions, position_args...)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM positions WHERE user_id = $1 AND quantity <= 0", userId)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		countPersisted(ModeDirect, 1, 0)
+		return nil
+	}
+
 	insert_update_positions := fmt.Sprintf(
 		`Insert INTO positions (user_id, symbol, quantity, average_price)
 		VALUES %s
@@ -76,125 +118,82 @@ func addToSQL(db *sql.DB, userId int, action string, balance float64, stocks []s
 	        quantity = positions.quantity + EXCLUDED.quantity,
 	        average_price = ((positions.quantity * positions.average_price) + (EXCLUDED.quantity * EXCLUDED.average_price))/ (positions.quantity + EXCLUDED.quantity),
 	        updated_at = CURRENT_TIMESTAMP;`, strings.Join(positions, ", "))
-	_, err = tx.ExecContext(ctx, insert_update_positions, args...)
+	_, err = tx.ExecContext(ctx, insert_update_positions, position_args...)
 	if err != nil {
 		tx.Rollback()
-		fmt.Printf("Failed to insert/update positions: %v\n", err) // Log exact failure
+		log.Printf("❌ Failed to insert/update positions: %v", err)
 		return err
 	}
 	err = tx.Commit()
-
-	// ⏱ End timing: measure duration
-	// elapsed := time.Since(startSQL)
-
-	// Thread‐safe update of SQL counters
-	// SqlMutex.Lock()
-	// if err != nil {
-	// 	FailedInserts++
-	// } else {
-	// 	SuccessfulInserts++
-	// 	TotalSQLTime += elapsed
-	// }
-	// SqlMutex.Unlock()
+	if err == nil {
+		countPersisted(ModeDirect, 1, 0)
+	}
 
 	return err
 }
-func processTrade(workerId int, db *sql.DB) {
+
+// persistEntry writes one buy_stream entry to Postgres, or moves it to the
+// dead-letter stream, and acks it for sql_workers. It returns false if the
+// entry could be neither written nor dead-lettered and is left pending.
+func persistEntry(db *sql.DB, entry Event) bool {
+	trade, err := parseStreamTrade(entry)
+	attempts := 1 // malformed entries are not retried
+	if err == nil {
+		attempts, err = withRetries(func() error {
+			return addToSQL(db, trade.EventID, trade.UserID, trade.Action, trade.Balance, trade.Stocks)
+		})
+	}
+	if err != nil {
+		log.Printf("❌ Failed to persist stream entry %s: %v", entry.ID, err)
+		if deadLetter(StageRedisToSQL, entry, attempts, err) != nil {
+			return false
+		}
+	} else {
+		orders.Record(context.Background(), trade.OrderID, orders.StagePersisted, "")
+	}
+	// trimming is left to the retention manager, which knows what every
+	// group has read
+	if err := streamBus.Ack(context.Background(), "buy_stream", "sql_workers", []Event{entry}); err != nil {
+		log.Printf("⚠️ Failed to ack stream entry %s: %v", entry.ID, err)
+	}
+	return true
+}
+
+// sqlBatch is how many buy_stream entries the sql_workers reader takes at once.
+const sqlBatch = 100
+
+// processTrade is the only sql_workers consumer. It splits what it reads by
+// user over up to workers goroutines, so a user's entries are written one
+// after another in stream order. When an entry is left pending, the rest of
+// its user's entries in the batch are too, and all of them are read again
+// before anything newer.
+func processTrade(workers int, db *sql.DB) {
+	ctx := context.Background()
 	for {
-		// log.Printf("📥 Worker %d attempting to read from `buy_stream`...", workerId)
-		messages, err := redisClient.Client.XReadGroup(context.Background(), &redis.XReadGroupArgs{
-			Group:    "sql_workers",
-			Consumer: fmt.Sprintf("worker-%d", workerId),
-			Streams:  []string{"buy_stream", ">"},
-			Count:    10,
-			Block:    0,
-		}).Result()
-		// log.Printf("reading message now!")
+		entries, err := streamBus.Subscribe(ctx, "buy_stream", "sql_workers", sqlConsumer, sqlBatch, streamWait)
 		if err != nil {
-			log.Println("Error reading from Redis Stream: ", err)
-			break
+			log.Printf("❌ Failed to read buy_stream: %v", err)
+			time.Sleep(time.Second)
+			continue
 		}
-		for _, message := range messages[0].Messages {
-			jobID := message.ID
-			values := message.Values
-			tempUserId, ok := values["user_id"].(string)
-			if !ok || tempUserId == "" {
-				log.Println("Missing or invalid user_id", values)
-				continue
-			}
-			userId, err := strconv.Atoi(tempUserId)
-			if err != nil {
-				log.Printf("Error converting user_id", values)
-			}
-			action, ok := values["action"].(string)
-			if !ok {
-				log.Printf("Missing or invalid action", values)
-				continue
-			}
-			balanceStr, ok := values["balance"].(string)
-			if !ok {
-				log.Printf("Missing or invalid balance", values)
-				continue
-			}
-			balance, err := strconv.ParseFloat(balanceStr, 64)
-			if err != nil {
-				log.Printf("Failed to convert balance to float", values)
-				continue
-			}
-			stockData, ok := values["stocks"].(string)
-			if !ok {
-				log.Printf("Failed to retrieve list of stocks")
-				continue
-			}
-			var stocks []struct {
-				Symbol   string  `json:"symbol"`
-				Quantity float64 `json:"quantity"`
-				Price    float64 `json:"price"`
-			}
-			err = json.Unmarshal([]byte(stockData), &stocks)
-			if err != nil {
-				log.Println("Failed to deserialized stock data: ", err)
-				continue
-			}
-			err = addToSQL(db, userId, action, balance, stocks)
-			if err != nil {
-				log.Println("Error processing to SQL: ", err)
-				continue
-			}
-			_, err = redisClient.Client.XAck(context.Background(), "buy_stream", "sql_workers", jobID).Result()
-			if err != nil {
-				log.Println("Error acknowledging job: ", err)
-			} else {
-				_, trimErr := redisClient.Client.XTrimMinID(context.Background(), "buy_stream", jobID).Result()
-				if trimErr != nil {
-					log.Println("❌ Error trimming Redis stream:", trimErr)
-				}else{
-					log.Println("Successfully trimmed!")
+		err = inShards(entries, workers, func(shard []Event) error {
+			for i, entry := range shard {
+				if !persistEntry(db, entry) {
+					streamBus.Nack(ctx, "buy_stream", "sql_workers", shard[i:])
+					return fmt.Errorf("stream entry %s left pending", entry.ID)
 				}
-				// redisClient.Client.XDel(context.Background(), "buy_stream", jobID)
-
-				// log.Printf("Trade %s acknowledged", jobID)
-				// redisClient.Client.XTrimMaxLen(context.Background(), "buy_stream", 200000).Result()
-				// if trimErr != nil {
-				// 	log.Println("❌ Error trimming Redis stream: ", trimErr)
-				// } else {
-				// 	log.Println("✅ Successfully trimmed processed trades.")
-				// }
 			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("⚠️ Reading buy_stream again: %v", err)
+			time.Sleep(time.Second)
 		}
 	}
 }
-func StartSQLWorkerPool(workerCount int, db *sql.DB) {
-	var wg sync.WaitGroup
-
-	for i := 1; i <= workerCount; i++ {
-		wg.Add(1)
-		go func(id int) {
-			defer wg.Done()
-			processTrade(id, db)
-		}(i)
-	}
-
-	wg.Wait()
 
+// StartSQLWorkerPool writes buy_stream to Postgres with up to workerCount
+// entries in flight at once. It does not return.
+func StartSQLWorkerPool(workerCount int, db *sql.DB) {
+	processTrade(workerCount, db)
 }
@@ -0,0 +1,128 @@
+package workers
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+
+	"trading-service/pkg/money"
+	"trading-service/pkg/shares"
+)
+
+func balanceOf(t *testing.T, db *sql.DB, userID int) string {
+	t.Helper()
+	var balance money.Money
+	if err := db.QueryRow(`SELECT balance FROM users WHERE id = $1`, userID).Scan(&balance); err != nil {
+		t.Fatal(err)
+	}
+	return balance.String()
+}
+
+// In both mode each path writes a trade's balance with its trade rows, so
+// the user ends on the balance of their latest trade whichever path wins
+// each event id.
+func TestBothPathsLeaveTheLatestBalance(t *testing.T) {
+	db := useTestDB(t)
+	directFirst, kafkaFirst := createTestUser(t, db), createTestUser(t, db)
+	trades := func(userID int) []Trade {
+		return []Trade{
+			testTrade(t, userID, fmt.Sprintf("%d-0", userID), "BUY", "9800.00", "AAPL", "2", "100.00"),
+			testTrade(t, userID, fmt.Sprintf("%d-1", userID), "BUY", "9700.00", "AAPL", "1", "100.00"),
+		}
+	}
+	direct := func(trade Trade) {
+		t.Helper()
+		if err := addToSQL(db, trade.EventID, trade.UserID, trade.Action, trade.Balance, trade.Stocks); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the direct path wins the first trade, Kafka writes both
+	first := trades(directFirst)
+	direct(first[0])
+	if got := balanceOf(t, db, directFirst); got != "9800.00" {
+		t.Fatalf("direct path wrote balance %s, want 9800.00", got)
+	}
+	if err := upsertBalancePositionsAndTradeHistory(db, first); err != nil {
+		t.Fatal(err)
+	}
+	direct(first[1])
+	if got := balanceOf(t, db, directFirst); got != "9700.00" {
+		t.Fatalf("balance %s after both paths, want 9700.00", got)
+	}
+
+	// Kafka wins both trades, the direct path finds them written
+	second := trades(kafkaFirst)
+	if err := upsertBalancePositionsAndTradeHistory(db, second); err != nil {
+		t.Fatal(err)
+	}
+	direct(second[0])
+	direct(second[1])
+	if got := balanceOf(t, db, kafkaFirst); got != "9700.00" {
+		t.Fatalf("balance %s after both paths, want 9700.00", got)
+	}
+}
+
+// A replayed old trade is written without putting back its balance: the
+// newer trade already in Postgres has the user's current one.
+func TestReplayedTradeKeepsTheNewerBalance(t *testing.T) {
+	db := useTestDB(t)
+	direct, kafka := createTestUser(t, db), createTestUser(t, db)
+	trades := func(userID int) (old, newer Trade) {
+		return testTrade(t, userID, fmt.Sprintf("%d-0", userID), "BUY", "9800.00", "AAPL", "2", "100.00"),
+			testTrade(t, userID, fmt.Sprintf("%d-1", userID), "BUY", "9700.00", "AAPL", "1", "100.00")
+	}
+
+	old, newer := trades(direct)
+	for _, trade := range []Trade{newer, old} {
+		if err := addToSQL(db, trade.EventID, trade.UserID, trade.Action, trade.Balance, trade.Stocks); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := balanceOf(t, db, direct); got != "9700.00" {
+		t.Fatalf("direct path left balance %s, want 9700.00", got)
+	}
+
+	old, newer = trades(kafka)
+	for _, batch := range [][]Trade{{newer}, {old}} {
+		if err := upsertBalancePositionsAndTradeHistory(db, batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := balanceOf(t, db, kafka); got != "9700.00" {
+		t.Fatalf("Kafka path left balance %s, want 9700.00", got)
+	}
+
+	for _, userID := range []int{direct, kafka} {
+		var quantity string
+		db.QueryRow(`SELECT quantity FROM positions WHERE user_id = $1 AND symbol = 'AAPL'`, userID).Scan(&quantity)
+		if quantity != "3.000000" {
+			t.Fatalf("user %d holds %s AAPL, want both trades applied", userID, quantity)
+		}
+	}
+}
+
+// Legs of the same symbol in one entry are applied as one position change.
+func TestAddToSQLFoldsRepeatedSymbols(t *testing.T) {
+	db := useTestDB(t)
+	userID := createTestUser(t, db)
+	buy := testTrade(t, userID, fmt.Sprintf("%d-0", userID), "BUY", "9670.00", "AAPL", "2", "100.00")
+	buy.Stocks = append(buy.Stocks, testTrade(t, userID, "", "BUY", "0", "AAPL", "1", "130.00").Stocks...)
+	sell := testTrade(t, userID, fmt.Sprintf("%d-1", userID), "SELL", "9930.00", "AAPL", "1", "130.00")
+	sell.Stocks = append(sell.Stocks, sell.Stocks[0])
+
+	for _, trade := range []Trade{buy, sell} {
+		if err := addToSQL(db, trade.EventID, trade.UserID, trade.Action, trade.Balance, trade.Stocks); err != nil {
+			t.Fatalf("%s: %v", trade.Action, err)
+		}
+	}
+	var quantity shares.Quantity
+	var average money.Money
+	err := db.QueryRow(`SELECT quantity, average_price FROM positions WHERE user_id = $1 AND symbol = 'AAPL'`, userID).Scan(&quantity, &average)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := quantity.String() + "@" + average.String(); got != "1@110.00" {
+		t.Fatalf("position %s, want 1@110.00", got)
+	}
+}
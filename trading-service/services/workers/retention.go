@@ -0,0 +1,183 @@
+package workers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"trading-service/pkg/redisClient"
+)
+
+// Workers only ack stream entries; the retention manager is the one place
+// that removes them. An entry can go once every consumer group on the stream
+// is done with it: the group has read past it and it is not in the group's
+// pending list. Below that floor, entries are trimmed once the stream is
+// longer than MaxLen or they are older than MaxAge. Entries above the floor
+// are kept however long or old the stream gets, so a lagging or stopped group
+// holds trimming back instead of missing events.
+type RetentionConfig struct {
+	Stream   string
+	MaxLen   int64         // entries to keep; 0 trims every processed entry
+	MaxAge   time.Duration // age after which processed entries are trimmed; 0 disables it
+	Interval time.Duration
+}
+
+// trimBatch bounds how many entries over MaxLen one run looks at.
+const trimBatch = 10000
+
+// RetentionStats describe the last retention run of one stream.
+type RetentionStats struct {
+	Length  int64  `json:"length"`
+	Floor   string `json:"floor,omitempty"` // first entry some group still needs
+	Trimmed int64  `json:"trimmed"`         // total since startup
+	LastRun string `json:"last_run,omitempty"`
+}
+
+var (
+	retentionMutex sync.Mutex
+	retentionStats = make(map[string]*RetentionStats)
+)
+
+// StartRetention trims cfg.Stream every cfg.Interval.
+func StartRetention(cfg RetentionConfig) {
+	go func() {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := trimStream(cfg); err != nil {
+				log.Printf("❌ Failed to trim %s: %v", cfg.Stream, err)
+			}
+		}
+	}()
+	log.Printf("✅ Retention for %s running every %s (max length %d, max age %s)", cfg.Stream, cfg.Interval, cfg.MaxLen, cfg.MaxAge)
+}
+
+func trimStream(cfg RetentionConfig) error {
+	ctx := context.Background()
+	floor, err := consumedFloor(ctx, cfg.Stream)
+	if err != nil || floor == "" {
+		return err
+	}
+	length, err := redisClient.Client.XLen(ctx, cfg.Stream).Result()
+	if err != nil {
+		return err
+	}
+
+	// without limits everything below the floor goes, otherwise only what
+	// is over one of them
+	minID := floor
+	if cfg.MaxLen > 0 || cfg.MaxAge > 0 {
+		minID = "0-0"
+		if cfg.MaxAge > 0 {
+			minID = fmt.Sprintf("%d-0", time.Now().Add(-cfg.MaxAge).UnixMilli())
+		}
+		if excess := length - cfg.MaxLen; cfg.MaxLen > 0 && excess > 0 {
+			if excess > trimBatch {
+				excess = trimBatch
+			}
+			over, err := redisClient.Client.XRangeN(ctx, cfg.Stream, "-", "+", excess).Result()
+			if err != nil {
+				return err
+			}
+			if len(over) > 0 {
+				if id := nextStreamID(over[len(over)-1].ID); compareStreamIDs(id, minID) > 0 {
+					minID = id
+				}
+			}
+		}
+		if compareStreamIDs(minID, floor) > 0 {
+			minID = floor
+		}
+	}
+
+	trimmed, err := redisClient.Client.XTrimMinID(ctx, cfg.Stream, minID).Result()
+	if err != nil {
+		return err
+	}
+	if cfg.MaxLen > 0 && length-trimmed > cfg.MaxLen {
+		log.Printf("⚠️ %s holds %d entries, over its max length of %d, because a consumer group has not processed them yet (floor %s)", cfg.Stream, length-trimmed, cfg.MaxLen, floor)
+	}
+
+	retentionMutex.Lock()
+	defer retentionMutex.Unlock()
+	stats, ok := retentionStats[cfg.Stream]
+	if !ok {
+		stats = &RetentionStats{}
+		retentionStats[cfg.Stream] = stats
+	}
+	stats.Length = length - trimmed
+	stats.Floor = floor
+	stats.Trimmed += trimmed
+	stats.LastRun = time.Now().UTC().Format(time.RFC3339)
+	return nil
+}
+
+// consumedFloor returns the lowest entry id any consumer group on stream
+// still needs: the oldest entry it has pending, or else the entry after the
+// last one delivered to it. It returns "" when the stream has no groups, since
+// nothing is known to be processed then.
+func consumedFloor(ctx context.Context, stream string) (string, error) {
+	groups, err := redisClient.Client.XInfoGroups(ctx, stream).Result()
+	if err != nil {
+		if strings.Contains(err.Error(), "no such key") {
+			return "", nil
+		}
+		return "", err
+	}
+	floor := ""
+	for _, group := range groups {
+		needed := nextStreamID(group.LastDeliveredID)
+		if group.Pending > 0 {
+			pending, err := redisClient.Client.XPending(ctx, stream, group.Name).Result()
+			if err != nil {
+				return "", err
+			}
+			needed = pending.Lower
+		}
+		if floor == "" || compareStreamIDs(needed, floor) < 0 {
+			floor = needed
+		}
+	}
+	return floor, nil
+}
+
+// parseStreamID splits a stream id into its millisecond and sequence parts.
+func parseStreamID(id string) (uint64, uint64) {
+	ms, seq, _ := strings.Cut(id, "-")
+	msPart, _ := strconv.ParseUint(ms, 10, 64)
+	seqPart, _ := strconv.ParseUint(seq, 10, 64)
+	return msPart, seqPart
+}
+
+func compareStreamIDs(a, b string) int {
+	aMs, aSeq := parseStreamID(a)
+	bMs, bSeq := parseStreamID(b)
+	switch {
+	case aMs < bMs, aMs == bMs && aSeq < bSeq:
+		return -1
+	case aMs == bMs && aSeq == bSeq:
+		return 0
+	}
+	return 1
+}
+
+// nextStreamID returns the smallest id after id.
+func nextStreamID(id string) string {
+	ms, seq := parseStreamID(id)
+	return fmt.Sprintf("%d-%d", ms, seq+1)
+}
+
+// RetentionMetrics returns the retention stats per stream.
+func RetentionMetrics() map[string]RetentionStats {
+	retentionMutex.Lock()
+	defer retentionMutex.Unlock()
+	metrics := make(map[string]RetentionStats, len(retentionStats))
+	for stream, stats := range retentionStats {
+		metrics[stream] = *stats
+	}
+	return metrics
+}
@@ -2,20 +2,23 @@ package workers
 
 import (
 	"context"
-	"fmt"
+	"errors"
 	"log"
 	"net/http"
-	"strconv"
 	"sync"
+	"time"
 
-	"trading-service/pkg/redisClient"
+	"trading-service/pkg/money"
+	"trading-service/pkg/shares"
 	redisStorage "trading-service/redis"
+	"trading-service/services/orders"
 	trade_service "trading-service/services/trade"
 )
 
 type TradeJob struct {
 	Trade trade_service.TradeRequest
 }
+
 var TradeJobQueue = make(chan TradeJob, 10000)
 
 func TradeWorker(id int, jobs <-chan TradeJob, wg *sync.WaitGroup) {
@@ -24,30 +27,136 @@ func TradeWorker(id int, jobs <-chan TradeJob, wg *sync.WaitGroup) {
 	for job := range jobs {
 		ctx := context.Background()
 		tradeData := job.Trade
+		// every trade is persisted as an order before it is queued
+		if tradeData.OrderID == 0 {
+			log.Printf("Dropping trade for user %d: it has no order (%d)", tradeData.UserID, http.StatusBadRequest)
+			continue
+		}
+		// pick up any amendment and skip orders canceled while queued
+		o, ok := orders.Claim(tradeData.OrderID)
+		if !ok {
+			log.Printf("Skipping order %d: canceled before execution", tradeData.OrderID)
+			continue
+		}
+		tradeData = o.ToTrade()
 
-		balanceStr, err := redisClient.Client.HGet(ctx, "user_balance", fmt.Sprint(tradeData.UserID)).Result()
-		balance, err := strconv.ParseFloat(balanceStr, 64)
-		if err != nil {
-			log.Printf("User not found or balance", http.StatusBadRequest)
+		if err := validQuantities(tradeData); err != nil {
+			log.Printf("Rejected trade for user %d: %v (%d)", tradeData.UserID, err, http.StatusBadRequest)
+			rejectOrder(ctx, tradeData, orders.ReasonInvalidQuantity)
+			continue
+		}
+		if err := orders.Validate(tradeData); err != nil {
+			log.Printf("Rejected order %d: %v (%d)", tradeData.OrderID, err, http.StatusBadRequest)
+			rejectOrder(ctx, tradeData, orders.ReasonInvalidOrder)
+			continue
 		}
-		var totalCost float64
+		var totalCost money.Money
+		unpriced := ""
+		overflow := false
 		for i, stock := range tradeData.Stock {
 			stockPrice, err := redisStorage.GetStockPrice(stock.Symbol)
 			if err != nil {
-				log.Printf("Failed to fetch price", err)
-			} else {
-				tradeData.Stock[i].Price = stockPrice
+				log.Printf("Failed to fetch price: %v", err)
+				unpriced = orders.ReasonPriceUnavailable
+				if errors.Is(err, redisStorage.ErrStalePrice) {
+					unpriced = orders.ReasonStalePrice
+				}
+				break
 			}
-			totalCost += stockPrice * stock.Quantity
+			tradeData.Stock[i].Price = stockPrice
+			cost, err := stockPrice.Times(stock.Quantity)
+			if err != nil {
+				log.Printf("Rejected order %d: %s of %s at %s: %v (%d)", tradeData.OrderID, stock.Quantity, stock.Symbol, stockPrice, err, http.StatusBadRequest)
+				overflow = true
+				break
+			}
+			totalCost += cost
+		}
+		if unpriced != "" {
+			rejectOrder(ctx, tradeData, unpriced)
+			continue
+		}
+		if overflow {
+			rejectOrder(ctx, tradeData, orders.ReasonInvalidQuantity)
+			continue
 		}
-		if totalCost <= balance {
-			trade_service.ExecuteBuy(ctx, tradeData, balance, totalCost)
-		} else {
-			log.Print(totalCost, balance, tradeData.UserID)
-			log.Printf("Insufficient funds",  http.StatusForbidden)
+		side := trade_service.TradeType(tradeData.Action)
+		if tradeData.OrderTypeOrMarket() == "LIMIT" && !orders.Crosses(side, tradeData.LimitPrice, tradeData.Stock[0].Price) {
+			// the price moved back through the limit while the job was queued
+			orders.Rest(orders.FromTrade(tradeData))
 			continue
 		}
+		// the balance and position checks happen inside the trade scripts,
+		// which refuse to run while Redis is reloaded from Postgres
+		err := execute(ctx, side, tradeData, totalCost)
+		for errors.Is(err, trade_service.ErrHydrating) {
+			time.Sleep(hydrationWait)
+			err = execute(ctx, side, tradeData, totalCost)
+		}
+		switch {
+		case err == nil:
+			fillOrder(ctx, tradeData)
+		case errors.Is(err, trade_service.ErrUnknownUser):
+			log.Printf("User %d not found or balance invalid (%d)", tradeData.UserID, http.StatusBadRequest)
+			rejectOrder(ctx, tradeData, orders.ReasonUnknownUser)
+		case errors.Is(err, trade_service.ErrInsufficientFunds):
+			log.Printf("Insufficient funds for user %d: cost %s (%d)", tradeData.UserID, totalCost, http.StatusForbidden)
+			rejectOrder(ctx, tradeData, orders.ReasonInsufficientFunds)
+		case errors.Is(err, trade_service.ErrInsufficientShares):
+			log.Printf("Sell rejected for user %d: %v (%d)", tradeData.UserID, err, http.StatusForbidden)
+			rejectOrder(ctx, tradeData, orders.ReasonInsufficientShares)
+		default:
+			log.Printf("%s failed for user %d: %v", side, tradeData.UserID, err)
+			rejectOrder(ctx, tradeData, orders.ReasonExecutionFailed)
+		}
+	}
+}
+
+// hydrationWait is how long a trade worker waits before trying a trade
+// again that was refused while Redis was being hydrated.
+const hydrationWait = 500 * time.Millisecond
+
+// execute runs the trade script for side.
+func execute(ctx context.Context, side string, trade trade_service.TradeRequest, total money.Money) error {
+	var err error
+	if side == "SELL" {
+		_, err = trade_service.ExecuteSell(ctx, trade, total)
+	} else {
+		_, err = trade_service.ExecuteBuy(ctx, trade, total)
+	}
+	return err
+}
+
+// fillOrder records that an order-backed trade executed in Redis.
+func fillOrder(ctx context.Context, trade trade_service.TradeRequest) {
+	if trade.OrderID == 0 {
+		return
+	}
+	if err := orders.SetStatus(ctx, trade.OrderID, "FILLED"); err != nil {
+		log.Printf("❌ %v", err)
+	}
+	orders.Record(ctx, trade.OrderID, orders.StageFilled, "")
+}
+
+// rejectOrder records why a worker refused an order-backed trade.
+func rejectOrder(ctx context.Context, trade trade_service.TradeRequest, reason string) {
+	if trade.OrderID == 0 {
+		return
+	}
+	if err := orders.SetStatus(ctx, trade.OrderID, "REJECTED"); err != nil {
+		log.Printf("❌ %v", err)
+	}
+	orders.Record(ctx, trade.OrderID, orders.StageRejected, reason)
+}
+
+// validQuantities checks every leg against its symbol's minimum increment.
+func validQuantities(trade trade_service.TradeRequest) error {
+	for _, stock := range trade.Stock {
+		if err := shares.Validate(stock.Symbol, stock.Quantity); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 func StartWorkerPool(workerCount int, jobs chan TradeJob) {
@@ -60,11 +169,3 @@ func StartWorkerPool(workerCount int, jobs chan TradeJob) {
 		go TradeWorker(i, jobs, &wg)
 	}
 }
-func EnsureRedisStream() {
-	ctx := context.Background()
-	err := redisClient.Client.XGroupCreateMkStream(ctx, "buy_stream", "kafka_workers", "$").Err()
-	if err != nil && err.Error() != "BUSYGROUP Consumer Group name already exists" {
-		log.Fatalf("Error creating consumer group: %v", err)
-	}
-	log.Println("✅ Redis Stream + 'kafka_workers' group ready!")
-}
@@ -0,0 +1,31 @@
+package workers
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	trade_service "trading-service/services/trade"
+)
+
+// A trade that never became an order, such as a limit request with no
+// stocks, is dropped instead of crashing the worker.
+func TestWorkerDropsTradesWithoutAnOrder(t *testing.T) {
+	jobs := make(chan TradeJob, 1)
+	jobs <- TradeJob{Trade: trade_service.TradeRequest{UserID: 1, Action: "BUY", OrderType: "LIMIT"}}
+	close(jobs)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go TradeWorker(1, jobs, &wg)
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("worker did not finish the queue")
+	}
+}
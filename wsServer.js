@@ -1,12 +1,13 @@
 import {WebSocketServer} from "ws";
 import redis from './redis.js'
+import {getAllLastPrices} from './services/priceStore.js'
 const wss = new WebSocketServer({port: 8080})
 
 wss.on('connection', async (ws)=>{
     console.log("New WebSocket Connection");
     ws.send(JSON.stringify({message: "Connected to live updates"}));
       const start = Date.now();
-      redis.hGetAll("stockPrices").then(stockData=>{
+      getAllLastPrices().then(stockData=>{
         wss.clients.forEach(client =>{
             if(client.readyState === 1){
                 client.send(JSON.stringify({type:"stocks", data: stockData}))
@@ -50,7 +51,7 @@ export async function pushLeaderboard(){
     console.log("Leaderboard update sent to WebSocket Clients")
 }
 export function pushStockPrices(){
-    redis.hGetAll("stockPrices").then(stockData=>{
+    getAllLastPrices().then(stockData=>{
         wss.clients.forEach(client =>{
             if(client.readyState === 1){
                 client.send(JSON.stringify({type:"stocks", data: stockData}))